@@ -0,0 +1,80 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// RawValue returns the encoded bytes of the value stored under key in the dictionary data,
+// exactly as they appear in data. The info hash of a torrent is computed over these bytes.
+func RawValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("bencode: not a dictionary")
+	}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		keyEnd, err := skipValue(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		if data[pos] < '0' || data[pos] > '9' {
+			return nil, fmt.Errorf("bencode: dictionary key at offset %d is not a string", pos)
+		}
+		k := data[bytes.IndexByte(data[pos:], ':')+pos+1 : keyEnd]
+		valueEnd, err := skipValue(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if string(k) == key {
+			return data[keyEnd:valueEnd], nil
+		}
+		pos = valueEnd
+	}
+	return nil, fmt.Errorf("bencode: key %q not found", key)
+}
+
+// skipValue returns the offset just past the value that starts at pos.
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, errors.New("bencode: unexpected end of data")
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, errors.New("bencode: unterminated integer")
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			next, err := skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+		if pos >= len(data) {
+			return 0, errors.New("bencode: unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[pos:], ':')
+		if colon < 0 {
+			return 0, errors.New("bencode: invalid string length")
+		}
+		n, err := strconv.Atoi(string(data[pos : pos+colon]))
+		if err != nil || n < 0 {
+			return 0, errors.New("bencode: invalid string length")
+		}
+		end := pos + colon + 1 + n
+		if end > len(data) {
+			return 0, errors.New("bencode: string runs past the end of data")
+		}
+		return end, nil
+	default:
+		return 0, fmt.Errorf("bencode: unexpected byte %q at offset %d", c, pos)
+	}
+}
@@ -0,0 +1,87 @@
+// Description: Accept completes the handshake of a connection a peer opened to us.
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"bit-torrent/bitfield"
+	"bit-torrent/handshake"
+	"bit-torrent/mse"
+	"bit-torrent/peers"
+)
+
+// Torrents is the set of torrents we accept connections for
+type Torrents interface {
+	// InfoHashes returns the info hashes of the torrents
+	InfoHashes() [][20]byte
+	// Lookup returns the peer ID we use for a torrent, the pieces we have and its number of pieces,
+	// or false if we do not serve it
+	Lookup(infoHash [20]byte) (peerID [20]byte, have bitfield.Bitfield, numPieces int, ok bool)
+}
+
+// Accept completes the handshake of a connection a peer opened to us
+// The encryption handshake runs according to the Encryption policy, then the peer's handshake is read first
+// and routed to one of torrents. We answer with our handshake, extended handshake and bitfield (or Have All/Have None)
+// and wait for the peer's bitfield; a peer that has no pieces may send none, or start with another message.
+// It returns the client and an error if one occurred.
+func Accept(conn net.Conn, torrents Torrents) (*Client, error) {
+	encrypted, err := mse.Accept(conn, Encryption, torrents.InfoHashes)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, have, numPieces, err := acceptHandShake(encrypted, torrents)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	err = c.SendHaveState(have, numPieces)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	err = c.recvHaveState()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// acceptHandShake reads the peer's handshake, answers it and sends the messages that follow it
+// It returns the client, the pieces we have of its torrent, its number of pieces and an error if one occurred.
+func acceptHandShake(conn net.Conn, torrents Torrents) (*Client, bitfield.Bitfield, int, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	res, err := handshake.Read(conn)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	peerID, have, numPieces, ok := torrents.Lookup(res.InfoHash)
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("Peer %s asked for unknown torrent %x", conn.RemoteAddr(), res.InfoHash)
+	}
+	_, err = conn.Write(ourHandshake(res.InfoHash, peerID).Serialize())
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := newClient(conn, remotePeer(conn), res.InfoHash, peerID, res)
+	err = c.start(res)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return c, have, numPieces, nil
+}
+
+// remotePeer returns the address of the other side of a connection
+func remotePeer(conn net.Conn) peers.Peer {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return peers.Peer{}
+	}
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
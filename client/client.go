@@ -4,25 +4,64 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"bit-torrent/bitfield"
 	"bit-torrent/handshake"
 	"bit-torrent/message"
+	"bit-torrent/mse"
 	"bit-torrent/peers"
+	"bit-torrent/proxy"
 )
 
-// this is a Client struct that contains the following fields:  Conn, Choked, Bitfield, Peer, infoHash, and peerID
+// Proxy is the proxy peer connections are made through, or nil to connect directly
+var Proxy proxy.Dialer
+
+// MessageTimeout is how long the rest of a message may take once WaitMessage saw it start
+const MessageTimeout = 30 * time.Second
+
+// Encryption is the policy for encrypting the connections we open (Message Stream Encryption)
+var Encryption = mse.Disabled
+
+// DHTPort is the UDP port of our DHT node, sent to peers that support the DHT, or 0 if we run none
+var DHTPort uint16
+
+// PortHandler, if set, is called with the DHT port a peer sends in a PORT message
+var PortHandler func(peer peers.Peer, port uint16)
+
+// this is a Client struct that contains the following fields:  Conn, Choked, Peer, infoHash, and peerID
+// Writes are serialized, so messages may be sent from several goroutines.
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
-	Bitfield bitfield.Bitfield
 	Peer     peers.Peer
 	infoHash [20]byte
 	peerID   [20]byte
+
+	piecesMu sync.Mutex        // guards pieces and haveAll
+	pieces   bitfield.Bitfield // the pieces the peer has
+	haveAll  bool              // the peer sent Have All instead of a bitfield
+
+	reader  *bufio.Reader    // reads from Conn; WaitMessage peeks into it
+	pending *message.Message // a message that came instead of the bitfield, returned by the next Read
+
+	extended bool               // the peer supports the extension protocol
+	extMu    sync.Mutex         // guards ext
+	ext      *ExtendedHandshake // the peer's extended handshake, nil until received
+	writeMu  sync.Mutex
+
+	stateMu        sync.Mutex // guards interested and peerInterested
+	interested     bool       // we told the peer we are interested
+	peerInterested bool       // the peer told us it is interested
+
+	fast        bool         // both sides support the Fast Extension
+	fastMu      sync.Mutex   // guards allowedFast
+	allowedFast map[int]bool // pieces the peer lets us request while choked
 }
 
 // completeHandShake completes the handshake with the peer
@@ -31,8 +70,7 @@ func completeHandShake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
-	req := handshake.New(infohash, peerID)
-	_, err := conn.Write(req.Serialize())
+	_, err := conn.Write(ourHandshake(infohash, peerID).Serialize())
 	if err != nil {
 		return nil, err
 	}
@@ -48,49 +86,178 @@ func completeHandShake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-// recvBitfield receives a bitfield message from the peer
-// It returns the bitfield and an error if one occurred.
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+// ourHandshake returns the handshake we send, with the reserved bits of the extensions we support
+func ourHandshake(infoHash, peerID [20]byte) *handshake.HandShake {
+	h := handshake.New(infoHash, peerID)
+	if DHTPort != 0 {
+		h.SetBit(handshake.BitDHT)
+	}
+	return h
+}
+
+// recvHaveState waits for the message that tells which pieces the peer has
+// A peer without pieces may send none: when no message starts within 5 seconds, or another message comes first,
+// the peer is taken to have no pieces and the message is kept for the next Read, so it is processed like any other.
+// A bitfield that comes later replaces the empty one. Only the start of a message is waited for this way; a message
+// that stalls part-way through fails the connection, since its framing would be lost.
+// It returns an error if the connection failed.
+func (c *Client) recvHaveState() error {
+	end := time.Now().Add(5 * time.Second)
+	for {
+		started, err := c.WaitMessage(time.Until(end))
+		if err != nil {
+			return err
+		}
+		if !started {
+			c.SetBitfield(bitfield.Bitfield{})
+			return nil
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(MessageTimeout))
+		msg, err := c.Read()
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
+		if msg != nil && (msg.ID == message.MsgExtended || msg.ID == message.MsgPort || msg.ID == message.MsgAllowedFast) {
+			continue
+		}
+		switch {
+		case msg != nil && msg.ID == message.MsgBitfield:
+			c.SetBitfield(msg.Payload)
+		case msg != nil && c.fast && msg.ID == message.MsgHaveAll:
+			c.SetHaveAll()
+		case msg != nil && c.fast && msg.ID == message.MsgHaveNone:
+			c.SetBitfield(bitfield.Bitfield{})
+		default:
+			c.SetBitfield(bitfield.Bitfield{})
+			c.pending = msg // nil for a keep-alive, which needs no processing
+		}
+		return nil
+	}
+}
 
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
+// WaitMessage waits up to timeout for the peer to start sending a message, without reading any of it
+// Nothing is lost when the wait times out, so the connection stays usable, unlike after a read that times out
+// part-way through a message. The caller reads the message with Read.
+// It returns whether a message started and an error if the connection failed.
+func (c *Client) WaitMessage(timeout time.Duration) (bool, error) {
+	if c.pending != nil {
+		return true, nil
 	}
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
-		return nil, err
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := c.reader.Peek(1)
+	c.Conn.SetReadDeadline(time.Time{})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false, nil
 	}
-	return msg.Payload, nil
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// New creates a new Client
+// Connect dials the peer and completes the handshake, including the extended handshake
+// if both sides support the extension protocol. It does not wait for the peer's bitfield.
+// The connection is encrypted according to the Encryption policy.
 // It returns the client and an error if one occurred.
-func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// IPv4 and IPv6 peers are dialed on their own address family.
+func Connect(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	conn, err := dialEncrypted(peer, infoHash)
 	if err != nil {
 		return nil, err
 	}
-	_, err = completeHandShake(conn, infoHash, peerID)
+	res, err := completeHandShake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	bf, err := recvBitfield(conn)
+
+	c := newClient(conn, peer, infoHash, peerID, res)
+	err = c.start(res)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	return c, nil
+}
 
+// newClient creates a client for a connection whose handshakes have been exchanged
+func newClient(conn net.Conn, peer peers.Peer, infoHash, peerID [20]byte, res *handshake.HandShake) *Client {
 	return &Client{
 		Conn:     conn,
+		reader:   bufio.NewReader(conn),
 		Choked:   true,
-		Bitfield: bf,
 		Peer:     peer,
 		infoHash: infoHash,
 		peerID:   peerID,
-	}, nil
+		extended: res.HasBit(handshake.BitExtended),
+		fast:     res.HasBit(handshake.BitFast),
+	}
+}
+
+// start sends the messages that follow the handshake: our extended handshake and our DHT port
+// if the peer announced support for them.
+// It returns an error if one occurred.
+func (c *Client) start(res *handshake.HandShake) error {
+	if c.extended {
+		err := c.sendExtendedHandshake()
+		if err != nil {
+			return err
+		}
+	}
+	if DHTPort != 0 && res.HasBit(handshake.BitDHT) {
+		return c.write(message.FormatPort(DHTPort))
+	}
+	return nil
+}
+
+// New creates a new Client
+// Right after the handshake it tells the peer which of the numPieces pieces we have and waits for the peer's bitfield;
+// a peer that has no pieces may send none, or start with another message.
+// It returns the client and an error if one occurred.
+// IPv4 and IPv6 peers are dialed on their own address family.
+func New(peer peers.Peer, peerID, infoHash [20]byte, have bitfield.Bitfield, numPieces int) (*Client, error) {
+	c, err := Connect(peer, peerID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	err = c.SendHaveState(have, numPieces)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	err = c.recvHaveState()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dial opens a TCP connection to the peer, through Proxy if one is set
+func Dial(peer peers.Peer) (net.Conn, error) {
+	if Proxy != nil {
+		return Proxy.DialTimeout(peer.Network(), peer.String(), 3*time.Second)
+	}
+	return net.DialTimeout(peer.Network(), peer.String(), 3*time.Second)
+}
+
+// dialEncrypted opens a connection to the peer and runs the encryption handshake the Encryption policy asks for
+// With the Preferred policy a peer that does not speak encryption is dialed again in plaintext.
+func dialEncrypted(peer peers.Peer, infoHash [20]byte) (net.Conn, error) {
+	conn, err := Dial(peer)
+	if err != nil || Encryption == mse.Disabled {
+		return conn, err
+	}
+	encrypted, err := mse.Initiate(conn, infoHash, Encryption)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if Encryption == mse.Required {
+		return nil, err
+	}
+	return Dial(peer)
 }
 
 // Close closes the connection
@@ -98,65 +265,160 @@ func (c *Client) Close() error {
 	return c.Conn.Close()
 }
 
+// InfoHash returns the info hash of the torrent the connection is for
+func (c *Client) InfoHash() [20]byte {
+	return c.infoHash
+}
+
 // Read reads and consumes a message from the connection
+// Extended messages are passed to the extended handshake or the registered extension handler,
+// PORT messages to PortHandler and Allowed Fast messages to the allowed fast set, and Interested and
+// Not Interested are recorded, before being returned.
 // It returns the message and an error if one occurred.
 func (c *Client) Read() (*message.Message, error) {
-	msg, err := message.Read(c.Conn)
+	if c.pending != nil {
+		msg := c.pending
+		c.pending = nil
+		return msg, nil // already handled when it was read
+	}
+	msg, err := message.Read(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if msg != nil && msg.ID == message.MsgExtended {
+		err = c.handleExtended(msg)
+	}
+	if msg != nil && msg.ID == message.MsgAllowedFast {
+		index, err := message.ParseAllowedFast(msg)
+		if err == nil {
+			c.allowFast(index)
+		}
+	}
+	if msg != nil && (msg.ID == message.MsgInterested || msg.ID == message.MsgNotInterested) {
+		c.stateMu.Lock()
+		c.peerInterested = msg.ID == message.MsgInterested
+		c.stateMu.Unlock()
+	}
+	if msg != nil && msg.ID == message.MsgPort && PortHandler != nil {
+		port, err := message.ParsePort(msg)
+		if err == nil && port != 0 {
+			PortHandler(c.Peer, port)
+		}
+	}
 	return msg, err
 }
 
+// write serializes a message and writes it to the connection
+// It returns an error if one occurred.
+func (c *Client) write(msg *message.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 // SendRequest sends a Request message to the peer
 // It returns an error if one occurred.
 func (c *Client) SendRequest(index, begin, length int) error {
 	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.write(req)
 }
 
 // SendInterested sends an Interested message to the peer
 // It returns an error if one occurred.
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	c.setInterested(true)
+	msg := &message.Message{ID: message.MsgInterested}
+	return c.write(msg)
 }
 
 // SendNotInterested sends a NotInterested message to the peer
 // It returns an error if one occurred.
 func (c *Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	c.setInterested(false)
+	msg := &message.Message{ID: message.MsgNotInterested}
+	return c.write(msg)
+}
+
+// setInterested records the interest we told the peer about
+func (c *Client) setInterested(interested bool) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.interested = interested
+}
+
+// Interested reports whether we told the peer we are interested in its pieces
+func (c *Client) Interested() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.interested
+}
+
+// PeerInterested reports whether the peer told us it is interested in our pieces
+func (c *Client) PeerInterested() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.peerInterested
+}
+
+// SendChoke sends a Choke message to the peer
+// It returns an error if one occurred.
+func (c *Client) SendChoke() error {
+	msg := &message.Message{ID: message.MsgChoke}
+	return c.write(msg)
 }
 
 // SendUnchoke sends an Unchoke message to the peer
 // It returns an error if one occurred.
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	msg := &message.Message{ID: message.MsgUnchoke}
+	return c.write(msg)
 }
 
 // SendPiece senda a piece message to the peer
 // It returns an error if one occurred.
 func (c *Client) SendPiece(index, begin int, data []byte) error {
 	msg := message.FormatPiece(index, begin, data)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(msg)
+}
+
+// SendBitfield sends a Bitfield message to the peer
+// It returns an error if one occurred.
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	msg := &message.Message{ID: message.MsgBitfield, Payload: bf}
+	return c.write(msg)
+}
+
+// SendHaveState tells the peer which of the numPieces pieces we have, as the first message after the handshake
+// With the Fast Extension a complete or empty set is sent as Have All or Have None, otherwise as a bitfield.
+// It returns an error if one occurred.
+func (c *Client) SendHaveState(have bitfield.Bitfield, numPieces int) error {
+	if c.fast {
+		count := 0
+		for i := 0; i < numPieces; i++ {
+			if have.HasPiece(i) {
+				count++
+			}
+		}
+		switch count {
+		case numPieces:
+			return c.SendHaveAll()
+		case 0:
+			return c.SendHaveNone()
+		}
+	}
+	return c.SendBitfield(have)
 }
 
 // SendHave sends a Have message to the peer
 // It returns an error if one occurred.
 func (c *Client) SendHave(index int) error {
 	msg := message.FormatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(msg)
 }
 
 // SendKeepAlive sends a KeepAlive message to the peer
 // It returns an error if one occurred.
 func (c *Client) SendKeepAlive() error {
-	msg := message.Message{}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(nil) // a nil message serializes to the empty keep-alive
 }
@@ -0,0 +1,243 @@
+// Description: Extension protocol (BEP 10): the extended handshake and a registry of extension message handlers.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"bit-torrent/bencode"
+	"bit-torrent/message"
+	"bit-torrent/mse"
+)
+
+// Version is the client name and version sent in the extended handshake
+const Version = "bit-torrent 0.1"
+
+// MaxRequestQueue is the number of outstanding requests we accept from a peer, sent as reqq
+const MaxRequestQueue = 250
+
+// ListenPort is the port advertised in the extended handshake, or 0 to not advertise one
+var ListenPort uint16
+
+// ExtensionHandler handles an extended message a peer sent for a registered extension
+// payload is the message without the extended message ID.
+type ExtensionHandler func(c *Client, payload []byte) error
+
+// extension is an entry of the registry
+type extension struct {
+	name    string
+	id      uint8 // the ID peers use to send us messages of this extension
+	handler ExtensionHandler
+}
+
+var (
+	extensionsMu sync.RWMutex
+	extensions   []extension
+)
+
+// ExtensionFilter, if set, reports whether a registered extension is offered on the connections of a torrent
+// Extensions it rejects are left out of the extended handshake and their messages are ignored.
+var ExtensionFilter func(infoHash [20]byte, name string) bool
+
+// offersExtension reports whether the named extension is offered on the connection
+func (c *Client) offersExtension(name string) bool {
+	return ExtensionFilter == nil || ExtensionFilter(c.infoHash, name)
+}
+
+// RegisterExtension registers a handler for the extended messages of the named extension (e.g. "ut_pex")
+// Registered extensions are advertised in the extended handshake of every later connection.
+// It returns the extended message ID peers use to send us messages of the extension.
+func RegisterExtension(name string, handler ExtensionHandler) uint8 {
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+
+	for i, ext := range extensions {
+		if ext.name == name {
+			extensions[i].handler = handler
+			return ext.id
+		}
+	}
+	id := uint8(len(extensions) + 1) // ID 0 is the extended handshake
+	extensions = append(extensions, extension{name: name, id: id, handler: handler})
+	return id
+}
+
+// lookupExtension returns the registered extension with the given local ID
+func lookupExtension(id uint8) (extension, bool) {
+	extensionsMu.RLock()
+	defer extensionsMu.RUnlock()
+
+	for _, ext := range extensions {
+		if ext.id == id {
+			return ext, true
+		}
+	}
+	return extension{}, false
+}
+
+// ExtendedHandshake is the extended handshake a peer sent us
+type ExtendedHandshake struct {
+	M            map[string]uint8 // extension names to the IDs the peer wants us to use
+	V            string           // client name and version
+	ReqQ         int              // number of outstanding requests the peer accepts
+	YourIP       net.IP           // our address as the peer sees it
+	Port         uint16           // the port the peer listens on
+	MetadataSize int              // size of the info dictionary (BEP 9)
+	Fields       map[string]interface{}
+}
+
+// sendExtendedHandshake sends our extended handshake advertising the registered extensions
+// It returns an error if one occurred.
+func (c *Client) sendExtendedHandshake() error {
+	m := make(map[string]interface{})
+	extensionsMu.RLock()
+	for _, ext := range extensions {
+		if c.offersExtension(ext.name) {
+			m[ext.name] = int(ext.id)
+		}
+	}
+	extensionsMu.RUnlock()
+
+	dict := map[string]interface{}{
+		"m":    m,
+		"v":    Version,
+		"reqq": MaxRequestQueue,
+	}
+	if addr, ok := c.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip := addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		dict["yourip"] = string(ip)
+	}
+	if ListenPort != 0 {
+		dict["p"] = int(ListenPort)
+	}
+	if Encryption != mse.Disabled {
+		dict["e"] = 1 // we support, and prefer, encrypted connections
+	}
+
+	payload, err := EncodeExtended(dict, nil)
+	if err != nil {
+		return err
+	}
+	return c.write(message.FormatExtended(0, payload))
+}
+
+// handleExtended dispatches an extended message to the extended handshake or to the registered handler
+// It returns an error if one occurred.
+func (c *Client) handleExtended(msg *message.Message) error {
+	extID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if extID == 0 {
+		hs, err := parseExtendedHandshake(payload)
+		if err != nil {
+			return err
+		}
+		c.extMu.Lock()
+		c.ext = hs
+		c.extMu.Unlock()
+		return nil
+	}
+
+	ext, ok := lookupExtension(extID)
+	if !ok || ext.handler == nil || !c.offersExtension(ext.name) {
+		return nil // not an extension we know or offer, ignore it
+	}
+	return ext.handler(c, payload)
+}
+
+// SupportsExtended reports whether the peer announced the extension protocol in its handshake
+func (c *Client) SupportsExtended() bool {
+	return c.extended
+}
+
+// ExtendedHandshake returns the extended handshake of the peer, or nil if it has not arrived yet
+func (c *Client) ExtendedHandshake() *ExtendedHandshake {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	return c.ext
+}
+
+// SupportsExtension reports whether the peer advertised the named extension
+func (c *Client) SupportsExtension(name string) bool {
+	hs := c.ExtendedHandshake()
+	return hs != nil && hs.M[name] != 0
+}
+
+// SendExtended sends an extended message of the named extension to the peer
+// It returns an error if the peer does not support the extension or if writing failed.
+func (c *Client) SendExtended(name string, payload []byte) error {
+	hs := c.ExtendedHandshake()
+	if hs == nil || hs.M[name] == 0 {
+		return fmt.Errorf("Peer %s does not support %s", c.Peer, name)
+	}
+	return c.write(message.FormatExtended(hs.M[name], payload))
+}
+
+// parseExtendedHandshake decodes the payload of an extended handshake
+func parseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	dict, _, err := DecodeExtended(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &ExtendedHandshake{M: make(map[string]uint8), Fields: dict}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, v := range m {
+			// An ID of 0 means the extension is disabled
+			if id, ok := v.(int64); ok && id > 0 && id < 256 {
+				hs.M[name] = uint8(id)
+			}
+		}
+	}
+	hs.V, _ = dict["v"].(string)
+	if reqq, ok := dict["reqq"].(int64); ok {
+		hs.ReqQ = int(reqq)
+	}
+	if ip, ok := dict["yourip"].(string); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		hs.YourIP = net.IP(ip)
+	}
+	if p, ok := dict["p"].(int64); ok && p > 0 && p < 65536 {
+		hs.Port = uint16(p)
+	}
+	if size, ok := dict["metadata_size"].(int64); ok {
+		hs.MetadataSize = int(size)
+	}
+	return hs, nil
+}
+
+// EncodeExtended bencodes dict and appends the trailing data some extended messages carry
+// It returns the payload and an error if one occurred.
+func EncodeExtended(dict map[string]interface{}, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, dict)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// DecodeExtended decodes the bencoded dictionary at the start of an extended message payload
+// It returns the dictionary, the bytes that follow it and an error if one occurred.
+func DecodeExtended(payload []byte) (map[string]interface{}, []byte, error) {
+	// A buffer as large as the payload lets us see how much the decoder consumed
+	r := bufio.NewReaderSize(bytes.NewReader(payload), len(payload)+16)
+	data, err := bencode.Decode(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("Extended message is not a dictionary")
+	}
+	return dict, payload[len(payload)-r.Buffered():], nil
+}
@@ -0,0 +1,156 @@
+// Description: Fast Extension (BEP 6): Have All/Have None, rejected requests and allowed fast pieces.
+
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+
+	"bit-torrent/bitfield"
+	"bit-torrent/message"
+)
+
+// AllowedFastCount is the number of pieces we let a choked peer request
+const AllowedFastCount = 10
+
+// AllowedFastSet generates the allowed fast set of a peer as specified in BEP 6
+// The set only depends on the peer's IPv4 address (its /24 network), the info hash and the number of pieces,
+// so both sides can compute it. Peers without an IPv4 address get no set.
+// It returns up to k piece indices.
+func AllowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	var set []int
+	seen := make(map[int]bool)
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// SupportsFast reports whether both sides announced the Fast Extension in their handshakes
+func (c *Client) SupportsFast() bool {
+	return c.fast
+}
+
+// HasPiece reports whether the peer has a piece, from its bitfield or Have All
+func (c *Client) HasPiece(index int) bool {
+	c.piecesMu.Lock()
+	defer c.piecesMu.Unlock()
+	return c.haveAll || c.pieces.HasPiece(index)
+}
+
+// SetPiece records a piece the peer announced with a Have message
+// The bitfield grows as needed, since a peer that sent Have None starts without one.
+func (c *Client) SetPiece(index int) {
+	if index < 0 {
+		return
+	}
+	c.piecesMu.Lock()
+	defer c.piecesMu.Unlock()
+	if index/8 >= len(c.pieces) {
+		bf := make([]byte, index/8+1)
+		copy(bf, c.pieces)
+		c.pieces = bf
+	}
+	c.pieces.SetPiece(index)
+}
+
+// SetBitfield replaces the pieces the peer has with the ones of a Bitfield message
+func (c *Client) SetBitfield(bf bitfield.Bitfield) {
+	c.piecesMu.Lock()
+	defer c.piecesMu.Unlock()
+	c.pieces = bf
+	c.haveAll = false
+}
+
+// SetHaveAll records that the peer sent Have All
+func (c *Client) SetHaveAll() {
+	c.piecesMu.Lock()
+	defer c.piecesMu.Unlock()
+	c.haveAll = true
+}
+
+// IsSeed reports whether the peer has every one of numPieces pieces
+func (c *Client) IsSeed(numPieces int) bool {
+	c.piecesMu.Lock()
+	defer c.piecesMu.Unlock()
+	if c.haveAll {
+		return true
+	}
+	if numPieces == 0 || c.pieces == nil {
+		return false
+	}
+	for i := 0; i < numPieces; i++ {
+		if !c.pieces.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsAllowedFast reports whether the peer allowed us to request a piece while choked
+func (c *Client) IsAllowedFast(index int) bool {
+	c.fastMu.Lock()
+	defer c.fastMu.Unlock()
+	return c.allowedFast[index]
+}
+
+// allowFast records an Allowed Fast message of the peer
+func (c *Client) allowFast(index int) {
+	c.fastMu.Lock()
+	defer c.fastMu.Unlock()
+	if c.allowedFast == nil {
+		c.allowedFast = make(map[int]bool)
+	}
+	c.allowedFast[index] = true
+}
+
+// SendHaveAll sends a HaveAll message to the peer
+// It returns an error if one occurred.
+func (c *Client) SendHaveAll() error {
+	return c.write(&message.Message{ID: message.MsgHaveAll})
+}
+
+// SendHaveNone sends a HaveNone message to the peer
+// It returns an error if one occurred.
+func (c *Client) SendHaveNone() error {
+	return c.write(&message.Message{ID: message.MsgHaveNone})
+}
+
+// SendReject sends a RejectRequest message to the peer
+// It returns an error if one occurred.
+func (c *Client) SendReject(index, begin, length int) error {
+	return c.write(message.FormatReject(index, begin, length))
+}
+
+// SendAllowedFast sends an AllowedFast message to the peer
+// It returns an error if one occurred.
+func (c *Client) SendAllowedFast(index int) error {
+	return c.write(message.FormatAllowedFast(index))
+}
+
+// SendSuggest sends a SuggestPiece message to the peer
+// It returns an error if one occurred.
+func (c *Client) SendSuggest(index int) error {
+	return c.write(message.FormatSuggest(index))
+}
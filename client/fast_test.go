@@ -0,0 +1,44 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [20]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, 20))
+	tests := []struct {
+		name      string
+		ip        net.IP
+		numPieces int
+		k         int
+		want      []int
+	}{
+		// The examples of BEP 6
+		{"7 pieces", net.IPv4(80, 4, 4, 200), 1313, 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"9 pieces", net.IPv4(80, 4, 4, 200), 1313, 9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		// Only the /24 network of the address counts
+		{"same network", net.IPv4(80, 4, 4, 1), 1313, 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"IPv6", net.ParseIP("2001:db8::1"), 1313, 7, nil},
+		{"no pieces", net.IPv4(80, 4, 4, 200), 0, 7, nil},
+	}
+	for _, test := range tests {
+		got := AllowedFastSet(test.ip, infoHash, test.numPieces, test.k)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: allowed fast set is %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// A torrent with fewer pieces than k allows all of them
+	got := AllowedFastSet(net.IPv4(80, 4, 4, 200), infoHash, 3, 7)
+	seen := make(map[int]bool)
+	for _, index := range got {
+		seen[index] = true
+	}
+	if len(got) != 3 || len(seen) != 3 {
+		t.Errorf("Allowed fast set of 3 pieces is %v, want all of them once", got)
+	}
+}
@@ -0,0 +1,25 @@
+// Description: Hash Request, Hashes and Hash Reject messages of v2 torrents (BEP 52).
+
+package client
+
+import (
+	"bit-torrent/message"
+)
+
+// SendHashRequest asks the peer for hashes of the merkle tree of a file
+// It returns an error if one occurred.
+func (c *Client) SendHashRequest(req message.HashRequest) error {
+	return c.write(message.FormatHashRequest(req))
+}
+
+// SendHashes answers a hash request with the base layer hashes followed by their uncle hashes
+// It returns an error if one occurred.
+func (c *Client) SendHashes(req message.HashRequest, hashes [][32]byte) error {
+	return c.write(message.FormatHashes(req, hashes))
+}
+
+// SendHashReject tells the peer we will not serve its hash request
+// It returns an error if one occurred.
+func (c *Client) SendHashReject(req message.HashRequest) error {
+	return c.write(message.FormatHashReject(req))
+}
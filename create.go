@@ -0,0 +1,98 @@
+// Description: The create command writes a .torrent file for local files or directories.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bit-torrent/torrent"
+)
+
+// listFlag is a flag that may be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runCreate creates a .torrent file for the file or directory given in args
+// Every -tracker flag is a tier of the announce list; the URLs of a tier are separated by commas.
+func runCreate(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, webSeeds listFlag
+	fs.Var(&trackers, "tracker", "tracker URLs of one tier, separated by commas (may be repeated)")
+	fs.Var(&webSeeds, "webseed", "URL of a web seed (may be repeated)")
+	out := fs.String("o", "", "path of the .torrent file to write (default: the name of the data with .torrent appended)")
+	comment := fs.String("comment", "", "comment stored in the torrent")
+	createdBy := fs.String("created-by", "bit-torrent", "program name stored in the torrent (empty to leave out)")
+	noDate := fs.Bool("no-date", false, "leave out the creation date")
+	private := fs.Bool("private", false, "mark the torrent private, so peers are only found through its trackers")
+	source := fs.String("source", "", "source tag stored in the info dictionary")
+	format := fs.String("format", "v1", "metadata to write: v1, v2 (BEP 52) or hybrid")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes, a multiple of 16384 (default: picked from the size of the data)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: go run . create [flags] <path to file or directory>")
+		fs.PrintDefaults()
+		return
+	}
+	path := fs.Arg(0)
+
+	opts := torrent.CreateOptions{
+		WebSeeds:    webSeeds,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		Source:      *source,
+		PieceLength: *pieceLength,
+	}
+	switch *format {
+	case "v1":
+		opts.Format = torrent.FormatV1
+	case "v2":
+		opts.Format = torrent.FormatV2
+	case "hybrid":
+		opts.Format = torrent.FormatHybrid
+	default:
+		log.Fatalf("Unknown torrent format %q\n", *format)
+	}
+	for _, tier := range trackers {
+		opts.Trackers = append(opts.Trackers, strings.Split(tier, ","))
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	fmt.Printf("Hashing %s...\n", path)
+	data, err := torrent.Create(path, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tf, err := torrent.Parse(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "" {
+		*out = filepath.Base(filepath.Clean(path)) + ".torrent"
+	}
+	err = ioutil.WriteFile(*out, data, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %s: pieces of %d bytes, info hash %x\n", *out, tf.PieceLength, tf.InfoHash)
+	if tf.MetaVersion == 2 {
+		fmt.Printf("v2 info hash %x\n", tf.InfoHashV2)
+	}
+}
@@ -0,0 +1,636 @@
+// Description: Mainline DHT node (BEP 5).
+// Package dht implements the KRPC protocol over UDP to find and announce peers of torrents without a tracker.
+package dht
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"bit-torrent/bencode"
+	"bit-torrent/peers"
+)
+
+// DefaultBootstrapNodes are well known nodes used to join the DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// queryTimeout is how long we wait for the answer to a query
+const queryTimeout = 3 * time.Second
+
+// alpha is the number of queries a lookup runs in parallel
+const alpha = 3
+
+// maintainInterval is how often questionable nodes are pinged and the node table is saved
+const maintainInterval = 5 * time.Minute
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// Config configures a DHT node
+type Config struct {
+	Addr           string   // UDP address to listen on, e.g. ":6881"
+	BootstrapNodes []string // host:port of nodes used to join the DHT
+	StatePath      string   // file the node ID and node table are kept in, or "" to not persist them
+}
+
+// Server is a DHT node
+type Server struct {
+	conn      *net.UDPConn
+	id        NodeID
+	table     *routingTable
+	tokens    tokenManager
+	store     *peerStore
+	bootstrap []string
+	statePath string
+	saved     []*Node // nodes loaded from the state file, contacted when bootstrapping
+
+	mu      sync.Mutex
+	pending map[string]chan krpcResult
+	nextTID uint16
+	done    chan struct{}
+}
+
+// krpcResult is the answer to a query: the response dictionary or an error
+type krpcResult struct {
+	r   map[string]interface{}
+	err error
+}
+
+// New starts a DHT node listening on cfg.Addr
+// The node ID and node table are loaded from cfg.StatePath if it exists.
+// It returns the server and an error if one occurred.
+func New(cfg Config) (*Server, error) {
+	s := &Server{
+		store:     newPeerStore(),
+		bootstrap: cfg.BootstrapNodes,
+		statePath: cfg.StatePath,
+		pending:   make(map[string]chan krpcResult),
+		done:      make(chan struct{}),
+	}
+
+	loaded := false
+	if cfg.StatePath != "" {
+		id, nodes, err := loadState(cfg.StatePath)
+		if err == nil {
+			s.id, s.saved, loaded = id, nodes, true
+		} else if !os.IsNotExist(err) {
+			log.Printf("Could not load DHT state from %s: %v\n", cfg.StatePath, err)
+		}
+	}
+	if !loaded {
+		id, err := RandomID()
+		if err != nil {
+			return nil, err
+		}
+		s.id = id
+	}
+	s.table = newRoutingTable(s.id)
+
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	s.conn, err = net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go s.serve()
+	go s.maintain()
+	return s, nil
+}
+
+// ID returns the ID of the node
+func (s *Server) ID() NodeID {
+	return s.id
+}
+
+// Port returns the UDP port the node listens on
+func (s *Server) Port() int {
+	return s.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Nodes returns the number of nodes in the routing table
+func (s *Server) Nodes() int {
+	return s.table.len()
+}
+
+// Close saves the node table and stops the node
+func (s *Server) Close() error {
+	s.save()
+	close(s.done)
+	return s.conn.Close()
+}
+
+// Bootstrap joins the DHT by looking up our own ID through the saved nodes and the bootstrap nodes
+// It returns an error if no node answered.
+func (s *Server) Bootstrap() error {
+	var wg sync.WaitGroup
+	for _, n := range s.saved {
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			s.findNode(addr, s.id)
+		}(n.Addr)
+	}
+	for _, host := range s.bootstrap {
+		addr, err := net.ResolveUDPAddr("udp4", host)
+		if err != nil {
+			log.Printf("Could not resolve DHT bootstrap node %s: %v\n", host, err)
+			continue
+		}
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			s.findNode(addr, s.id)
+		}(addr)
+	}
+	wg.Wait()
+
+	if s.table.len() == 0 {
+		return fmt.Errorf("No DHT node answered")
+	}
+	s.lookup(s.id, false)
+	log.Printf("DHT bootstrapped with %d nodes\n", s.table.len())
+	return nil
+}
+
+// AddNode pings a node, for example one a peer announced with a PORT message, and adds it to the table if it answers
+func (s *Server) AddNode(addr *net.UDPAddr) {
+	go s.query(addr, "ping", map[string]interface{}{})
+}
+
+// GetPeers looks up the peers of an info hash
+// It returns the peers and an error if the lookup could not be started.
+func (s *Server) GetPeers(infoHash [20]byte) ([]peers.Peer, error) {
+	_, ps, err := s.lookup(NodeID(infoHash), true)
+	return ps, err
+}
+
+// Announce looks up the peers of an info hash and announces that we accept connections for it on port
+// The announce goes to the K closest nodes that handed us a token.
+// It returns the peers found and an error if the lookup could not be started.
+func (s *Server) Announce(infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	closest, ps, err := s.lookup(NodeID(infoHash), true)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(c *contact) {
+			defer wg.Done()
+			_, err := s.query(c.node.Addr, "announce_peer", map[string]interface{}{
+				"info_hash":    string(infoHash[:]),
+				"port":         int(port),
+				"token":        c.token,
+				"implied_port": 0,
+			})
+			if err != nil {
+				log.Printf("Could not announce to DHT node %s: %v\n", c.node.Addr, err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	return ps, nil
+}
+
+// contact is a node taking part in a lookup
+type contact struct {
+	node      *Node
+	token     string
+	queried   bool
+	responded bool
+}
+
+// lookup runs an iterative find_node or get_peers lookup for target
+// It returns the K closest nodes that answered, the peers found and an error if no node is known.
+func (s *Server) lookup(target NodeID, getPeers bool) ([]*contact, []peers.Peer, error) {
+	var contacts []*contact
+	seen := make(map[NodeID]bool)
+	for _, n := range s.table.closest(target, K) {
+		contacts = append(contacts, &contact{node: n})
+		seen[n.ID] = true
+	}
+	if len(contacts) == 0 {
+		return nil, nil, fmt.Errorf("No DHT nodes known")
+	}
+
+	found := make(map[string]peers.Peer)
+	type answer struct {
+		c     *contact
+		nodes []*Node
+		peers []peers.Peer
+		token string
+		err   error
+	}
+
+	for {
+		sort.Slice(contacts, func(i, j int) bool {
+			return less(contacts[i].node.ID.xor(target), contacts[j].node.ID.xor(target))
+		})
+
+		// Query the closest nodes we have not asked yet, alpha at a time
+		var batch []*contact
+		for i := 0; i < len(contacts) && i < K && len(batch) < alpha; i++ {
+			if !contacts[i].queried {
+				batch = append(batch, contacts[i])
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		answers := make(chan answer, len(batch))
+		for _, c := range batch {
+			c.queried = true
+			go func(c *contact) {
+				var a answer
+				a.c = c
+				if getPeers {
+					a.nodes, a.peers, a.token, a.err = s.getPeers(c.node.Addr, [20]byte(target))
+				} else {
+					a.nodes, a.err = s.findNode(c.node.Addr, target)
+				}
+				answers <- a
+			}(c)
+		}
+
+		var failed []*contact
+		for range batch {
+			a := <-answers
+			if a.err != nil {
+				s.table.failed(a.c.node.ID)
+				failed = append(failed, a.c)
+				continue
+			}
+			a.c.responded = true
+			a.c.token = a.token
+			for _, p := range a.peers {
+				found[p.String()] = p
+			}
+			for _, n := range a.nodes {
+				if !seen[n.ID] && n.ID != s.id {
+					seen[n.ID] = true
+					contacts = append(contacts, &contact{node: n})
+				}
+			}
+		}
+		// Nodes that did not answer make room for the next closest ones
+		for _, f := range failed {
+			for i, c := range contacts {
+				if c == f {
+					contacts = append(contacts[:i], contacts[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	var closest []*contact
+	for _, c := range contacts {
+		if c.responded && len(closest) < K {
+			closest = append(closest, c)
+		}
+	}
+	ps := make([]peers.Peer, 0, len(found))
+	for _, p := range found {
+		ps = append(ps, p)
+	}
+	return closest, ps, nil
+}
+
+// findNode sends a find_node query
+// It returns the nodes in the answer and an error if one occurred.
+func (s *Server) findNode(addr *net.UDPAddr, target NodeID) ([]*Node, error) {
+	r, err := s.query(addr, "find_node", map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := r["nodes"].(string)
+	return decodeNodes(nodes)
+}
+
+// getPeers sends a get_peers query
+// It returns the closer nodes, the peers, the token in the answer and an error if one occurred.
+func (s *Server) getPeers(addr *net.UDPAddr, infoHash [20]byte) ([]*Node, []peers.Peer, string, error) {
+	r, err := s.query(addr, "get_peers", map[string]interface{}{"info_hash": string(infoHash[:])})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	token, _ := r["token"].(string)
+
+	var ps []peers.Peer
+	values, _ := r["values"].([]interface{})
+	for _, v := range values {
+		compact, ok := v.(string)
+		if !ok {
+			continue
+		}
+		p, err := peers.Unmarshal([]byte(compact))
+		if err != nil {
+			continue
+		}
+		ps = append(ps, p...)
+	}
+
+	var nodes []*Node
+	if compact, ok := r["nodes"].(string); ok {
+		nodes, err = decodeNodes(compact)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+	return nodes, ps, token, nil
+}
+
+// query sends a KRPC query and waits for the answer
+// The answering node is added to the routing table.
+// It returns the response dictionary and an error if the node returned an error or did not answer in time.
+func (s *Server) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(s.id[:])
+
+	s.mu.Lock()
+	s.nextTID++
+	tid := string([]byte{byte(s.nextTID >> 8), byte(s.nextTID)})
+	ch := make(chan krpcResult, 1)
+	s.pending[tid] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, tid)
+		s.mu.Unlock()
+	}()
+
+	err := s.send(addr, map[string]interface{}{
+		"t": tid,
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, res.err
+		}
+		id, ok := res.r["id"].(string)
+		if !ok || len(id) != 20 {
+			return nil, fmt.Errorf("DHT node %s answered without a valid ID", addr)
+		}
+		var nodeID NodeID
+		copy(nodeID[:], id)
+		s.addNode(nodeID, addr)
+		return res.r, nil
+	case <-time.After(queryTimeout):
+		return nil, fmt.Errorf("DHT node %s did not answer %s", addr, method)
+	case <-s.done:
+		return nil, fmt.Errorf("DHT node closed")
+	}
+}
+
+// addNode adds a node to the routing table
+// If its bucket is full of questionable nodes, the oldest is pinged and replaced if it does not answer.
+func (s *Server) addNode(id NodeID, addr *net.UDPAddr) {
+	stale := s.table.insert(id, addr)
+	if stale == nil {
+		return
+	}
+	go func() {
+		_, err := s.query(stale.Addr, "ping", map[string]interface{}{})
+		if err != nil {
+			s.table.replace(stale, id, addr)
+		}
+	}()
+}
+
+// send bencodes a KRPC message and sends it
+// It returns an error if one occurred.
+func (s *Server) send(addr *net.UDPAddr, msg map[string]interface{}) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDP(buf.Bytes(), addr)
+	return err
+}
+
+// serve reads KRPC messages until the node is closed
+func (s *Server) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("DHT read error: %v\n", err)
+			continue
+		}
+
+		data, err := bencode.Decode(bytes.NewReader(buf[:n]))
+		if err != nil {
+			continue
+		}
+		msg, ok := data.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tid, _ := msg["t"].(string)
+		y, _ := msg["y"].(string)
+
+		switch y {
+		case "q":
+			s.handleQuery(addr, tid, msg)
+		case "r", "e":
+			s.mu.Lock()
+			ch := s.pending[tid]
+			s.mu.Unlock()
+			if ch == nil {
+				continue
+			}
+			var res krpcResult
+			if y == "r" {
+				res.r, ok = msg["r"].(map[string]interface{})
+				if !ok {
+					res.err = fmt.Errorf("DHT node %s sent a response without r", addr)
+				}
+			} else {
+				res.err = krpcError(msg)
+			}
+			select {
+			case ch <- res:
+			default:
+			}
+		}
+	}
+}
+
+// krpcError converts the e list of an error message into an error
+func krpcError(msg map[string]interface{}) error {
+	e, _ := msg["e"].([]interface{})
+	if len(e) == 2 {
+		code, _ := e[0].(int64)
+		text, _ := e[1].(string)
+		return fmt.Errorf("DHT error %d: %s", code, text)
+	}
+	return fmt.Errorf("DHT error")
+}
+
+// handleQuery answers a query from another node
+func (s *Server) handleQuery(addr *net.UDPAddr, tid string, msg map[string]interface{}) {
+	method, _ := msg["q"].(string)
+	args, _ := msg["a"].(map[string]interface{})
+	id, _ := args["id"].(string)
+	if len(id) != 20 {
+		s.sendError(addr, tid, errProtocol, "invalid id")
+		return
+	}
+	var nodeID NodeID
+	copy(nodeID[:], id)
+
+	r := map[string]interface{}{"id": string(s.id[:])}
+	switch method {
+	case "ping":
+	case "find_node":
+		target, _ := args["target"].(string)
+		if len(target) != 20 {
+			s.sendError(addr, tid, errProtocol, "invalid target")
+			return
+		}
+		var t NodeID
+		copy(t[:], target)
+		r["nodes"] = encodeNodes(s.table.closest(t, K))
+	case "get_peers":
+		infoHash, ok := hashArg(args, "info_hash")
+		if !ok {
+			s.sendError(addr, tid, errProtocol, "invalid info_hash")
+			return
+		}
+		r["token"] = s.tokens.token(addr.IP)
+		ps := s.store.get(infoHash)
+		if len(ps) > 0 {
+			values := make([]interface{}, len(ps))
+			for i, p := range ps {
+				values[i] = string(peers.Marshal([]peers.Peer{p}))
+			}
+			r["values"] = values
+		} else {
+			r["nodes"] = encodeNodes(s.table.closest(NodeID(infoHash), K))
+		}
+	case "announce_peer":
+		infoHash, ok := hashArg(args, "info_hash")
+		if !ok {
+			s.sendError(addr, tid, errProtocol, "invalid info_hash")
+			return
+		}
+		token, _ := args["token"].(string)
+		if !s.tokens.valid(token, addr.IP) {
+			s.sendError(addr, tid, errProtocol, "bad token")
+			return
+		}
+		port, _ := args["port"].(int64)
+		if implied, _ := args["implied_port"].(int64); implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			s.sendError(addr, tid, errProtocol, "invalid port")
+			return
+		}
+		s.store.add(infoHash, peers.Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		s.sendError(addr, tid, errMethodUnknown, "method unknown")
+		return
+	}
+
+	s.addNode(nodeID, addr)
+	err := s.send(addr, map[string]interface{}{"t": tid, "y": "r", "r": r})
+	if err != nil {
+		log.Printf("Could not answer DHT node %s: %v\n", addr, err)
+	}
+}
+
+// hashArg reads a 20 byte argument of a query
+func hashArg(args map[string]interface{}, key string) ([20]byte, bool) {
+	var h [20]byte
+	s, _ := args[key].(string)
+	if len(s) != 20 {
+		return h, false
+	}
+	copy(h[:], s)
+	return h, true
+}
+
+// sendError answers a query with a KRPC error
+func (s *Server) sendError(addr *net.UDPAddr, tid string, code int, text string) {
+	s.send(addr, map[string]interface{}{
+		"t": tid,
+		"y": "e",
+		"e": []interface{}{code, text},
+	})
+}
+
+// maintain pings questionable nodes, bootstraps again if the table ran empty and saves the table
+func (s *Server) maintain() {
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, n := range s.table.nodes() {
+			if time.Since(n.LastSeen) > questionableAfter {
+				go func(n *Node) {
+					_, err := s.query(n.Addr, "ping", map[string]interface{}{})
+					if err != nil {
+						s.table.failed(n.ID)
+					}
+				}(n)
+			}
+		}
+		if s.table.len() < K {
+			err := s.Bootstrap()
+			if err != nil {
+				log.Printf("Could not bootstrap DHT: %v\n", err)
+			}
+		}
+		s.save()
+	}
+}
+
+// save writes the node table to the state file, if there is one
+func (s *Server) save() {
+	if s.statePath == "" {
+		return
+	}
+	err := saveState(s.statePath, s.id, s.table.nodes())
+	if err != nil {
+		log.Printf("Could not save DHT state to %s: %v\n", s.statePath, err)
+	}
+}
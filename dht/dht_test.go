@@ -0,0 +1,169 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"bit-torrent/bencode"
+)
+
+// startNode starts a DHT node on a local port without bootstrap nodes
+// It returns the node and a UDP connection to talk KRPC to it, which the caller closes.
+func startNode(t *testing.T) (*Server, *net.UDPConn) {
+	t.Helper()
+	s, err := New(Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Skipf("Cannot start a DHT node: %v", err)
+	}
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.Port()})
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s, conn
+}
+
+// exchange bencodes a KRPC message, sends it and decodes the answer
+func exchange(t *testing.T, conn *net.UDPConn, msg map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(queryTimeout))
+	n, err := conn.Read(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := bencode.Decode(bytes.NewReader(answer[:n]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, ok := data.(map[string]interface{})
+	if !ok {
+		t.Fatalf("The answer is a %T, want a dictionary", data)
+	}
+	if tid, _ := reply["t"].(string); tid != msg["t"] {
+		t.Errorf("Transaction ID is %q, want %q", tid, msg["t"])
+	}
+	return reply
+}
+
+func TestKRPCQueries(t *testing.T) {
+	s, conn := startNode(t)
+	defer s.Close()
+	defer conn.Close()
+
+	id := string(bytes.Repeat([]byte{0xaa}, 20))
+	infoHash := string(bytes.Repeat([]byte{0xbb}, 20))
+	tests := []struct {
+		name   string
+		method string
+		args   map[string]interface{}
+		code   int64 // the KRPC error code of the answer, or 0 for a response
+		keys   []string
+	}{
+		{"ping", "ping", map[string]interface{}{"id": id}, 0, []string{"id"}},
+		{"find_node", "find_node", map[string]interface{}{"id": id, "target": id}, 0, []string{"id", "nodes"}},
+		{"get_peers", "get_peers", map[string]interface{}{"id": id, "info_hash": infoHash}, 0, []string{"id", "token", "nodes"}},
+		{"short id", "ping", map[string]interface{}{"id": "short"}, errProtocol, nil},
+		{"short target", "find_node", map[string]interface{}{"id": id, "target": "short"}, errProtocol, nil},
+		{"bad token", "announce_peer", map[string]interface{}{"id": id, "info_hash": infoHash, "port": 6881, "token": "bad"}, errProtocol, nil},
+		{"unknown method", "vote", map[string]interface{}{"id": id}, errMethodUnknown, nil},
+	}
+	for i, test := range tests {
+		reply := exchange(t, conn, map[string]interface{}{
+			"t": string([]byte{0, byte(i)}),
+			"y": "q",
+			"q": test.method,
+			"a": test.args,
+		})
+		y, _ := reply["y"].(string)
+		if test.code != 0 {
+			e, _ := reply["e"].([]interface{})
+			if y != "e" || len(e) != 2 || e[0] != test.code {
+				t.Errorf("%s: answer is %v, want error %d", test.name, reply, test.code)
+			}
+			continue
+		}
+		r, _ := reply["r"].(map[string]interface{})
+		if y != "r" || r == nil {
+			t.Errorf("%s: answer is %v, want a response", test.name, reply)
+			continue
+		}
+		for _, key := range test.keys {
+			if _, ok := r[key]; !ok {
+				t.Errorf("%s: response has no %s", test.name, key)
+			}
+		}
+		if got, _ := r["id"].(string); got != string(s.id[:]) {
+			t.Errorf("%s: response ID is %x, want %s", test.name, got, s.ID())
+		}
+	}
+}
+
+func TestKRPCAnnounce(t *testing.T) {
+	s, conn := startNode(t)
+	defer s.Close()
+	defer conn.Close()
+
+	id := string(bytes.Repeat([]byte{0xaa}, 20))
+	infoHash := string(bytes.Repeat([]byte{0xbb}, 20))
+	getPeers := map[string]interface{}{
+		"t": "g1",
+		"y": "q",
+		"q": "get_peers",
+		"a": map[string]interface{}{"id": id, "info_hash": infoHash},
+	}
+	r, _ := exchange(t, conn, getPeers)["r"].(map[string]interface{})
+	token, _ := r["token"].(string)
+	if token == "" {
+		t.Fatal("get_peers returned no token")
+	}
+
+	reply := exchange(t, conn, map[string]interface{}{
+		"t": "a1",
+		"y": "q",
+		"q": "announce_peer",
+		"a": map[string]interface{}{"id": id, "info_hash": infoHash, "port": 6881, "token": token},
+	})
+	if y, _ := reply["y"].(string); y != "r" {
+		t.Fatalf("announce_peer answer is %v, want a response", reply)
+	}
+
+	getPeers["t"] = "g2"
+	r, _ = exchange(t, conn, getPeers)["r"].(map[string]interface{})
+	values, _ := r["values"].([]interface{})
+	if len(values) != 1 {
+		t.Fatalf("get_peers returned %d peers, want 1", len(values))
+	}
+	want := string([]byte{127, 0, 0, 1, 0x1a, 0xe1})
+	if values[0] != want {
+		t.Errorf("Peer is %x, want %x", values[0], want)
+	}
+}
+
+func TestKRPCError(t *testing.T) {
+	tests := []struct {
+		msg  map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"e": []interface{}{int64(201), "A Generic Error Ocurred"}}, "DHT error 201: A Generic Error Ocurred"},
+		{map[string]interface{}{"e": []interface{}{int64(203)}}, "DHT error"},
+		{map[string]interface{}{}, "DHT error"},
+	}
+	for _, test := range tests {
+		if got := krpcError(test.msg).Error(); got != test.want {
+			t.Errorf("krpcError(%v) is %q, want %q", test.msg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Description: Persistence of the node ID and node table between runs.
+package dht
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"bit-torrent/bencode"
+)
+
+// loadState reads the node ID and the nodes saved by saveState
+// It returns the ID, the nodes and an error if one occurred.
+func loadState(path string) (NodeID, []*Node, error) {
+	var id NodeID
+	file, err := os.Open(path)
+	if err != nil {
+		return id, nil, err
+	}
+	defer file.Close()
+
+	data, err := bencode.Decode(file)
+	if err != nil {
+		return id, nil, err
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return id, nil, fmt.Errorf("DHT state is not a dictionary")
+	}
+	rawID, _ := dict["id"].(string)
+	if len(rawID) != len(id) {
+		return id, nil, fmt.Errorf("DHT state has an invalid node ID")
+	}
+	copy(id[:], rawID)
+
+	compact, _ := dict["nodes"].(string)
+	nodes, err := decodeNodes(compact)
+	if err != nil {
+		return id, nil, err
+	}
+	return id, nodes, nil
+}
+
+// saveState writes the node ID and nodes to path, replacing the file atomically
+// It returns an error if one occurred.
+func saveState(path string, id NodeID, nodes []*Node) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{
+		"id":    string(id[:]),
+		"nodes": encodeNodes(nodes),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
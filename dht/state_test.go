@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "dht.dat")
+
+	id := NodeID{1, 2, 3}
+	nodes := []*Node{
+		{ID: NodeID{4}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}},
+		{ID: NodeID{5}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 51413}},
+	}
+	err = saveState(path, id, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotID, gotNodes, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID != id {
+		t.Errorf("ID is %s, want %s", gotID, id)
+	}
+	if len(gotNodes) != len(nodes) {
+		t.Fatalf("Loaded %d nodes, want %d", len(gotNodes), len(nodes))
+	}
+	for i, n := range nodes {
+		if gotNodes[i].ID != n.ID || gotNodes[i].Addr.String() != n.Addr.String() {
+			t.Errorf("Node %d is %s at %s, want %s at %s", i, gotNodes[i].ID, gotNodes[i].Addr, n.ID, n.Addr)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("The temporary file was left behind: %v", err)
+	}
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, _, err = loadState(filepath.Join(dir, "missing"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Loading a missing file returned %v, want a not exist error", err)
+	}
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not bencode", "garbage"},
+		{"not a dictionary", "li1ee"},
+		{"short ID", "d2:id3:abc5:nodes0:e"},
+		{"malformed nodes", "d2:id20:aaaaaaaaaaaaaaaaaaaa5:nodes3:abce"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, "state")
+		err := ioutil.WriteFile(path, []byte(test.data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadState(path); err == nil {
+			t.Errorf("%s: loading succeeded", test.name)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Description: Node IDs, compact node info and the routing table of the DHT node.
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the size of a bucket and the number of closest nodes a lookup returns
+const K = 8
+
+// nodeInfoSize is the size of a node in compact node info: ID, IPv4 address and port
+const nodeInfoSize = 26
+
+// questionableAfter is how long a node may stay silent before we consider it questionable
+const questionableAfter = 15 * time.Minute
+
+// maxFailures is the number of unanswered queries after which a node is removed
+const maxFailures = 3
+
+// NodeID identifies a node; distances between IDs and info hashes are measured with XOR
+type NodeID [20]byte
+
+// RandomID returns a random node ID
+func RandomID() (NodeID, error) {
+	var id NodeID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+// String returns the ID in hex
+func (id NodeID) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
+// xor returns the XOR distance between two IDs
+func (id NodeID) xor(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// less reports whether distance a is smaller than distance b
+func less(a, b NodeID) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// prefixLen returns the number of leading bits two IDs have in common
+func (id NodeID) prefixLen(other NodeID) int {
+	d := id.xor(other)
+	for i, b := range d {
+		if b == 0 {
+			continue
+		}
+		n := i * 8
+		for b&0x80 == 0 {
+			b <<= 1
+			n++
+		}
+		return n
+	}
+	return len(d) * 8
+}
+
+// Node is a DHT node in the routing table
+type Node struct {
+	ID       NodeID
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	failures int
+}
+
+// encodeNodes packs nodes into compact node info, skipping nodes without an IPv4 address
+func encodeNodes(nodes []*Node) string {
+	buf := make([]byte, 0, len(nodes)*nodeInfoSize)
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(n.Addr.Port))
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip...)
+		buf = append(buf, port[:]...)
+	}
+	return string(buf)
+}
+
+// decodeNodes unpacks compact node info
+// It returns the nodes and an error if the data is malformed.
+func decodeNodes(s string) ([]*Node, error) {
+	if len(s)%nodeInfoSize != 0 {
+		return nil, fmt.Errorf("Received malformed nodes of length %d", len(s))
+	}
+	nodes := make([]*Node, 0, len(s)/nodeInfoSize)
+	for i := 0; i < len(s); i += nodeInfoSize {
+		n := &Node{Addr: &net.UDPAddr{}}
+		copy(n.ID[:], s[i:i+20])
+		n.Addr.IP = net.IP([]byte(s[i+20 : i+24]))
+		n.Addr.Port = int(binary.BigEndian.Uint16([]byte(s[i+24 : i+26])))
+		if n.Addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// routingTable holds up to K nodes for every length of the prefix they share with our ID
+type routingTable struct {
+	self    NodeID
+	mu      sync.Mutex
+	buckets [160][]*Node
+}
+
+// newRoutingTable creates an empty routing table around our ID
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+// insert adds a node that just contacted us or answered us, or refreshes it if it is known
+// If the bucket is full and its least recently seen node is questionable, that node is returned
+// so the caller can ping it and replace it if it does not answer.
+func (t *routingTable) insert(id NodeID, addr *net.UDPAddr) (stale *Node) {
+	if id == t.self || addr.IP.To4() == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.self.prefixLen(id)
+	bucket := t.buckets[i]
+	for j, n := range bucket {
+		if n.ID == id {
+			n.Addr = addr
+			n.LastSeen = time.Now()
+			n.failures = 0
+			// Keep the bucket ordered from least to most recently seen
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), n)
+			return nil
+		}
+	}
+
+	n := &Node{ID: id, Addr: addr, LastSeen: time.Now()}
+	if len(bucket) < K {
+		t.buckets[i] = append(bucket, n)
+		return nil
+	}
+	for j, old := range bucket {
+		if old.failures >= maxFailures {
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), n)
+			return nil
+		}
+	}
+	if time.Since(bucket[0].LastSeen) > questionableAfter {
+		return bucket[0]
+	}
+	return nil
+}
+
+// replace swaps a stale node that did not answer for a new one
+func (t *routingTable) replace(stale *Node, id NodeID, addr *net.UDPAddr) {
+	t.remove(stale.ID)
+	t.insert(id, addr)
+}
+
+// failed records an unanswered query and removes nodes that keep failing
+func (t *routingTable) failed(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.self.prefixLen(id)
+	for j, n := range t.buckets[i] {
+		if n.ID == id {
+			n.failures++
+			if n.failures >= maxFailures {
+				t.buckets[i] = append(t.buckets[i][:j:j], t.buckets[i][j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// remove removes a node from the table
+func (t *routingTable) remove(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.self.prefixLen(id)
+	for j, n := range t.buckets[i] {
+		if n.ID == id {
+			t.buckets[i] = append(t.buckets[i][:j:j], t.buckets[i][j+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to n known nodes closest to target
+func (t *routingTable) closest(target NodeID, n int) []*Node {
+	nodes := t.nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return less(nodes[i].ID.xor(target), nodes[j].ID.xor(target))
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// nodes returns copies of all the nodes in the table
+func (t *routingTable) nodes() []*Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []*Node
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			c := *n
+			nodes = append(nodes, &c)
+		}
+	}
+	return nodes
+}
+
+// len returns the number of nodes in the table
+func (t *routingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := 0
+	for _, bucket := range t.buckets {
+		count += len(bucket)
+	}
+	return count
+}
@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// bucketID returns an ID that shares no prefix with the zero ID, so they all fall in the same bucket
+func bucketID(i byte) NodeID {
+	return NodeID{0x80, i}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []*Node{
+		{ID: NodeID{1}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}},
+		{ID: NodeID{2}, Addr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 6881}}, // skipped: no IPv4 address
+		{ID: NodeID{3}, Addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 65535}},
+	}
+	compact := encodeNodes(nodes)
+	if len(compact) != 2*nodeInfoSize {
+		t.Fatalf("Compact node info is %d bytes, want %d", len(compact), 2*nodeInfoSize)
+	}
+	decoded, err := decodeNodes(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 {
+		t.Fatalf("Decoded %d nodes, want 2", len(decoded))
+	}
+	for i, want := range []*Node{nodes[0], nodes[2]} {
+		got := decoded[i]
+		if got.ID != want.ID || !got.Addr.IP.Equal(want.Addr.IP) || got.Addr.Port != want.Addr.Port {
+			t.Errorf("Node %d is %s at %s, want %s at %s", i, got.ID, got.Addr, want.ID, want.Addr)
+		}
+	}
+}
+
+func TestDecodeNodes(t *testing.T) {
+	id := NodeID{1}
+	node := string(id[:]) + "\x0a\x00\x00\x01\x1a\xe1"
+	tests := []struct {
+		name  string
+		input string
+		nodes int
+		fails bool
+	}{
+		{"empty", "", 0, false},
+		{"one node", node, 1, false},
+		{"port 0 is skipped", node[:24] + "\x00\x00" + node, 1, false},
+		{"truncated", node[:25], 0, true},
+		{"trailing byte", node + "x", 0, true},
+	}
+	for _, test := range tests {
+		nodes, err := decodeNodes(test.input)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error is %v, want failure %v", test.name, err, test.fails)
+			continue
+		}
+		if len(nodes) != test.nodes {
+			t.Errorf("%s: decoded %d nodes, want %d", test.name, len(nodes), test.nodes)
+		}
+	}
+}
+
+func TestRoutingTableInsert(t *testing.T) {
+	table := newRoutingTable(NodeID{})
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+
+	if stale := table.insert(NodeID{}, addr); stale != nil || table.len() != 0 {
+		t.Error("Our own ID was added")
+	}
+	if stale := table.insert(bucketID(0), &net.UDPAddr{IP: net.ParseIP("::1"), Port: 6881}); stale != nil || table.len() != 0 {
+		t.Error("A node without an IPv4 address was added")
+	}
+	for i := 0; i < K; i++ {
+		if stale := table.insert(bucketID(byte(i)), addr); stale != nil {
+			t.Fatalf("Inserting node %d into a bucket that is not full returned %s", i, stale.ID)
+		}
+	}
+	// Inserting a known node again only refreshes it
+	table.insert(bucketID(0), addr)
+	if table.len() != K {
+		t.Fatalf("The table holds %d nodes, want %d", table.len(), K)
+	}
+
+	// A full bucket of good nodes turns newcomers away
+	if stale := table.insert(bucketID(K), addr); stale != nil {
+		t.Errorf("A full bucket of good nodes returned %s as stale", stale.ID)
+	}
+	if table.len() != K {
+		t.Errorf("The table holds %d nodes, want %d", table.len(), K)
+	}
+
+	// Its least recently seen node is offered for eviction once it is questionable;
+	// bucketID(0) was refreshed, so that is bucketID(1)
+	table.buckets[0][0].LastSeen = time.Now().Add(-questionableAfter - time.Minute)
+	stale := table.insert(bucketID(K), addr)
+	if stale == nil || stale.ID != bucketID(1) {
+		t.Fatalf("Stale node is %v, want %s", stale, bucketID(1))
+	}
+	table.replace(stale, bucketID(K), addr)
+	ids := make(map[NodeID]bool)
+	for _, n := range table.nodes() {
+		ids[n.ID] = true
+	}
+	if ids[bucketID(1)] || !ids[bucketID(K)] || len(ids) != K {
+		t.Errorf("After the replacement the table holds %v", ids)
+	}
+
+	// A node that keeps failing is removed, which makes room at once
+	for i := 0; i < maxFailures; i++ {
+		table.failed(bucketID(2))
+	}
+	if table.len() != K-1 {
+		t.Fatalf("The table holds %d nodes after a node failed, want %d", table.len(), K-1)
+	}
+	if stale := table.insert(bucketID(K+1), addr); stale != nil || table.len() != K {
+		t.Errorf("The free place was not used: stale %v, %d nodes", stale, table.len())
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	table := newRoutingTable(NodeID{})
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	for _, id := range []NodeID{{0x80}, {0x40}, {0x20}, {0x10}} {
+		table.insert(id, addr)
+	}
+	closest := table.closest(NodeID{0x41}, 2)
+	if len(closest) != 2 || closest[0].ID != (NodeID{0x40}) || closest[1].ID != (NodeID{0x10}) {
+		t.Errorf("Closest nodes are %v, want 40… and 10…", closest)
+	}
+}
@@ -0,0 +1,116 @@
+// Description: Tokens handed out in get_peers responses and the peers announced to us.
+package dht
+
+import (
+	crand "crypto/rand"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"bit-torrent/peers"
+)
+
+// tokenLifetime is how often the token secret changes; tokens of the previous secret stay valid
+const tokenLifetime = 5 * time.Minute
+
+// peerLifetime is how long an announced peer is kept without announcing again
+const peerLifetime = 30 * time.Minute
+
+// maxValues is the largest number of peers returned for a get_peers query
+const maxValues = 50
+
+// tokenManager creates and checks the tokens that allow a node to announce to us
+type tokenManager struct {
+	mu      sync.Mutex
+	secret  [20]byte
+	prev    [20]byte
+	rotated time.Time
+}
+
+// rotate changes the secret if it is older than tokenLifetime; t.mu must be held
+func (t *tokenManager) rotate() {
+	if time.Since(t.rotated) < tokenLifetime {
+		return
+	}
+	t.prev = t.secret
+	crand.Read(t.secret[:])
+	t.rotated = time.Now()
+}
+
+// token returns the token for a node at the given IP address
+func (t *tokenManager) token(ip net.IP) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return tokenFor(t.secret, ip)
+}
+
+// valid reports whether a token was handed out to the given IP address recently
+func (t *tokenManager) valid(token string, ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return token == tokenFor(t.secret, ip) || token == tokenFor(t.prev, ip)
+}
+
+// tokenFor hashes a secret with an IP address
+func tokenFor(secret [20]byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h := sha1.Sum(append(secret[:], ip...))
+	return string(h[:8])
+}
+
+// peerStore holds the peers announced to us per info hash
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[[20]byte]map[string]storedPeer
+}
+
+// storedPeer is an announced peer and when it announced
+type storedPeer struct {
+	peer peers.Peer
+	seen time.Time
+}
+
+// newPeerStore creates an empty peer store
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[[20]byte]map[string]storedPeer)}
+}
+
+// add stores a peer that announced an info hash
+func (s *peerStore) add(infoHash [20]byte, p peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	swarm := s.peers[infoHash]
+	if swarm == nil {
+		swarm = make(map[string]storedPeer)
+		s.peers[infoHash] = swarm
+	}
+	swarm[p.String()] = storedPeer{p, time.Now()}
+}
+
+// get returns up to maxValues random peers of an info hash, dropping expired ones on the way
+func (s *peerStore) get(infoHash [20]byte) []peers.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ps []peers.Peer
+	for addr, sp := range s.peers[infoHash] {
+		if time.Since(sp.seen) > peerLifetime {
+			delete(s.peers[infoHash], addr)
+			continue
+		}
+		ps = append(ps, sp.peer)
+	}
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+	rand.Shuffle(len(ps), func(i, j int) { ps[i], ps[j] = ps[j], ps[i] })
+	if len(ps) > maxValues {
+		ps = ps[:maxValues]
+	}
+	return ps
+}
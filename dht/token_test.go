@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenRotation(t *testing.T) {
+	var tokens tokenManager
+	ip := net.IPv4(10, 0, 0, 1)
+	other := net.IPv4(10, 0, 0, 2)
+	token := tokens.token(ip)
+
+	// expire forces the next call to rotate the secret
+	expire := func() {
+		tokens.mu.Lock()
+		tokens.rotated = time.Now().Add(-tokenLifetime - time.Second)
+		tokens.mu.Unlock()
+	}
+	tests := []struct {
+		name    string
+		rotate  bool
+		ip      net.IP
+		isValid bool
+	}{
+		{"fresh token", false, ip, true},
+		{"other IP address", false, other, false},
+		{"IPv4 in IPv6 form", false, ip.To16(), true},
+		{"after one rotation", true, ip, true},
+		{"other IP address after one rotation", false, other, false},
+		{"after two rotations", true, ip, false},
+	}
+	for _, test := range tests {
+		if test.rotate {
+			expire()
+		}
+		if valid := tokens.valid(token, test.ip); valid != test.isValid {
+			t.Errorf("%s: valid is %v, want %v", test.name, valid, test.isValid)
+		}
+	}
+	if tokens.valid("", ip) {
+		t.Error("An empty token is valid")
+	}
+}
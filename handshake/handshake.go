@@ -9,24 +9,52 @@ import (
 )
 
 
+// Bits of the reserved bytes that announce protocol extensions.
+// They are numbered from the right of the last reserved byte, the way the specifications count them.
+const (
+	// BitDHT announces a DHT node reachable through the PORT message (BEP 5)
+	BitDHT = 0
+
+	// BitFast announces the Fast Extension (BEP 6)
+	BitFast = 2
+
+	// BitExtended announces the extension protocol (BEP 10)
+	BitExtended = 20
+)
+
 // A Handshake is a special message that a peer uses to identify itself 
 // to another peer. 
-// It contains the following fields: Pstr, InfoHash, and PeerID 
+// It contains the following fields: Pstr, Reserved, InfoHash, and PeerID 
 type HandShake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte 
 } 
  
 // New Creates a new handshake with the standard pstr and the given infohash and peerid. 
+// The reserved bits of the extensions we support are set.
 // It returns a pointer to the new handshake. 
 
 func New(infoHash, peerID [20]byte) *HandShake {
- 	return &HandShake{
+ 	h := &HandShake{
  		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.SetBit(BitExtended)
+	h.SetBit(BitFast)
+	return h
+}
+
+// SetBit sets a bit of the reserved bytes
+func (h *HandShake) SetBit(bit int) {
+	h.Reserved[7-bit/8] |= 1 << uint(bit%8)
+}
+
+// HasBit reports whether a bit of the reserved bytes is set
+func (h *HandShake) HasBit(bit int) bool {
+	return h.Reserved[7-bit/8]&(1<<uint(bit%8)) != 0
 }
 
 
@@ -39,7 +67,7 @@ func (h *HandShake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -67,14 +95,20 @@ func Read(r io.Reader) (*HandShake, error) {
 
 	handshakeBuf := make([]byte, 48+pstrlen)
 	_, err = io.ReadFull(r, handshakeBuf)
+	if err != nil {
+		return nil, err
+	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := HandShake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
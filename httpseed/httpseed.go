@@ -0,0 +1,173 @@
+// Description: HTTP seeds (BEP 17): pieces of a torrent fetched from a server by info hash and piece index.
+// Package httpseed implements the Hoffman-style httpseeds protocol. A request names the info hash, a piece and
+// optionally byte ranges within the piece; a busy server answers 503 with the number of seconds to wait.
+package httpseed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bit-torrent/proxy"
+)
+
+// Proxy is the proxy HTTP seeds are reached through, or nil to connect directly
+var Proxy proxy.Dialer
+
+// Timeout is how long one request to an HTTP seed may take
+var Timeout = 60 * time.Second
+
+// DefaultRetry is how long we wait for a busy server that did not say how long to wait
+const DefaultRetry = 30 * time.Second
+
+// BusyError is returned when the server is busy or does not have a piece yet and asked us to come back later
+type BusyError struct {
+	Seed  string
+	Retry time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("HTTP seed %s is busy, retry in %v", e.Seed, e.Retry)
+}
+
+// RetryAfter returns how long the server asked us to wait
+func (e *BusyError) RetryAfter() time.Duration {
+	return e.Retry
+}
+
+// Seed reads the data of a torrent from an HTTP seed
+type Seed struct {
+	URL         string
+	base        *url.URL
+	infoHash    [20]byte
+	pieceLength int64
+	length      int64
+	client      *http.Client
+}
+
+// New creates an HTTP seed for the torrent with the given info hash, piece length and length, as listed in its
+// httpseeds
+// It returns the seed and an error if the URL is not an HTTP URL.
+func New(rawURL string, infoHash [20]byte, pieceLength, length int) (*Seed, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" || pieceLength <= 0 {
+		return nil, fmt.Errorf("Unsupported HTTP seed URL %s", rawURL)
+	}
+	return &Seed{
+		URL:         rawURL,
+		base:        base,
+		infoHash:    infoHash,
+		pieceLength: int64(pieceLength),
+		length:      int64(length),
+		client:      httpClient(),
+	}, nil
+}
+
+// Host returns the host the seed's requests go to
+func (s *Seed) Host() string {
+	return s.base.Host
+}
+
+// String returns the URL of the seed
+func (s *Seed) String() string {
+	return s.URL
+}
+
+// ReadAt reads len(p) bytes of the torrent's data at offset off, with one request per piece it spans
+func (s *Seed) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.length {
+		return 0, io.EOF
+	}
+	done := 0
+	for done < len(p) {
+		at := off + int64(done)
+		piece := int(at / s.pieceLength)
+		begin := at % s.pieceLength
+		n := len(p) - done
+		if int64(n) > s.pieceLength-begin {
+			n = int(s.pieceLength - begin)
+		}
+		err := s.get(piece, begin, p[done:done+n])
+		if err != nil {
+			return done, err
+		}
+		done += n
+	}
+	return done, nil
+}
+
+// requestURL returns the URL that asks for length bytes of a piece, starting at begin
+// The whole piece is asked for without a range.
+func (s *Seed) requestURL(piece int, begin int64, length int) string {
+	u := *s.base
+	q := u.Query()
+	q.Set("info_hash", string(s.infoHash[:]))
+	q.Set("piece", strconv.Itoa(piece))
+	if begin != 0 || int64(length) != s.pieceSize(piece) {
+		q.Set("ranges", fmt.Sprintf("%d-%d", begin, begin+int64(length)-1))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// pieceSize returns the size of a piece; the last one may be shorter
+func (s *Seed) pieceSize(piece int) int64 {
+	begin := int64(piece) * s.pieceLength
+	if begin+s.pieceLength > s.length {
+		return s.length - begin
+	}
+	return s.pieceLength
+}
+
+// get reads len(p) bytes of a piece, starting at begin
+// It returns a *BusyError if the server asked us to come back later.
+func (s *Seed) get(piece int, begin int64, p []byte) error {
+	resp, err := s.client.Get(s.requestURL(piece, begin, len(p)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		retry := DefaultRetry
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 32))
+		seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err == nil && seconds >= 0 {
+			retry = time.Duration(seconds) * time.Second
+		}
+		return &BusyError{Seed: s.URL, Retry: retry}
+	default:
+		return fmt.Errorf("HTTP seed %s answered %s for piece %d", s.URL, resp.Status, piece)
+	}
+	_, err = io.ReadFull(resp.Body, p)
+	if err != nil {
+		return fmt.Errorf("Could not read %d bytes of piece %d from %s: %v", len(p), piece, s.URL, err)
+	}
+	return nil
+}
+
+// httpClient returns the HTTP client used for requests to HTTP seeds
+// Connections go through Proxy if one is set.
+func httpClient() *http.Client {
+	c := &http.Client{Timeout: Timeout}
+	if Proxy != nil {
+		c.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return Proxy.DialTimeout(network, addr, 15*time.Second)
+			},
+		}
+	}
+	return c
+}
@@ -0,0 +1,151 @@
+package httpseed
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pieceServer is an HTTP seed of one torrent that records the pieces and ranges asked for
+type pieceServer struct {
+	infoHash    [20]byte
+	data        []byte
+	pieceLength int
+	busy        string // the body of a 503 answer to every request, or "" to serve them
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func (s *pieceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.mu.Lock()
+	s.requested = append(s.requested, q.Get("piece")+" "+q.Get("ranges"))
+	s.mu.Unlock()
+	if s.busy != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, s.busy)
+		return
+	}
+	if q.Get("info_hash") != string(s.infoHash[:]) {
+		http.NotFound(w, r)
+		return
+	}
+
+	piece, err := strconv.Atoi(q.Get("piece"))
+	if err != nil || piece < 0 || piece*s.pieceLength >= len(s.data) {
+		http.Error(w, "bad piece", http.StatusBadRequest)
+		return
+	}
+	start, end := piece*s.pieceLength, (piece+1)*s.pieceLength
+	if end > len(s.data) {
+		end = len(s.data)
+	}
+	if ranges := q.Get("ranges"); ranges != "" {
+		var first, last int
+		_, err := fmt.Sscanf(ranges, "%d-%d", &first, &last)
+		if err != nil || start+last >= end {
+			http.Error(w, "bad range", http.StatusBadRequest)
+			return
+		}
+		start, end = start+first, start+last+1
+	}
+	w.Write(s.data[start:end])
+}
+
+func (s *pieceServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requested...)
+}
+
+func TestReadAtRanges(t *testing.T) {
+	data := make([]byte, 250) // pieces of 100, 100 and 50 bytes
+	for i := range data {
+		data[i] = byte(i)
+	}
+	srv := &pieceServer{infoHash: [20]byte{1, 2, 3}, data: data, pieceLength: 100}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	seed, err := New(ts.URL+"/seed", srv.infoHash, srv.pieceLength, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		off, size int
+		requested []string // piece and ranges of each request
+	}{
+		{"whole piece", 100, 100, []string{"1 "}},
+		{"short last piece", 200, 50, []string{"2 "}},
+		{"within a piece", 10, 20, []string{"0 10-29"}},
+		{"end of a piece", 180, 20, []string{"1 80-99"}},
+		{"across pieces", 90, 120, []string{"0 90-99", "1 ", "2 0-9"}},
+		{"everything", 0, 250, []string{"0 ", "1 ", "2 "}},
+	}
+	for _, test := range tests {
+		before := len(srv.requests())
+		p := make([]byte, test.size)
+		n, err := seed.ReadAt(p, int64(test.off))
+		if err != nil || n != test.size {
+			t.Errorf("%s: read %d bytes, %v, want %d", test.name, n, err, test.size)
+			continue
+		}
+		if string(p) != string(data[test.off:test.off+test.size]) {
+			t.Errorf("%s: read the wrong data", test.name)
+		}
+		if got := srv.requests()[before:]; strings.Join(got, ",") != strings.Join(test.requested, ",") {
+			t.Errorf("%s: requested %q, want %q", test.name, got, test.requested)
+		}
+	}
+
+	for _, off := range []int64{-1, 240} {
+		if _, err := seed.ReadAt(make([]byte, 20), off); err != io.EOF {
+			t.Errorf("Reading 20 bytes at %d returned %v, want EOF", off, err)
+		}
+	}
+}
+
+func TestBusySeed(t *testing.T) {
+	tests := []struct {
+		body  string
+		retry time.Duration
+	}{
+		{"7", 7 * time.Second},
+		{" 0\n", 0},
+		{"soon", DefaultRetry},
+	}
+	for _, test := range tests {
+		srv := &pieceServer{data: make([]byte, 10), pieceLength: 10, busy: test.body}
+		ts := httptest.NewServer(srv)
+		seed, err := New(ts.URL, srv.infoHash, srv.pieceLength, len(srv.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = seed.ReadAt(make([]byte, 10), 0)
+		ts.Close()
+		busy, ok := err.(*BusyError)
+		if !ok {
+			t.Errorf("Busy answer %q returned %v, want a BusyError", test.body, err)
+			continue
+		}
+		if busy.RetryAfter() != test.retry {
+			t.Errorf("Busy answer %q waits %v, want %v", test.body, busy.RetryAfter(), test.retry)
+		}
+	}
+}
+
+func TestNewRejectsURLs(t *testing.T) {
+	for _, rawURL := range []string{"ftp://seed.example/", "seed.example/file", "http:///file"} {
+		if _, err := New(rawURL, [20]byte{}, 100, 1000); err == nil {
+			t.Errorf("New accepted %s", rawURL)
+		}
+	}
+}
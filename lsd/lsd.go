@@ -0,0 +1,265 @@
+// Description: Local Service Discovery (BEP 14).
+// Package lsd announces the torrents we are active in on the local network with multicast
+// BT-SEARCH messages and reports the peers that announce the same torrents.
+package lsd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bit-torrent/peers"
+)
+
+// Multicast groups of the IPv4 and IPv6 announces
+const (
+	Group4 = "239.192.152.143:6771"
+	Group6 = "[ff15::efc0:988f]:6771"
+)
+
+// AnnounceInterval is how often every torrent is announced
+const AnnounceInterval = 5 * time.Minute
+
+// minAnnounceGap is the shortest gap between two announces of the same torrent
+const minAnnounceGap = time.Minute
+
+// maxHashesPerMessage keeps announces within a single unfragmented datagram
+const maxHashesPerMessage = 20
+
+// Handler receives a peer that announced a torrent on the local network
+type Handler func(peers.Peer)
+
+// Service announces torrents and listens for the announces of other peers
+type Service struct {
+	port   uint16
+	cookie string
+	conns  []*lsdConn
+
+	mu        sync.Mutex
+	torrents  map[[20]byte]Handler
+	announced map[[20]byte]time.Time
+	done      chan struct{}
+}
+
+// lsdConn holds the sockets of one address family
+// The listening socket is bound to the group address, so announces go out through a socket of their own.
+type lsdConn struct {
+	conn  *net.UDPConn
+	send  *net.UDPConn
+	group *net.UDPAddr
+}
+
+// New joins the IPv4 and, where available, the IPv6 multicast group
+// port is the TCP port we accept peer connections on.
+// It returns the service and an error if neither group could be joined.
+func New(port uint16) (*Service, error) {
+	cookie := make([]byte, 8)
+	_, err := rand.Read(cookie)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		port:      port,
+		cookie:    hex.EncodeToString(cookie),
+		torrents:  make(map[[20]byte]Handler),
+		announced: make(map[[20]byte]time.Time),
+		done:      make(chan struct{}),
+	}
+
+	for _, g := range []struct{ network, addr string }{{"udp4", Group4}, {"udp6", Group6}} {
+		group, err := net.ResolveUDPAddr(g.network, g.addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenMulticastUDP(g.network, nil, group)
+		if err != nil {
+			log.Printf("Could not join local service discovery group %s: %v\n", g.addr, err)
+			continue
+		}
+		send, err := net.ListenUDP(g.network, nil)
+		if err != nil {
+			conn.Close()
+			log.Printf("Could not open local service discovery socket for %s: %v\n", g.addr, err)
+			continue
+		}
+		s.conns = append(s.conns, &lsdConn{conn, send, group})
+	}
+	if len(s.conns) == 0 {
+		return nil, fmt.Errorf("Could not join any local service discovery group")
+	}
+
+	for _, c := range s.conns {
+		go s.listen(c)
+	}
+	go s.run()
+	return s, nil
+}
+
+// Add starts announcing a torrent; peers announcing it are passed to handler
+func (s *Service) Add(infoHash [20]byte, handler Handler) {
+	s.mu.Lock()
+	s.torrents[infoHash] = handler
+	s.mu.Unlock()
+	s.announce([][20]byte{infoHash})
+}
+
+// Remove stops announcing a torrent
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+	delete(s.announced, infoHash)
+}
+
+// Close leaves the multicast groups
+func (s *Service) Close() {
+	close(s.done)
+	for _, c := range s.conns {
+		c.conn.Close()
+		c.send.Close()
+	}
+}
+
+// run announces all torrents every AnnounceInterval
+func (s *Service) run() {
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		hashes := make([][20]byte, 0, len(s.torrents))
+		for h := range s.torrents {
+			hashes = append(hashes, h)
+		}
+		s.mu.Unlock()
+		s.announce(hashes)
+	}
+}
+
+// announce sends BT-SEARCH messages for the torrents that were not announced within the last minute
+func (s *Service) announce(hashes [][20]byte) {
+	s.mu.Lock()
+	var due [][20]byte
+	for _, h := range hashes {
+		if time.Since(s.announced[h]) < minAnnounceGap {
+			continue
+		}
+		s.announced[h] = time.Now()
+		due = append(due, h)
+	}
+	s.mu.Unlock()
+
+	for len(due) > 0 {
+		n := len(due)
+		if n > maxHashesPerMessage {
+			n = maxHashesPerMessage
+		}
+		for _, c := range s.conns {
+			msg := formatSearch(c.group.String(), s.port, due[:n], s.cookie)
+			_, err := c.send.WriteToUDP(msg, c.group)
+			if err != nil {
+				log.Printf("Could not send local service discovery announce to %s: %v\n", c.group, err)
+			}
+		}
+		due = due[n:]
+	}
+}
+
+// listen handles the announces arriving on a multicast socket until the service is closed
+func (s *Service) listen(c *lsdConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("Local service discovery read error: %v\n", err)
+			continue
+		}
+
+		port, hashes, cookie, err := parseSearch(buf[:n])
+		if err != nil || cookie == s.cookie {
+			continue // not an announce, or our own
+		}
+		p := peers.Peer{IP: addr.IP, Port: port}
+		for _, h := range hashes {
+			s.mu.Lock()
+			handler := s.torrents[h]
+			s.mu.Unlock()
+			if handler != nil {
+				handler(p)
+			}
+		}
+	}
+}
+
+// formatSearch builds a BT-SEARCH message
+func formatSearch(host string, port uint16, hashes [][20]byte, cookie string) []byte {
+	var b strings.Builder
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	fmt.Fprintf(&b, "Port: %d\r\n", port)
+	for _, h := range hashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", h)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	b.WriteString("\r\n\r\n")
+	return []byte(b.String())
+}
+
+// parseSearch parses a BT-SEARCH message
+// It returns the announced port, the info hashes, the cookie and an error if the message is not a valid announce.
+func parseSearch(msg []byte) (uint16, [][20]byte, string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(msg)))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", fmt.Errorf("Not a BT-SEARCH message")
+	}
+
+	var port uint16
+	var hashes [][20]byte
+	var cookie string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		switch strings.ToLower(line[:colon]) {
+		case "port":
+			p, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || p == 0 {
+				return 0, nil, "", fmt.Errorf("Invalid port %q", value)
+			}
+			port = uint16(p)
+		case "infohash":
+			raw, err := hex.DecodeString(value)
+			if err != nil || len(raw) != 20 {
+				continue
+			}
+			var h [20]byte
+			copy(h[:], raw)
+			hashes = append(hashes, h)
+		case "cookie":
+			cookie = value
+		}
+	}
+	if port == 0 || len(hashes) == 0 {
+		return 0, nil, "", fmt.Errorf("BT-SEARCH message without port or info hash")
+	}
+	return port, hashes, cookie, nil
+}
@@ -0,0 +1,144 @@
+// Description: Magnet URI parsing.
+// Package magnet parses magnet links as described in BEP 9 and BEP 53.
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// btihPrefix is the exact topic prefix of a BitTorrent info hash
+const btihPrefix = "urn:btih:"
+
+// Magnet holds the fields of a magnet link
+type Magnet struct {
+	InfoHash    [20]byte
+	DisplayName string   // dn
+	Trackers    []string // tr
+	WebSeeds    []string // ws
+	Peers       []string // x.pe, as host:port
+	SelectOnly  []int    // so, indices of the files to download (BEP 53)
+}
+
+// Parse parses a magnet URI
+// The info hash may be given as 40 hex digits or 32 base32 characters.
+// It returns the magnet and an error if the URI is not a valid BitTorrent magnet link.
+func Parse(uri string) (Magnet, error) {
+	var m Magnet
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return m, err
+	}
+	if u.Scheme != "magnet" {
+		return m, fmt.Errorf("Not a magnet link: %s", uri)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return m, err
+	}
+
+	found := false
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return m, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return m, fmt.Errorf("Magnet link has no BitTorrent info hash: %s", uri)
+	}
+
+	m.DisplayName = params.Get("dn")
+	m.Trackers = params["tr"]
+	m.WebSeeds = params["ws"]
+	m.Peers = params["x.pe"]
+	if so := params.Get("so"); so != "" {
+		m.SelectOnly, err = parseSelectOnly(so)
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// String formats the magnet back into a URI
+func (m Magnet) String() string {
+	params := url.Values{}
+	if m.DisplayName != "" {
+		params.Set("dn", m.DisplayName)
+	}
+	for _, tr := range m.Trackers {
+		params.Add("tr", tr)
+	}
+	for _, ws := range m.WebSeeds {
+		params.Add("ws", ws)
+	}
+	for _, pe := range m.Peers {
+		params.Add("x.pe", pe)
+	}
+	if len(m.SelectOnly) > 0 {
+		indices := make([]string, len(m.SelectOnly))
+		for i, index := range m.SelectOnly {
+			indices[i] = strconv.Itoa(index)
+		}
+		params.Set("so", strings.Join(indices, ","))
+	}
+	uri := "magnet:?xt=" + btihPrefix + hex.EncodeToString(m.InfoHash[:])
+	if len(params) > 0 {
+		uri += "&" + params.Encode()
+	}
+	return uri
+}
+
+// parseInfoHash decodes a hex or base32 encoded info hash
+func parseInfoHash(s string) ([20]byte, error) {
+	var h [20]byte
+	var raw []byte
+	var err error
+	switch len(s) {
+	case 40:
+		raw, err = hex.DecodeString(s)
+	case 32:
+		raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = fmt.Errorf("Info hash %q has invalid length %d", s, len(s))
+	}
+	if err != nil {
+		return h, err
+	}
+	copy(h[:], raw)
+	return h, nil
+}
+
+// parseSelectOnly parses a comma separated list of file indices and inclusive ranges such as "0,2,4-6"
+func parseSelectOnly(so string) ([]int, error) {
+	var indices []int
+	for _, part := range strings.Split(so, ",") {
+		first, last := part, part
+		if dash := strings.Index(part, "-"); dash >= 0 {
+			first, last = part[:dash], part[dash+1:]
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("Invalid file index %q in so=%s", part, so)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("Invalid file range %q in so=%s", part, so)
+		}
+		for i := from; i <= to; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
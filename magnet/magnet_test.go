@@ -0,0 +1,83 @@
+package magnet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	infoHash := [20]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23,
+		0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}
+	tests := []struct {
+		name string
+		uri  string
+		want Magnet
+	}{
+		{
+			"hex info hash",
+			"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567",
+			Magnet{InfoHash: infoHash},
+		},
+		{
+			"base32 info hash",
+			"magnet:?xt=urn:btih:AERUKZ4JVPG66AJDIVTYTK6N54ASGRLH",
+			Magnet{InfoHash: infoHash},
+		},
+		{
+			"lower case base32",
+			"magnet:?xt=urn:btih:aerukz4jvpg66ajdivtytk6n54asgrlh",
+			Magnet{InfoHash: infoHash},
+		},
+		{
+			"all fields",
+			"magnet:?xt=urn:sha1:ABC&xt=urn:btih:0123456789ABCDEF0123456789ABCDEF01234567&dn=My+File" +
+				"&tr=udp%3A%2F%2Ftracker.example%3A6969&tr=http%3A%2F%2Fother.example%2Fannounce" +
+				"&ws=http%3A%2F%2Fseed.example%2Ffile&x.pe=10.0.0.1%3A6881&x.pe=%5B%3A%3A1%5D%3A6881&so=0,2,4-6",
+			Magnet{
+				InfoHash:    infoHash,
+				DisplayName: "My File",
+				Trackers:    []string{"udp://tracker.example:6969", "http://other.example/announce"},
+				WebSeeds:    []string{"http://seed.example/file"},
+				Peers:       []string{"10.0.0.1:6881", "[::1]:6881"},
+				SelectOnly:  []int{0, 2, 4, 5, 6},
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.uri)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parsed %+v, want %+v", test.name, got, test.want)
+		}
+		// Formatting and parsing again gives the same magnet
+		again, err := Parse(got.String())
+		if err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("%s: %s parses to %+v, %v, want %+v", test.name, got.String(), again, err, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+	}{
+		{"not a magnet", "http://example.com/?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"},
+		{"no info hash", "magnet:?dn=file"},
+		{"other hash only", "magnet:?xt=urn:sha1:0123456789abcdef0123456789abcdef01234567"},
+		{"short info hash", "magnet:?xt=urn:btih:0123456789abcdef"},
+		{"invalid hex", "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef0123456z"},
+		{"invalid base32", "magnet:?xt=urn:btih:AERUKZ4JVPG66AJDIVTYTK6N54ASGRL1"},
+		{"invalid so index", "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&so=a"},
+		{"reversed so range", "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&so=6-4"},
+		{"negative so index", "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&so=-1"},
+	}
+	for _, test := range tests {
+		if m, err := Parse(test.uri); err == nil {
+			t.Errorf("%s: parsed %+v, want an error", test.name, m)
+		}
+	}
+}
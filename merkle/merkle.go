@@ -0,0 +1,148 @@
+// Description: Merkle trees of BitTorrent v2 (BEP 52).
+// Package merkle builds the SHA-256 hash trees of v2 torrents. The leaves are the hashes of the 16 KiB blocks of a
+// file, padded with zero hashes to a power of two. The layer whose nodes each cover one piece is the piece layer,
+// and the root of the tree is the file's pieces root.
+package merkle
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// BlockSize is the size of the data hashed into one leaf
+const BlockSize = 16 * 1024
+
+// HashBlock returns the leaf hash of a block, which is shorter than BlockSize only at the end of a file
+func HashBlock(block []byte) [32]byte {
+	return sha256.Sum256(block)
+}
+
+// hashPair returns the parent of two nodes
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// ZeroHash returns the root of a tree of 2^level zero leaf hashes, which pads a layer at that level
+func ZeroHash(level int) [32]byte {
+	var h [32]byte
+	for i := 0; i < level; i++ {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+// NextPowerOfTwo returns the smallest power of two that is at least n
+func NextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << uint(bits.Len(uint(n-1)))
+}
+
+// RootFrom returns the root of a tree whose nodes at the given level are nodes, padded to width nodes
+// width must be a power of two that is at least len(nodes).
+func RootFrom(nodes [][32]byte, level, width int) [32]byte {
+	layers := Layers(nodes, level, width)
+	return layers[len(layers)-1][0]
+}
+
+// PieceLayer returns the piece layer of a file from the hashes of its blocks
+// Every node is the root of blocksPerPiece leaves; the last one is padded with zero leaf hashes.
+func PieceLayer(blocks [][32]byte, blocksPerPiece int) [][32]byte {
+	var layer [][32]byte
+	for begin := 0; begin < len(blocks); begin += blocksPerPiece {
+		end := begin + blocksPerPiece
+		if end > len(blocks) {
+			end = len(blocks)
+		}
+		layer = append(layer, RootFrom(blocks[begin:end], 0, blocksPerPiece))
+	}
+	return layer
+}
+
+// LayerRoot returns the pieces root of a file from its piece layer
+func LayerRoot(layer [][32]byte, blocksPerPiece int) [32]byte {
+	level := bits.TrailingZeros(uint(blocksPerPiece))
+	return RootFrom(layer, level, NextPowerOfTwo(len(layer)))
+}
+
+// PiecesRoot returns the pieces root of a file from the hashes of its blocks
+// A file of at most one piece has no piece layer; its root covers only the leaves it needs.
+func PiecesRoot(blocks [][32]byte, blocksPerPiece int) [32]byte {
+	if len(blocks) <= blocksPerPiece {
+		return RootFrom(blocks, 0, NextPowerOfTwo(len(blocks)))
+	}
+	return LayerRoot(PieceLayer(blocks, blocksPerPiece), blocksPerPiece)
+}
+
+// PieceRoot returns the root of the subtree of width leaves over the data of a piece
+// width is the number of blocks of a piece, or the padded number of leaves of a file of at most one piece.
+func PieceRoot(data []byte, width int) [32]byte {
+	return RootFrom(HashBlocks(data), 0, width)
+}
+
+// HashBlocks returns the leaf hashes of the blocks of data
+func HashBlocks(data []byte) [][32]byte {
+	var blocks [][32]byte
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		blocks = append(blocks, HashBlock(data[begin:end]))
+	}
+	return blocks
+}
+
+// Layers returns the layers of a tree from nodes at some level up to the root
+// layers[0] holds nodes padded to width with zero hashes of the level, and the last layer holds only the root.
+func Layers(nodes [][32]byte, level, width int) [][][32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, nodes)
+	pad := ZeroHash(level)
+	for i := len(nodes); i < width; i++ {
+		layer[i] = pad
+	}
+	layers := [][][32]byte{layer}
+	for len(layer) > 1 {
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layers = append(layers, next)
+		layer = next
+	}
+	return layers
+}
+
+// UncleCount returns the number of uncle hashes that prove length base hashes up to proofLayers layers above them
+// The lowest layers are covered by the base hashes themselves.
+func UncleCount(length, proofLayers int) int {
+	n := proofLayers - bits.TrailingZeros(uint(length))
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// VerifyProof reports whether base, a power of two number of hashes starting at index of their layer, lead to root
+// with the uncle hashes of their subtree, which must reach up to the root
+func VerifyProof(root [32]byte, base [][32]byte, index int, uncles [][32]byte) bool {
+	if len(base) == 0 || len(base)&(len(base)-1) != 0 || index%len(base) != 0 {
+		return false
+	}
+	node := RootFrom(base, 0, len(base))
+	pos := index / len(base)
+	for _, uncle := range uncles {
+		if pos%2 == 0 {
+			node = hashPair(node, uncle)
+		} else {
+			node = hashPair(uncle, node)
+		}
+		pos /= 2
+	}
+	return pos == 0 && node == root
+}
@@ -0,0 +1,73 @@
+package merkle
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// testData returns size bytes of a repeating pattern
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestPiecesRoot(t *testing.T) {
+	// Roots computed with an independent SHA-256 implementation of BEP 52
+	tests := []struct {
+		size int
+		root string
+	}{
+		{100, "bce0aff19cf5aa6a7469a30d61d04e4376e4bbf6381052ee9e7f33925c954d52"},
+		{BlockSize, "4348e3b98e8a327b34ced39c1da9e67cdb4cd5e48e4d7960607a3ae403d35f0c"},
+		{BlockSize + 1, "9d7887c65d577a0237fb3c0998b87b3a62762d03796889a2caea01db914ccbb8"},
+		{4*BlockSize + 100, "4dc991d3778c61cbdd4974b0589d82c3376934f9540df55d7f00f6d77c990365"},
+	}
+	for _, test := range tests {
+		blocks := HashBlocks(testData(test.size))
+		// The root does not depend on the piece length
+		for _, blocksPerPiece := range []int{1, 2, 4, 16} {
+			root := PiecesRoot(blocks, blocksPerPiece)
+			if got := hex.EncodeToString(root[:]); got != test.root {
+				t.Errorf("Root of %d bytes in pieces of %d blocks is %s, want %s", test.size, blocksPerPiece, got, test.root)
+			}
+		}
+	}
+}
+
+func TestPieceLayer(t *testing.T) {
+	data := testData(4*BlockSize + 100)
+	blocks := HashBlocks(data)
+	layer := PieceLayer(blocks, 2)
+	if len(layer) != 3 {
+		t.Fatalf("Piece layer has %d nodes, want 3", len(layer))
+	}
+	// Each node is the root of the blocks of its piece, the last one padded to two blocks
+	for i, node := range layer {
+		end := (i + 1) * 2 * BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if want := PieceRoot(data[i*2*BlockSize:end], 2); node != want {
+			t.Errorf("Node %d of the piece layer is %x, want %x", i, node, want)
+		}
+	}
+	if LayerRoot(layer, 2) != PiecesRoot(blocks, 1) {
+		t.Error("The root of the piece layer is not the root of the blocks")
+	}
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	tests := []struct {
+		n, want int
+	}{
+		{0, 1}, {1, 1}, {2, 2}, {3, 4}, {4, 4}, {5, 8}, {1000, 1024}, {1024, 1024},
+	}
+	for _, test := range tests {
+		if got := NextPowerOfTwo(test.n); got != test.want {
+			t.Errorf("NextPowerOfTwo(%d) is %d, want %d", test.n, got, test.want)
+		}
+	}
+}
@@ -39,6 +39,36 @@ const (
 
 	// MsgCancel cancels a request
 	MsgCancel messageID = 8
+
+	// MsgPort announces the UDP port of the sender's DHT node (BEP 5)
+	MsgPort messageID = 9
+
+	// MsgSuggest advises the receiver to download a piece (Fast Extension, BEP 6)
+	MsgSuggest messageID = 13
+
+	// MsgHaveAll replaces the bitfield of a sender that has every piece
+	MsgHaveAll messageID = 14
+
+	// MsgHaveNone replaces the bitfield of a sender that has no pieces
+	MsgHaveNone messageID = 15
+
+	// MsgReject tells the receiver a request will not be served
+	MsgReject messageID = 16
+
+	// MsgAllowedFast lets the receiver request a piece even while choked
+	MsgAllowedFast messageID = 17
+
+	// MsgExtended carries a message of the extension protocol (BEP 10)
+	MsgExtended messageID = 20
+
+	// MsgHashRequest asks for hashes of the merkle tree of a file of a v2 torrent (BEP 52)
+	MsgHashRequest messageID = 21
+
+	// MsgHashes delivers the hashes of a hash request
+	MsgHashes messageID = 22
+
+	// MsgHashReject tells the receiver a hash request will not be served
+	MsgHashReject messageID = 23
 )
 
 
@@ -55,9 +85,31 @@ func ParseRequest(msg *Message) (index, begin, length int, err error) {
 	if msg.ID != MsgRequest {
 		return 0, 0, 0, fmt.Errorf("Invalid message ID for ParseRequest: %d", msg.ID)
 	}
+	return parseBlock(msg)
+}
 
+// ParseReject parses a RejectRequest message and returns the index, begin, and length
+// of the rejected request
+func ParseReject(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgReject {
+		return 0, 0, 0, fmt.Errorf("Invalid message ID for ParseReject: %d", msg.ID)
+	}
+	return parseBlock(msg)
+}
+
+// ParseCancel parses a Cancel message and returns the index, begin, and length
+// of the cancelled request
+func ParseCancel(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("Invalid message ID for ParseCancel: %d", msg.ID)
+	}
+	return parseBlock(msg)
+}
+
+// parseBlock parses the index, begin and length payload shared by Request, Cancel and RejectRequest messages
+func parseBlock(msg *Message) (index, begin, length int, err error) {
 	if len(msg.Payload) != 12 {
-		return 0, 0, 0, fmt.Errorf("Invalid payload length for ParseRequest: %d", len(msg.Payload))
+		return 0, 0, 0, fmt.Errorf("Invalid payload length for %s: %d", msg.name(), len(msg.Payload))
 	}
 
 	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
@@ -84,11 +136,28 @@ func FormatPiece(index, begin int, data []byte) *Message {
 // returns a pointer to a Message
 
 func FormatRequest(index, begin, length int) *Message {
+	return formatBlock(MsgRequest, index, begin, length)
+}
+
+// FormatCancel creates a CANCEL message for a request that is no longer needed
+
+func FormatCancel(index, begin, length int) *Message {
+	return formatBlock(MsgCancel, index, begin, length)
+}
+
+// FormatReject creates a REJECT REQUEST message for a request we will not serve
+
+func FormatReject(index, begin, length int) *Message {
+	return formatBlock(MsgReject, index, begin, length)
+}
+
+// formatBlock creates a message with the index, begin and length payload of a request
+func formatBlock(id messageID, index, begin, length int) *Message {
 	payload := make([]byte, 12)
 	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
 	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
 	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
-	return &Message{ID: MsgRequest, Payload: payload}
+	return &Message{ID: id, Payload: payload}
 }
 
 
@@ -97,9 +166,26 @@ func FormatRequest(index, begin, length int) *Message {
 // returns a pointer to a Message
 
 func FormatHave(index int) *Message {
+	return formatIndex(MsgHave, index)
+}
+
+// FormatSuggest creates a SUGGEST PIECE message
+
+func FormatSuggest(index int) *Message {
+	return formatIndex(MsgSuggest, index)
+}
+
+// FormatAllowedFast creates an ALLOWED FAST message
+
+func FormatAllowedFast(index int) *Message {
+	return formatIndex(MsgAllowedFast, index)
+}
+
+// formatIndex creates a message whose payload is a piece index
+func formatIndex(id messageID, index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
-	return &Message{ID: MsgHave, Payload: payload}
+	return &Message{ID: id, Payload: payload}
 }
 
 
@@ -136,13 +222,178 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// FormatExtended creates an EXTENDED message
+// extID is the extended message ID the receiver assigned to the extension, or 0 for the extended handshake
+
+func FormatExtended(extID uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = extID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseExtended parses an EXTENDED message
+// It returns the extended message ID, the payload that follows it and an error if one occurred.
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Expected EXTENDED (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Payload too short. %d < 1", len(msg.Payload))
+	}
+
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// HashRequest is the payload of Hash Request and Hash Reject messages, which also starts a Hashes message
+type HashRequest struct {
+	PiecesRoot  [32]byte // the root of the file's merkle tree
+	BaseLayer   int      // the layer of the requested hashes, 0 for the hashes of the 16 KiB blocks
+	Index       int      // the position of the first requested hash in the base layer
+	Length      int      // the number of hashes requested from the base layer
+	ProofLayers int      // the number of layers above the base layer to prove the hashes up to
+}
+
+// hashRequestSize is the length of the payload of a Hash Request message
+const hashRequestSize = 32 + 4*4
+
+// FormatHashRequest creates a HASH REQUEST message
+
+func FormatHashRequest(req HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: req.serialize()}
+}
+
+// FormatHashReject creates a HASH REJECT message for a hash request we will not serve
+
+func FormatHashReject(req HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: req.serialize()}
+}
+
+// FormatHashes creates a HASHES message
+// hashes are the requested hashes of the base layer followed by the uncle hashes that prove them.
+
+func FormatHashes(req HashRequest, hashes [][32]byte) *Message {
+	payload := req.serialize()
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// serialize encodes a hash request as the payload of a message
+func (req HashRequest) serialize() []byte {
+	payload := make([]byte, hashRequestSize)
+	copy(payload[0:32], req.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(req.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(req.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(req.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(req.ProofLayers))
+	return payload
+}
+
+// parseHashRequest decodes the hash request at the start of a payload
+func parseHashRequest(payload []byte) HashRequest {
+	var req HashRequest
+	copy(req.PiecesRoot[:], payload[0:32])
+	req.BaseLayer = int(binary.BigEndian.Uint32(payload[32:36]))
+	req.Index = int(binary.BigEndian.Uint32(payload[36:40]))
+	req.Length = int(binary.BigEndian.Uint32(payload[40:44]))
+	req.ProofLayers = int(binary.BigEndian.Uint32(payload[44:48]))
+	return req
+}
+
+// ParseHashRequest parses a HASH REQUEST message
+// It returns the request and an error if one occurred.
+func ParseHashRequest(msg *Message) (HashRequest, error) {
+	if msg.ID != MsgHashRequest {
+		return HashRequest{}, fmt.Errorf("Expected HASH REQUEST (ID %d), got ID %d", MsgHashRequest, msg.ID)
+	}
+	if len(msg.Payload) != hashRequestSize {
+		return HashRequest{}, fmt.Errorf("Invalid payload length for %s: %d", msg.name(), len(msg.Payload))
+	}
+	return parseHashRequest(msg.Payload), nil
+}
+
+// ParseHashReject parses a HASH REJECT message
+// It returns the rejected request and an error if one occurred.
+func ParseHashReject(msg *Message) (HashRequest, error) {
+	if msg.ID != MsgHashReject {
+		return HashRequest{}, fmt.Errorf("Expected HASH REJECT (ID %d), got ID %d", MsgHashReject, msg.ID)
+	}
+	if len(msg.Payload) != hashRequestSize {
+		return HashRequest{}, fmt.Errorf("Invalid payload length for %s: %d", msg.name(), len(msg.Payload))
+	}
+	return parseHashRequest(msg.Payload), nil
+}
+
+// ParseHashes parses a HASHES message
+// It returns the request it answers, the hashes and an error if one occurred.
+func ParseHashes(msg *Message) (HashRequest, [][32]byte, error) {
+	if msg.ID != MsgHashes {
+		return HashRequest{}, nil, fmt.Errorf("Expected HASHES (ID %d), got ID %d", MsgHashes, msg.ID)
+	}
+	if len(msg.Payload) < hashRequestSize || (len(msg.Payload)-hashRequestSize)%32 != 0 {
+		return HashRequest{}, nil, fmt.Errorf("Invalid payload length for %s: %d", msg.name(), len(msg.Payload))
+	}
+	req := parseHashRequest(msg.Payload)
+	hashes := make([][32]byte, (len(msg.Payload)-hashRequestSize)/32)
+	for i := range hashes {
+		copy(hashes[i][:], msg.Payload[hashRequestSize+i*32:])
+	}
+	return req, hashes, nil
+}
+
+// FormatPort creates a PORT message
+// port is the UDP port our DHT node listens on
+
+func FormatPort(port uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+	return &Message{ID: MsgPort, Payload: payload}
+}
+
+// ParsePort parses a PORT message
+// It returns the DHT port of the peer and an error if one occurred.
+func ParsePort(msg *Message) (uint16, error) {
+	if msg.ID != MsgPort {
+		return 0, fmt.Errorf("Expected PORT (ID %d), got ID %d", MsgPort, msg.ID)
+	}
+
+	if len(msg.Payload) != 2 {
+		return 0, fmt.Errorf("Expected payload length 2, got length %d", len(msg.Payload))
+	}
+
+	return binary.BigEndian.Uint16(msg.Payload), nil
+}
+
 // ParseHave parses a HAVE message
 func ParseHave(msg *Message) (int, error) {
 
 	if msg.ID != MsgHave {
 		return 0, fmt.Errorf("Expected HAVE (ID %d), got ID %d", MsgHave, msg.ID)
 	}
+	return parseIndex(msg)
+}
+
+// ParseSuggest parses a SUGGEST PIECE message
+func ParseSuggest(msg *Message) (int, error) {
+	if msg.ID != MsgSuggest {
+		return 0, fmt.Errorf("Expected SUGGEST PIECE (ID %d), got ID %d", MsgSuggest, msg.ID)
+	}
+	return parseIndex(msg)
+}
+
+// ParseAllowedFast parses an ALLOWED FAST message
+func ParseAllowedFast(msg *Message) (int, error) {
+	if msg.ID != MsgAllowedFast {
+		return 0, fmt.Errorf("Expected ALLOWED FAST (ID %d), got ID %d", MsgAllowedFast, msg.ID)
+	}
+	return parseIndex(msg)
+}
 
+// parseIndex parses the piece index payload of Have, Suggest Piece and Allowed Fast messages
+func parseIndex(msg *Message) (int, error) {
 	if len(msg.Payload) != 4 {
 		return 0, fmt.Errorf("Expected payload length 4, got length %d", len(msg.Payload))
 	}
@@ -236,6 +487,36 @@ func (m *Message) name() string {
 	case MsgCancel:
 		return "Cancel"
 
+	case MsgPort:
+		return "Port"
+
+	case MsgSuggest:
+		return "SuggestPiece"
+
+	case MsgHaveAll:
+		return "HaveAll"
+
+	case MsgHaveNone:
+		return "HaveNone"
+
+	case MsgReject:
+		return "RejectRequest"
+
+	case MsgAllowedFast:
+		return "AllowedFast"
+
+	case MsgExtended:
+		return "Extended"
+
+	case MsgHashRequest:
+		return "HashRequest"
+
+	case MsgHashes:
+		return "Hashes"
+
+	case MsgHashReject:
+		return "HashReject"
+
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
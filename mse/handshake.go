@@ -0,0 +1,262 @@
+// Description: The encryption handshake of the side that opens a connection and of the side that accepts it.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// handshakeTimeout bounds the whole encryption handshake
+const handshakeTimeout = 10 * time.Second
+
+// pstr is the start of a plaintext BitTorrent handshake
+var pstr = []byte("\x13BitTorrent protocol")
+
+// Initiate runs the encryption handshake on a connection we opened for the torrent with the given info hash
+// With the Preferred policy plaintext is offered as well and the other side chooses; with Required only RC4 is offered.
+// It returns the connection to run the BitTorrent handshake on and an error if one occurred.
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy) (*Conn, error) {
+	if policy == Disabled {
+		return nil, fmt.Errorf("Encryption is disabled")
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	br := bufio.NewReader(conn)
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	x, ya, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPadding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(ya, padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	yb := make([]byte, keySize)
+	_, err = io.ReadFull(br, yb)
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(x, yb)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	enc := newCipher("keyA", secret, infoHash)
+	dec := newCipher("keyB", secret, infoHash)
+	provide := uint32(cryptoRC4)
+	if policy == Preferred {
+		provide |= cryptoPlaintext
+	}
+	req2, req3 := hash([]byte("req2"), infoHash[:]), hash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	var buf bytes.Buffer
+	buf.Write(hash([]byte("req1"), secret))
+	buf.Write(req2)
+	header := make([]byte, 16) // VC, crypto_provide, len(PadC) = 0, len(IA) = 0
+	binary.BigEndian.PutUint32(header[8:12], provide)
+	enc.XORKeyStream(header, header)
+	buf.Write(header)
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// PadB has a random length, so find the start of the encrypted VC
+	encryptedVC := make([]byte, len(vc))
+	newCipher("keyB", secret, infoHash).XORKeyStream(encryptedVC, vc)
+	err = synchronize(br, encryptedVC, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(make([]byte, len(vc)), encryptedVC)
+
+	fields := make([]byte, 6)
+	_, err = io.ReadFull(br, fields)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(fields, fields)
+	selected := binary.BigEndian.Uint32(fields[0:4])
+	padD := make([]byte, binary.BigEndian.Uint16(fields[4:6]))
+	if len(padD) > maxPadding {
+		return nil, fmt.Errorf("Invalid padding length %d", len(padD))
+	}
+	_, err = io.ReadFull(br, padD)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	switch {
+	case selected == cryptoRC4:
+		return &Conn{Conn: conn, r: br, enc: enc, dec: dec}, nil
+	case selected == cryptoPlaintext && policy == Preferred:
+		return &Conn{Conn: conn, r: br}, nil
+	}
+	return nil, fmt.Errorf("Peer selected unsupported crypto method %d", selected)
+}
+
+// Accept runs the receiving side of the encryption handshake on a connection that was accepted
+// Plaintext BitTorrent handshakes are passed through unless the policy requires encryption.
+// infoHashes returns the info hashes of the torrents we serve; one of them must match the peer's.
+// It returns the connection to read the BitTorrent handshake from and an error if one occurred.
+func Accept(conn net.Conn, policy Policy, infoHashes func() [][20]byte) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	br := bufio.NewReader(conn)
+
+	start, err := br.Peek(len(pstr))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, pstr) {
+		if policy == Required {
+			return nil, fmt.Errorf("Refusing plaintext connection from %s", conn.RemoteAddr())
+		}
+		return &Conn{Conn: conn, r: br}, nil
+	}
+	if policy == Disabled {
+		return nil, fmt.Errorf("Refusing encrypted connection from %s", conn.RemoteAddr())
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	ya := make([]byte, keySize)
+	_, err = io.ReadFull(br, ya)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	x, yb, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPadding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(yb, padB...))
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(x, ya)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	err = synchronize(br, hash([]byte("req1"), secret), maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	obfuscated := make([]byte, 20)
+	_, err = io.ReadFull(br, obfuscated)
+	if err != nil {
+		return nil, err
+	}
+	req3 := hash([]byte("req3"), secret)
+	var infoHash [20]byte
+	found := false
+	for _, h := range infoHashes() {
+		req2 := hash([]byte("req2"), h[:])
+		match := true
+		for i := range req2 {
+			if req2[i]^req3[i] != obfuscated[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			infoHash, found = h, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Encrypted connection from %s is for an unknown torrent", conn.RemoteAddr())
+	}
+
+	dec := newCipher("keyA", secret, infoHash)
+	enc := newCipher("keyB", secret, infoHash)
+	fields := make([]byte, 14)
+	_, err = io.ReadFull(br, fields)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(fields, fields)
+	if !bytes.Equal(fields[0:8], vc) {
+		return nil, fmt.Errorf("Invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(fields[8:12])
+	padC := make([]byte, binary.BigEndian.Uint16(fields[12:14]))
+	if len(padC) > maxPadding {
+		return nil, fmt.Errorf("Invalid padding length %d", len(padC))
+	}
+	_, err = io.ReadFull(br, padC)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+	lenIA := make([]byte, 2)
+	_, err = io.ReadFull(br, lenIA)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(lenIA, lenIA)
+	ia := make([]byte, binary.BigEndian.Uint16(lenIA))
+	_, err = io.ReadFull(br, ia)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy == Preferred:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("No acceptable crypto method in %d", provide)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	enc.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	if selected == cryptoPlaintext {
+		return &Conn{Conn: conn, r: br, pending: ia}, nil
+	}
+	return &Conn{Conn: conn, r: br, pending: ia, enc: enc, dec: dec}, nil
+}
+
+// synchronize reads from r until it has consumed marker, which must start within maxSkip bytes
+// It returns an error if the marker was not found.
+func synchronize(r *bufio.Reader, marker []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(marker))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if len(window) >= len(marker) && bytes.Equal(window[len(window)-len(marker):], marker) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Could not synchronize the encryption handshake")
+}
@@ -0,0 +1,179 @@
+// Description: Message Stream Encryption / Protocol Encryption.
+// Package mse implements the Diffie-Hellman key exchange and RC4 obfuscation that can run beneath the
+// BitTorrent handshake, for connections we open (Initiate) and connections we accept (Accept).
+package mse
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Policy says when connections are encrypted
+type Policy int
+
+const (
+	// Disabled only makes and accepts plaintext connections
+	Disabled Policy = iota
+	// Preferred tries encryption first and falls back to plaintext
+	Preferred
+	// Required refuses plaintext connections
+	Required
+)
+
+// String returns the name of the policy
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Preferred:
+		return "preferred"
+	case Required:
+		return "required"
+	default:
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+}
+
+// ParsePolicy parses "disabled", "preferred" or "required"
+// It returns the policy and an error if the name is unknown.
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "disabled":
+		return Disabled, nil
+	case "preferred":
+		return Preferred, nil
+	case "required":
+		return Required, nil
+	}
+	return Disabled, fmt.Errorf("Unknown encryption policy %q", s)
+}
+
+// Crypto methods offered in crypto_provide and chosen in crypto_select
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+// keySize is the size of the Diffie-Hellman public keys and the shared secret
+const keySize = 96
+
+// maxPadding is the largest random padding either side may send
+const maxPadding = 512
+
+// prime is the 768-bit prime P of the key exchange; the generator is 2
+var prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+	"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+var generator = big.NewInt(2)
+
+// vc is the verification constant
+var vc = make([]byte, 8)
+
+// newKeyPair creates a private key of 160 random bits and its public key
+// It returns both and an error if one occurred.
+func newKeyPair() (*big.Int, []byte, error) {
+	priv := make([]byte, 20)
+	_, err := rand.Read(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(priv)
+	y := new(big.Int).Exp(generator, x, prime)
+	return x, pad(y.Bytes()), nil
+}
+
+// sharedSecret computes S from our private key and the other side's public key
+func sharedSecret(x *big.Int, remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return pad(new(big.Int).Exp(y, x, prime).Bytes())
+}
+
+// pad left-pads a number to keySize bytes
+func pad(b []byte) []byte {
+	if len(b) >= keySize {
+		return b
+	}
+	out := make([]byte, keySize)
+	copy(out[keySize-len(b):], b)
+	return out
+}
+
+// hash returns the SHA-1 of its concatenated arguments
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher creates the RC4 cipher of one direction and discards the first 1024 bytes of its key stream
+func newCipher(name string, secret []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), secret, skey[:]))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// randomPadding returns between 0 and maxPadding random bytes
+func randomPadding() ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+	padding := make([]byte, (int(n[0])<<8|int(n[1]))%(maxPadding+1))
+	_, err = rand.Read(padding)
+	return padding, err
+}
+
+// Conn is a connection after the encryption handshake
+// Depending on the negotiated method the stream is RC4 encrypted or plaintext.
+type Conn struct {
+	net.Conn
+	r       io.Reader // the rest of the stream, after what was read during the handshake
+	pending []byte    // plaintext received during the handshake (the initial payload)
+	dec     *rc4.Cipher
+	enc     *rc4.Cipher
+	writeMu sync.Mutex
+}
+
+// Encrypted reports whether the stream is RC4 encrypted
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+// Read reads and decrypts data from the connection
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(p)
+	if c.dec != nil {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+// Write encrypts and writes data to the connection
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
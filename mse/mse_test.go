@@ -0,0 +1,172 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshakeResult is what one side of a handshake ended with
+type handshakeResult struct {
+	conn *Conn
+	err  error
+}
+
+// handshake runs Initiate and Accept against each other over an in-memory connection
+// It returns the results of the initiating and the accepting side.
+func handshake(infoHash [20]byte, initiator, responder Policy, served [20]byte) (handshakeResult, handshakeResult) {
+	a, b := net.Pipe()
+	accepted := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := Accept(b, responder, func() [][20]byte { return [][20]byte{{0xff}, served} })
+		if err != nil {
+			b.Close()
+		}
+		accepted <- handshakeResult{conn, err}
+	}()
+	conn, err := Initiate(a, infoHash, initiator)
+	if err != nil {
+		a.Close()
+	}
+	return handshakeResult{conn, err}, <-accepted
+}
+
+// exchange writes data on one connection and checks that it arrives on the other
+func exchange(t *testing.T, from, to net.Conn, data []byte) {
+	t.Helper()
+	go from.Write(data)
+	got := make([]byte, len(data))
+	_, err := io.ReadFull(to, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Received %q, want %q", got, data)
+	}
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	tests := []struct {
+		initiator, responder Policy
+	}{
+		{Preferred, Preferred},
+		{Preferred, Required},
+		{Required, Preferred},
+		{Required, Required},
+	}
+	for _, test := range tests {
+		init, acc := handshake(infoHash, test.initiator, test.responder, infoHash)
+		if init.err != nil || acc.err != nil {
+			t.Errorf("%s to %s: handshake failed: %v, %v", test.initiator, test.responder, init.err, acc.err)
+			continue
+		}
+		if !init.conn.Encrypted() || !acc.conn.Encrypted() {
+			t.Errorf("%s to %s: encrypted is %v and %v, want both", test.initiator, test.responder,
+				init.conn.Encrypted(), acc.conn.Encrypted())
+		}
+		exchange(t, init.conn, acc.conn, []byte("\x13BitTorrent protocol from the initiator"))
+		exchange(t, acc.conn, init.conn, []byte("\x13BitTorrent protocol from the responder"))
+		init.conn.Close()
+		acc.conn.Close()
+	}
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	tests := []struct {
+		name                 string
+		initiator, responder Policy
+		served               [20]byte
+	}{
+		{"unknown torrent", Preferred, Preferred, [20]byte{4, 5, 6}},
+		{"encryption disabled", Required, Disabled, infoHash},
+		{"initiator disabled", Disabled, Preferred, infoHash},
+	}
+	for _, test := range tests {
+		init, acc := handshake(infoHash, test.initiator, test.responder, test.served)
+		if init.err == nil || acc.err == nil {
+			t.Errorf("%s: handshake errors are %v and %v, want both to fail", test.name, init.err, acc.err)
+		}
+	}
+}
+
+func TestPlaintextPeer(t *testing.T) {
+	// A plaintext BitTorrent handshake: pstr, reserved bytes, info hash and peer ID
+	hello := append(append([]byte(nil), pstr...), make([]byte, 48)...)
+	tests := []struct {
+		policy  Policy
+		refused bool
+	}{
+		{Disabled, false},
+		{Preferred, false},
+		{Required, true},
+	}
+	for _, test := range tests {
+		a, b := net.Pipe()
+		go a.Write(hello)
+		conn, err := Accept(b, test.policy, func() [][20]byte { return nil })
+		if test.refused {
+			if err == nil {
+				t.Errorf("%s: a plaintext peer was accepted", test.policy)
+			}
+			a.Close()
+			b.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: a plaintext peer was refused: %v", test.policy, err)
+			a.Close()
+			b.Close()
+			continue
+		}
+		if conn.Encrypted() {
+			t.Errorf("%s: a plaintext connection is encrypted", test.policy)
+		}
+		// The bytes peeked at are read again as the BitTorrent handshake
+		got := make([]byte, len(hello))
+		_, err = io.ReadFull(conn, got)
+		if err != nil || !bytes.Equal(got, hello) {
+			t.Errorf("%s: read %q, %v, want the plaintext handshake", test.policy, got, err)
+		}
+		exchange(t, conn, a, []byte("plaintext answer"))
+		a.Close()
+		conn.Close()
+	}
+}
+
+func TestInitiateToPlaintextPeer(t *testing.T) {
+	// A peer without encryption answers our public key with its own handshake and hangs up;
+	// Initiate must fail so the caller can dial again in plaintext
+	a, b := net.Pipe()
+	go func() {
+		b.Read(make([]byte, keySize+maxPadding)) // Ya and PadA come in one write
+		b.Write(append(append([]byte(nil), pstr...), make([]byte, 48)...))
+		b.Close()
+	}()
+	_, err := Initiate(a, [20]byte{1}, Preferred)
+	if err == nil {
+		t.Error("The handshake with a plaintext peer succeeded")
+	}
+	a.Close()
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		fails  bool
+	}{
+		{"disabled", Disabled, false},
+		{"Preferred", Preferred, false},
+		{"REQUIRED", Required, false},
+		{"always", Disabled, true},
+	}
+	for _, test := range tests {
+		policy, err := ParsePolicy(test.name)
+		if (err != nil) != test.fails || policy != test.policy {
+			t.Errorf("ParsePolicy(%q) is %s, %v, want %s", test.name, policy, err, test.policy)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Description: The choker decides which peers we upload to.
+// Every RechokeInterval the interested peers that give us the most in return are unchoked, and every
+// OptimisticInterval one more interested peer is unchoked at random so new peers get a chance to prove themselves.
+package peer2peer
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"bit-torrent/client"
+)
+
+// UploadSlots is the number of peers unchoked at a time, including the optimistic unchoke
+var UploadSlots = 4
+
+// RechokeInterval is how often the unchoked peers are chosen again
+const RechokeInterval = 10 * time.Second
+
+// OptimisticInterval is how often the optimistic unchoke moves to another peer
+const OptimisticInterval = 30 * time.Second
+
+// chokeState is what the choker knows about one peer
+type chokeState struct {
+	interested bool      // the peer wants to download from us
+	choked     bool      // we choke the peer
+	chokedAt   time.Time // when we last choked the peer
+	uploaded   int64     // bytes sent to the peer since the last rechoke
+	downloaded int64     // bytes received from the peer since the last rechoke
+	rate       int64     // smoothed bytes per rechoke interval that rank the peer
+}
+
+// Choker chooses the peers we unchoke
+// While seeding peers are ranked by how fast we upload to them, while leeching by how fast they upload to us.
+type Choker struct {
+	mu         sync.Mutex
+	peers      map[*client.Client]*chokeState
+	optimistic *client.Client
+	seeding    bool
+	rounds     int
+	uploaded   int64     // bytes sent to all peers
+	interestAt time.Time // when a peer was last seen interested
+	done       chan struct{}
+}
+
+// NewChoker creates a choker and starts rechoking every RechokeInterval
+func NewChoker(seeding bool) *Choker {
+	ch := &Choker{
+		peers:      make(map[*client.Client]*chokeState),
+		seeding:    seeding,
+		interestAt: time.Now(),
+		done:       make(chan struct{}),
+	}
+	go ch.run()
+	return ch
+}
+
+// Close stops rechoking
+func (ch *Choker) Close() {
+	close(ch.done)
+}
+
+// SetSeeding switches between ranking peers by upload rate (seeding) and by download rate (leeching)
+func (ch *Choker) SetSeeding(seeding bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.seeding = seeding
+}
+
+// Add starts choking a peer; it is choked until it is interested and wins a slot
+// A peer the choker already knows, such as one handed from the download to the seeder, keeps its state.
+// It returns an error if the Choke message could not be sent.
+func (ch *Choker) Add(c *client.Client) error {
+	ch.mu.Lock()
+	if ch.peers[c] != nil {
+		ch.mu.Unlock()
+		return nil
+	}
+	ch.peers[c] = &chokeState{choked: true, chokedAt: time.Now()}
+	ch.mu.Unlock()
+	return c.SendChoke()
+}
+
+// Remove forgets a peer whose connection was closed
+func (ch *Choker) Remove(c *client.Client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	delete(ch.peers, c)
+	if ch.optimistic == c {
+		ch.optimistic = nil
+	}
+}
+
+// SetInterested records an Interested or NotInterested message of a peer
+// A peer that becomes interested while a slot is free is unchoked right away instead of at the next rechoke.
+func (ch *Choker) SetInterested(c *client.Client, interested bool) {
+	ch.mu.Lock()
+	state := ch.peers[c]
+	if state == nil {
+		ch.mu.Unlock()
+		return
+	}
+	state.interested = interested
+	unchoke := false
+	if interested && state.choked && ch.unchokedLocked() < UploadSlots {
+		state.choked = false
+		unchoke = true
+	}
+	ch.mu.Unlock()
+
+	if unchoke {
+		err := c.SendUnchoke()
+		if err != nil {
+			log.Printf("Could not unchoke %s: %v\n", c.Peer, err)
+		}
+	}
+}
+
+// IsChoked reports whether we choke a peer
+func (ch *Choker) IsChoked(c *client.Client) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	state := ch.peers[c]
+	return state == nil || state.choked
+}
+
+// ChokedSince returns when we choked a peer, or the zero time if we do not choke it
+func (ch *Choker) ChokedSince(c *client.Client) time.Time {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	state := ch.peers[c]
+	if state == nil || !state.choked {
+		return time.Time{}
+	}
+	return state.chokedAt
+}
+
+// Uploaded records bytes of piece data sent to a peer
+func (ch *Choker) Uploaded(c *client.Client, n int) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.uploaded += int64(n)
+	if state := ch.peers[c]; state != nil {
+		state.uploaded += int64(n)
+	}
+}
+
+// TotalUploaded returns the bytes of piece data sent to all peers
+func (ch *Choker) TotalUploaded() int64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.uploaded
+}
+
+// IdleFor returns how long no peer has been interested in our pieces, or 0 if one is
+func (ch *Choker) IdleFor() time.Duration {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for _, state := range ch.peers {
+		if state.interested {
+			ch.interestAt = time.Now()
+			return 0
+		}
+	}
+	return time.Since(ch.interestAt)
+}
+
+// Downloaded records bytes of piece data received from a peer
+func (ch *Choker) Downloaded(c *client.Client, n int) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if state := ch.peers[c]; state != nil {
+		state.downloaded += int64(n)
+	}
+}
+
+// unchokedLocked returns the number of peers we unchoke; ch.mu must be held
+func (ch *Choker) unchokedLocked() int {
+	n := 0
+	for _, state := range ch.peers {
+		if !state.choked {
+			n++
+		}
+	}
+	return n
+}
+
+// run rechokes every RechokeInterval until the choker is closed
+func (ch *Choker) run() {
+	ticker := time.NewTicker(RechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch.done:
+			return
+		case <-ticker.C:
+			ch.rechoke()
+		}
+	}
+}
+
+// rechoke unchokes the UploadSlots-1 interested peers with the best rates and the optimistic unchoke, and chokes the rest
+func (ch *Choker) rechoke() {
+	ch.mu.Lock()
+	ranked := make([]*client.Client, 0, len(ch.peers))
+	for c, state := range ch.peers {
+		// Average with the previous interval so a single slow interval does not cost a peer its slot
+		sample := state.downloaded
+		if ch.seeding {
+			sample = state.uploaded
+		}
+		state.rate = (state.rate + sample) / 2
+		state.uploaded, state.downloaded = 0, 0
+		if state.interested {
+			ranked = append(ranked, c)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		return ch.peers[ranked[i]].rate > ch.peers[ranked[j]].rate
+	})
+
+	unchoke := make(map[*client.Client]bool)
+	regular := UploadSlots - 1
+	if regular > len(ranked) {
+		regular = len(ranked)
+	}
+	for _, c := range ranked[:regular] {
+		unchoke[c] = true
+	}
+
+	// Move the optimistic unchoke every OptimisticInterval, or when its peer lost interest or earned a regular slot
+	rotate := ch.rounds%int(OptimisticInterval/RechokeInterval) == 0
+	ch.rounds++
+	if opt := ch.optimistic; opt == nil || rotate || unchoke[opt] || !ch.peers[opt].interested {
+		ch.optimistic = nil
+		candidates := ranked[regular:]
+		if len(candidates) > 0 {
+			ch.optimistic = candidates[rand.Intn(len(candidates))]
+		}
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+
+	var toChoke, toUnchoke []*client.Client
+	for c, state := range ch.peers {
+		if unchoke[c] && state.choked {
+			state.choked = false
+			toUnchoke = append(toUnchoke, c)
+		} else if !unchoke[c] && !state.choked {
+			state.choked = true
+			state.chokedAt = time.Now()
+			toChoke = append(toChoke, c)
+		}
+	}
+	ch.mu.Unlock()
+
+	for _, c := range toChoke {
+		err := c.SendChoke()
+		if err != nil {
+			log.Printf("Could not choke %s: %v\n", c.Peer, err)
+		}
+	}
+	for _, c := range toUnchoke {
+		err := c.SendUnchoke()
+		if err != nil {
+			log.Printf("Could not unchoke %s: %v\n", c.Peer, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package peer2peer
+
+import (
+	"net"
+	"testing"
+
+	"bit-torrent/client"
+)
+
+// discardConn is a connection that swallows the Choke and Unchoke messages of the choker
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+func (discardConn) Close() error                { return nil }
+
+// newTestChoker returns a choker that only rechokes when the test calls rechoke, with n interested peers
+func newTestChoker(seeding bool, n int) (*Choker, []*client.Client) {
+	ch := &Choker{peers: make(map[*client.Client]*chokeState), seeding: seeding}
+	clients := make([]*client.Client, n)
+	for i := range clients {
+		clients[i] = &client.Client{Conn: discardConn{}}
+		ch.Add(clients[i])
+		ch.SetInterested(clients[i], true)
+	}
+	return ch, clients
+}
+
+// unchoked returns the indexes of the clients the choker unchokes
+func unchoked(ch *Choker, clients []*client.Client) map[int]bool {
+	set := make(map[int]bool)
+	for i, c := range clients {
+		if !ch.IsChoked(c) {
+			set[i] = true
+		}
+	}
+	return set
+}
+
+func TestChokerRanking(t *testing.T) {
+	oldSlots := UploadSlots
+	defer func() { UploadSlots = oldSlots }()
+	UploadSlots = 4
+
+	tests := []struct {
+		name    string
+		seeding bool
+		want    []int // the peers that must win the three regular slots
+	}{
+		{"leeching", false, []int{0, 1, 2}}, // ranked by what they send us
+		{"seeding", true, []int{5, 4, 3}},   // ranked by what we send them
+	}
+	for _, test := range tests {
+		ch, clients := newTestChoker(test.seeding, 6)
+		// Peer 6 would rank first either way but is not interested
+		idle := &client.Client{Conn: discardConn{}}
+		ch.Add(idle)
+		for i, c := range clients {
+			ch.Downloaded(c, (6-i)*1000)
+			ch.Uploaded(c, (i+1)*1000)
+		}
+		ch.Downloaded(idle, 100000)
+		ch.Uploaded(idle, 100000)
+		ch.rechoke()
+
+		got := unchoked(ch, clients)
+		for _, i := range test.want {
+			if !got[i] {
+				t.Errorf("%s: peer %d is choked, unchoked are %v", test.name, i, got)
+			}
+		}
+		// The fourth slot is the optimistic unchoke of one of the others
+		if len(got) != UploadSlots {
+			t.Errorf("%s: %d peers are unchoked, want %d", test.name, len(got), UploadSlots)
+		}
+		if !ch.IsChoked(idle) {
+			t.Errorf("%s: a peer that is not interested was unchoked", test.name)
+		}
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	oldSlots := UploadSlots
+	defer func() { UploadSlots = oldSlots }()
+	UploadSlots = 2
+
+	// Peer 0 keeps the regular slot; the optimistic slot goes to one of the other nine
+	ch, clients := newTestChoker(false, 10)
+	optimistic := func() *client.Client {
+		ch.mu.Lock()
+		defer ch.mu.Unlock()
+		return ch.optimistic
+	}
+	roundsPerRotation := int(OptimisticInterval / RechokeInterval)
+
+	moved := 0
+	var previous *client.Client
+	for round := 0; round < 10*roundsPerRotation; round++ {
+		ch.Downloaded(clients[0], 1000)
+		ch.rechoke()
+		opt := optimistic()
+		if opt == nil || opt == clients[0] {
+			t.Fatalf("Round %d: optimistic unchoke is %v, want one of the other peers", round, opt)
+		}
+		if ch.IsChoked(opt) || ch.IsChoked(clients[0]) || len(unchoked(ch, clients)) != UploadSlots {
+			t.Fatalf("Round %d: unchoked peers are %v", round, unchoked(ch, clients))
+		}
+		if round%roundsPerRotation != 0 && opt != previous {
+			t.Fatalf("Round %d: the optimistic unchoke moved before %v passed", round, OptimisticInterval)
+		}
+		if round > 0 && round%roundsPerRotation == 0 && opt != previous {
+			moved++
+		}
+		previous = opt
+	}
+	// Each rotation picks one of nine peers at random, so it almost never stays put nine times
+	if moved == 0 {
+		t.Error("The optimistic unchoke never moved")
+	}
+
+	// A peer that loses interest loses the optimistic slot at the next rechoke
+	ch.SetInterested(previous, false)
+	ch.rechoke()
+	if opt := optimistic(); opt == previous || !ch.IsChoked(previous) {
+		t.Error("The optimistic unchoke stayed with a peer that is not interested")
+	}
+}
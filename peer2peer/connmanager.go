@@ -0,0 +1,239 @@
+// Description: ConnManager keeps track of the peers of a torrent and the clients connected to them.
+// Peers learned after the initial tracker announce (from peer exchange, for example) are dialed here.
+package peer2peer
+
+import (
+	"log"
+	"sync"
+
+	"bit-torrent/bitfield"
+	"bit-torrent/client"
+	"bit-torrent/peers"
+)
+
+// MaxConns is the largest number of peers we stay connected to per torrent
+const MaxConns = 50
+
+// ConnManager keeps track of the clients connected for one torrent
+type ConnManager struct {
+	peerID    [20]byte
+	infoHash  [20]byte
+	numPieces int
+	private   bool // a private torrent (BEP 27), whose peers come only from its trackers
+
+	mu       sync.Mutex
+	dialing  map[string]bool           // addresses we are dialing
+	clients  map[string]*client.Client // connected clients by address
+	outgoing map[*client.Client]bool   // clients we dialed ourselves
+	pex      map[*client.Client]*pexState
+	have     bitfield.Bitfield // pieces we have verified
+	hideHave bool              // super-seeding: peers are told we have no pieces
+	handler  func(*client.Client)
+	done     chan struct{}
+}
+
+var (
+	managersMu sync.Mutex
+	managers   = make(map[[20]byte]*ConnManager)
+)
+
+// NewConnManager creates the connection manager of a torrent and starts peer exchange, unless the torrent is private
+// It is registered under the info hash so incoming extension messages can find it.
+func NewConnManager(peerID, infoHash [20]byte, numPieces int, private bool) *ConnManager {
+	m := &ConnManager{
+		peerID:    peerID,
+		infoHash:  infoHash,
+		numPieces: numPieces,
+		private:   private,
+		dialing:   make(map[string]bool),
+		clients:   make(map[string]*client.Client),
+		outgoing:  make(map[*client.Client]bool),
+		pex:       make(map[*client.Client]*pexState),
+		have:      bitfield.New(numPieces),
+		done:      make(chan struct{}),
+	}
+
+	managersMu.Lock()
+	managers[infoHash] = m
+	managersMu.Unlock()
+
+	if !private {
+		go m.runPEX()
+	}
+	return m
+}
+
+// lookupManager returns the connection manager of the torrent with the given info hash, or nil
+func lookupManager(infoHash [20]byte) *ConnManager {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+	return managers[infoHash]
+}
+
+// Close stops peer exchange and unregisters the manager; connected clients are left open
+func (m *ConnManager) Close() {
+	managersMu.Lock()
+	if managers[m.infoHash] == m {
+		delete(managers, m.infoHash)
+	}
+	managersMu.Unlock()
+	close(m.done)
+}
+
+// Done returns a channel that is closed when the manager is closed
+func (m *ConnManager) Done() <-chan struct{} {
+	return m.done
+}
+
+// SetPiece records that we have verified a piece and announces it to the connected peers with a Have message
+func (m *ConnManager) SetPiece(index int) {
+	m.mu.Lock()
+	if m.have.HasPiece(index) {
+		m.mu.Unlock()
+		return
+	}
+	m.have.SetPiece(index)
+	if m.hideHave {
+		m.mu.Unlock()
+		return
+	}
+	clients := make([]*client.Client, 0, len(m.clients))
+	for _, c := range m.clients {
+		clients = append(clients, c)
+	}
+	m.mu.Unlock()
+
+	for _, c := range clients {
+		err := c.SendHave(index)
+		if err != nil {
+			log.Printf("Could not send have to %s: %v\n", c.Peer, err)
+		}
+	}
+}
+
+// Bitfield returns a copy of the pieces we have verified
+func (m *ConnManager) Bitfield() bitfield.Bitfield {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bf := make(bitfield.Bitfield, len(m.have))
+	copy(bf, m.have)
+	return bf
+}
+
+// SetSuperSeeding makes new connections, and pieces verified from now on, not reveal the pieces we have,
+// so the super-seeder can announce them one at a time
+func (m *ConnManager) SetSuperSeeding(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hideHave = on
+}
+
+// advertised returns the pieces we tell new connections about
+func (m *ConnManager) advertised() bitfield.Bitfield {
+	m.mu.Lock()
+	hide := m.hideHave
+	m.mu.Unlock()
+	if hide {
+		return bitfield.New(m.numPieces)
+	}
+	return m.Bitfield()
+}
+
+// SetHandler sets the function that takes over clients connected from now on,
+// e.g. to start a download worker for them. Without a handler clients are only registered.
+func (m *ConnManager) SetHandler(handler func(*client.Client)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handler = handler
+}
+
+// Connect dials a peer and registers the resulting client
+// It returns the client and an error if one occurred.
+func (m *ConnManager) Connect(p peers.Peer) (*client.Client, error) {
+	c, err := client.New(p, m.peerID, m.infoHash, m.advertised(), m.numPieces)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.outgoing[c] = true
+	m.mu.Unlock()
+	m.register(c)
+	return c, nil
+}
+
+// AddPeers dials the peers we are not connected to yet, in the background, while we have room for more connections
+// Clients that connect are registered and passed to the handler.
+func (m *ConnManager) AddPeers(ps []peers.Peer) {
+	for _, p := range ps {
+		addr := p.String()
+		m.mu.Lock()
+		if m.dialing[addr] || m.clients[addr] != nil || len(m.clients)+len(m.dialing) >= MaxConns {
+			m.mu.Unlock()
+			continue
+		}
+		m.dialing[addr] = true
+		m.mu.Unlock()
+
+		go func(p peers.Peer) {
+			c, err := m.Connect(p)
+			m.mu.Lock()
+			delete(m.dialing, p.String())
+			handler := m.handler
+			m.mu.Unlock()
+			if err != nil {
+				return
+			}
+			log.Printf("Connected to new peer %s\n", p)
+			if handler != nil {
+				handler(c)
+			}
+		}(p)
+	}
+}
+
+// AddClient registers a client that is already connected, such as one that connected to us
+// It returns false, and closes the client, if we have no room for it.
+func (m *ConnManager) AddClient(c *client.Client) bool {
+	m.mu.Lock()
+	full := len(m.clients) >= MaxConns
+	handler := m.handler
+	m.mu.Unlock()
+	if full {
+		c.Close()
+		return false
+	}
+	m.register(c)
+	if handler != nil {
+		handler(c)
+	}
+	return true
+}
+
+// register adds a connected client to the manager
+func (m *ConnManager) register(c *client.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients[c.Peer.String()] = c
+}
+
+// Remove forgets a client whose connection was closed
+func (m *ConnManager) Remove(c *client.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.clients[c.Peer.String()] == c {
+		delete(m.clients, c.Peer.String())
+	}
+	delete(m.outgoing, c)
+	delete(m.pex, c)
+}
+
+// Clients returns the connected clients
+func (m *ConnManager) Clients() []*client.Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clients := make([]*client.Client, 0, len(m.clients))
+	for _, c := range m.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
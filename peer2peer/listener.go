@@ -0,0 +1,70 @@
+// Description: The listener accepts the connections peers open to us and routes them to the torrents of the session.
+package peer2peer
+
+import (
+	"log"
+	"net"
+
+	"bit-torrent/bitfield"
+	"bit-torrent/client"
+)
+
+// session is the set of torrents with a registered connection manager
+type session struct{}
+
+// InfoHashes returns the info hashes of the registered torrents
+func (session) InfoHashes() [][20]byte {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+	hashes := make([][20]byte, 0, len(managers))
+	for h := range managers {
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+// Lookup returns our peer ID, the pieces we advertise and the number of pieces of a registered torrent
+func (session) Lookup(infoHash [20]byte) ([20]byte, bitfield.Bitfield, int, bool) {
+	m := lookupManager(infoHash)
+	if m == nil {
+		return [20]byte{}, nil, 0, false
+	}
+	return m.peerID, m.advertised(), m.numPieces, true
+}
+
+// Serve accepts peer connections on the listener until it is closed
+// Each client is handed to the connection manager of the torrent it asks for, which passes it on
+// to the download or seed logic.
+// It returns the error that stopped it.
+func Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go serveConn(conn)
+	}
+}
+
+// serveConn completes the handshake of an accepted connection and registers the client
+func serveConn(conn net.Conn) {
+	c, err := client.Accept(conn, session{})
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	m := lookupManager(c.InfoHash())
+	if m == nil {
+		c.Close()
+		return
+	}
+	if !m.AddClient(c) {
+		log.Printf("Rejected connection from %s: too many peers\n", c.Peer)
+		return
+	}
+	log.Printf("Accepted connection from %s\n", c.Peer)
+}
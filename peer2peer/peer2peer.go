@@ -8,11 +8,15 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"log"
 	"runtime"
+	"sync"
 	"time"
 
+	"bit-torrent/bitfield"
 	"bit-torrent/client"
+	"bit-torrent/merkle"
 	"bit-torrent/message"
 	"bit-torrent/peers"
 )
@@ -31,6 +35,11 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Conns       *ConnManager // clients connected for this torrent, nil if not managed
+	FilesV2     []FileV2     // the files of a v2 or hybrid torrent; v2-only torrents verify their pieces with them
+	WebSeeds    []WebSeed    // HTTP sources of the data that pieces are downloaded from alongside the peers
+	Private     bool         // a private torrent (BEP 27): no DHT, local service discovery or peer exchange
+	Choker      *Choker      // chooses the peers we upload to while downloading and seeding, nil if not shared
 }
 
 // this struct contains the following fields: index, hash, and length
@@ -38,6 +47,7 @@ type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+	v2     *pieceV2 // set instead of hash for v2-only torrents
 }
 
 // this struct contains the following fields: index, buf
@@ -54,12 +64,26 @@ type pieceProgress struct {
 	downloaded int
 	requested  int
 	backlog    int
+	rejected   []block     // blocks the peer rejected, to be requested again
+	store      *pieceStore // pieces we serve to the peer, nil if we serve none
+	choker     *Choker     // ranks the peer by what it sends us, nil if we do not upload
+
+	hashRequest  *message.HashRequest // the hash request we wait for an answer to, if any
+	hashes       [][32]byte           // the answer to hashRequest
+	hashRejected bool                 // whether the peer rejected hashRequest
 }
-// startDownloadWorker starts a worker that downloads pieces from a peer and puts them on the results queue when done downloading them (or when an error occurs)
 
+// block is the begin offset and length of a block of a piece
+type block struct {
+	begin  int
+	length int
+}
 
+// startDownloadWorker starts a worker that downloads pieces from a peer and puts them on the results queue when done downloading them (or when an error occurs)
+// While downloading, and while the peer has none of the pieces we still need, the worker also serves
+// the peer's requests for the pieces in store.
 func (t *Torrent) startDownloadWorker(c *client.Client, workQueue chan *pieceWork,
-	results chan *pieceResult) {
+	results chan *pieceResult, store *pieceStore, choker *Choker, done <-chan struct{}) {
 	// c, err := client.New(peer, t.PeerID, t.InfoHash)
 	// if err != nil {
 	// 	log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
@@ -67,31 +91,74 @@ func (t *Torrent) startDownloadWorker(c *client.Client, workQueue chan *pieceWor
 	// }
 	// defer c.Conn.Close()
 	// log.Printf("Completed handshake with %s\n", peer.IP)
-	c.SendUnchoke()
-	c.SendInterested()
+	// A client whose connection failed is closed and forgotten, so it no longer counts towards MaxConns, is
+	// reported as dropped to peer exchange and is not handed to the seeder; after the download it is kept
+	failed := true
+	defer func() {
+		if failed {
+			c.Close()
+			choker.Remove(c)
+			if t.Conns != nil {
+				t.Conns.Remove(c)
+			}
+		}
+	}()
+
+	// The peer is unchoked when the choker gives it an upload slot, and told we are interested while it has
+	// pieces we need
+	choker.Add(c)
+	choker.SetInterested(c, c.PeerInterested())
 
+	misses := 0
 	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
+		if !c.HasPiece(pw.index) {
 			workQueue <- pw // Put piece
+			misses++
+			// After a full round of pieces the peer does not have, wait for its messages instead of spinning
+			if misses > len(workQueue) {
+				misses = 0
+				if c.Interested() {
+					c.SendNotInterested()
+				}
+				err := serveIdle(c, store, choker, done)
+				if err != nil {
+					log.Println("Exiting", err)
+					return
+				}
+			}
 			continue
 		}
+		misses = 0
+		if !c.Interested() {
+			c.SendInterested()
+		}
 		// Download the piece
 
-		buf, err := attemptDownloadPiece(c, pw)
+		buf, err := attemptDownloadPiece(c, pw, store, choker)
 		if err != nil {
 			log.Println("Exiting", err)
 			workQueue <- pw // Put piece back on the queue
 			return
 		}
 		err = checkIntegrity(pw, buf)
+		if err != nil && pw.v2 != nil {
+			// Only the blocks that do not match their hash are downloaded again
+			err = repairPiece(c, pw, buf, store, choker)
+			if err == nil {
+				err = checkIntegrity(pw, buf)
+			}
+		}
 		if err != nil {
 			log.Printf("Piece #%d failed integrity check\n", pw.index)
 			workQueue <- pw // Put piece back on the queue
 			continue
 		}
-		c.SendHave(pw.index)
+		if t.Conns == nil {
+			c.SendHave(pw.index) // with a ConnManager every peer is told when the piece is collected
+		}
 		results <- &pieceResult{pw.index, buf}
 	}
+	failed = false
 }
 
 // readMessage reads a message from the peer and updates the pieceProgress struct accordingly (if the message is a piece message)
@@ -106,6 +173,10 @@ func (state *pieceProgress) readMessage() error {
 	}
 
 	switch msg.ID {
+	case message.MsgInterested, message.MsgNotInterested:
+		if state.choker != nil {
+			state.choker.SetInterested(state.client, msg.ID == message.MsgInterested)
+		}
 	case message.MsgUnchoke:
 		state.client.Choked = false
 	case message.MsgChoke:
@@ -115,24 +186,82 @@ func (state *pieceProgress) readMessage() error {
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
+		state.client.SetPiece(index)
+	case message.MsgBitfield:
+		// A peer that was slow to send its bitfield was taken to have no pieces until now
+		state.client.SetBitfield(msg.Payload)
+	case message.MsgHaveAll:
+		if state.client.SupportsFast() {
+			state.client.SetHaveAll()
+		}
+	case message.MsgHaveNone:
+		if state.client.SupportsFast() {
+			state.client.SetBitfield(bitfield.Bitfield{})
+		}
+	case message.MsgReject:
+		index, begin, length, err := message.ParseReject(msg)
+		if err != nil {
+			return err
+		}
+		// Ask again for rejected blocks of the piece we are downloading
+		if index == state.index {
+			state.backlog--
+			state.rejected = append(state.rejected, block{begin, length})
+		}
+	case message.MsgRequest:
+		if state.store != nil {
+			return state.store.serveRequest(state.client, msg, state.choker)
+		}
+	case message.MsgHashRequest:
+		// Hashes below the piece layer are hashed from our data, so only unchoked peers get them
+		if state.store != nil {
+			var data io.ReaderAt = state.store
+			if state.choker != nil && state.choker.IsChoked(state.client) {
+				data = nil
+			}
+			return state.store.t.ServeHashRequest(state.client, msg, data)
+		}
+	case message.MsgHashes:
+		req, hashes, err := message.ParseHashes(msg)
+		if err != nil {
+			return err
+		}
+		if state.hashRequest != nil && req == *state.hashRequest {
+			state.hashes = hashes
+		}
+	case message.MsgHashReject:
+		req, err := message.ParseHashReject(msg)
+		if err != nil {
+			return err
+		}
+		if state.hashRequest != nil && req == *state.hashRequest {
+			state.hashRejected = true
+		}
 	case message.MsgPiece:
+		if state.buf == nil {
+			return nil // not downloading a piece
+		}
 		n, err := message.ParsePiece(state.index, state.buf, msg)
 		if err != nil {
 			return err
 		}
 		state.downloaded += n
 		state.backlog--
+		if state.choker != nil {
+			state.choker.Downloaded(state.client, n)
+		}
 	}
 	return nil
 }
 
 // attemptDownloadPiece attempts to download a piece from a peer and returns the piece data (or an error if it fails)
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
+func attemptDownloadPiece(c *client.Client, pw *pieceWork, store *pieceStore, choker *Choker) ([]byte, error) {
 	state := pieceProgress{
 		index:  pw.index,
 		client: c,
 		buf:    make([]byte, pw.length),
+		store:  store,
+		choker: choker,
 	}
 
 	// Setting a deadline helps get unresponsive peers unstuck.
@@ -140,9 +269,30 @@ func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
 	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
 
+	err := state.download(pw)
+	if err != nil {
+		return nil, err
+	}
+	return state.buf, nil
+}
+
+// download requests the blocks of the piece that are neither downloaded nor requested yet, and those the peer
+// rejected, and reads messages until the whole piece is downloaded
+// It returns an error if the connection failed.
+func (state *pieceProgress) download(pw *pieceWork) error {
+	c := state.client
 	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
+		// If unchoked, or allowed to request this piece while choked, send requests until we have enough unfulfilled requests
+		if !state.client.Choked || c.IsAllowedFast(pw.index) {
+			for state.backlog < MaxBacklog && len(state.rejected) > 0 {
+				b := state.rejected[0]
+				err := c.SendRequest(pw.index, b.begin, b.length)
+				if err != nil {
+					return err
+				}
+				state.rejected = state.rejected[1:]
+				state.backlog++
+			}
 			for state.backlog < MaxBacklog && state.requested < pw.length {
 				blockSize := MaxBlockSize
 				// Last block might be shorter than the typical block
@@ -152,7 +302,7 @@ func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 
 				err := c.SendRequest(pw.index, state.requested, blockSize)
 				if err != nil {
-					return nil, err
+					return err
 				}
 				state.backlog++
 				state.requested += blockSize
@@ -161,15 +311,63 @@ func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 
 		err := state.readMessage()
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
+	return nil
+}
 
-	return state.buf, nil
+// idleWait is how long a worker whose peer has nothing we need waits for a message before trying the queue again
+const idleWait = 2 * time.Second
+
+// maxIdleServe is the longest a worker serves a peer that has nothing we need before trying the queue again,
+// even if the peer keeps sending messages
+const maxIdleServe = 10 * time.Second
+
+// serveIdle handles the messages of a peer that has none of the pieces we still need, such as its requests
+// and Have messages, until it falls silent for idleWait, maxIdleServe has passed or done is closed
+// Only the start of a message is waited for with a deadline; once a message started it has to arrive in full,
+// or the connection fails, since a read cut off part-way through would lose the framing of the messages.
+// It returns an error if the connection failed.
+func serveIdle(c *client.Client, store *pieceStore, choker *Choker, done <-chan struct{}) error {
+	state := pieceProgress{index: -1, client: c, store: store, choker: choker}
+	end := time.Now().Add(maxIdleServe)
+	for time.Now().Before(end) {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		wait := idleWait
+		if left := time.Until(end); left < wait {
+			wait = left
+		}
+		started, err := c.WaitMessage(wait)
+		if err != nil {
+			return err
+		}
+		if !started {
+			return nil
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(client.MessageTimeout))
+		err = state.readMessage()
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // checkIntegrity checks if the downloaded piece matches the hash in the torrent file and returns an error if it doesn't
+// A piece of a v2-only torrent has to match its node of the merkle tree instead.
 func checkIntegrity(pw *pieceWork, buf []byte) error {
+	if pw.v2 != nil {
+		if merkle.PieceRoot(buf, pw.v2.width) != pw.v2.root {
+			return fmt.Errorf("Index %d failed integrity check", pw.index)
+		}
+		return nil
+	}
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
 		return fmt.Errorf("Index %d failed integrity check", pw.index)
@@ -177,18 +375,45 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
+// newPieceWork returns the work of downloading a piece, with what the piece is verified against
+func (t *Torrent) newPieceWork(index int) *pieceWork {
+	pw := &pieceWork{index: index, length: t.PieceSize(index)}
+	if t.PieceHashes != nil {
+		pw.hash = t.PieceHashes[index]
+	} else {
+		pw.v2 = t.pieceV2(index)
+	}
+	return pw
+}
+
+// VerifyPiece reports whether data is the correct content of a piece
+func (t *Torrent) VerifyPiece(index int, data []byte) bool {
+	if index < 0 || index >= t.NumPieces() {
+		return false
+	}
+	pw := t.newPieceWork(index)
+	if t.PieceHashes == nil && pw.v2 == nil {
+		return false
+	}
+	return checkIntegrity(pw, data) == nil
+}
+
 // calculateBoundsForPiece calculates the begin and end byte offsets for a piece with the given index in the torrent file and returns them as a tuple
+// The last piece of a file of a v2-only torrent ends with the file, before the padding that aligns the next file.
 func (t *Torrent) calculateBoundsForPiece(index int) (begin, end int) {
 	begin = index * t.PieceLength
 	end = begin + t.PieceLength
 	if end > t.Length {
 		end = t.Length
 	}
+	if v := t.pieceV2(index); v != nil && int64(end) > v.file.Offset+v.file.Length {
+		end = int(v.file.Offset + v.file.Length)
+	}
 	return begin, end
 }
 
-// calculatePieceSize calculates the size of a piece with the given index in the torrent file and returns it as an integer
-func (t *Torrent) calculatePieceSize(index int) int {
+// PieceSize calculates the size of a piece with the given index in the torrent file and returns it as an integer
+func (t *Torrent) PieceSize(index int) int {
 	begin, end := t.calculateBoundsForPiece(index)
 	return end - begin
 }
@@ -197,33 +422,81 @@ func (t *Torrent) calculatePieceSize(index int) int {
 func (t *Torrent) Download(clients []*client.Client) ([]byte, error) {
 	log.Println("Starting download for", t.Name)
 	// Init queues for workers to retrieve work and send results
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
+	numPieces := t.NumPieces()
+	workQueue := make(chan *pieceWork, numPieces)
 	results := make(chan *pieceResult)
 
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+	for index := 0; index < numPieces; index++ {
+		workQueue <- t.newPieceWork(index)
 	}
 
-	// Start worker
-	for _, client := range clients {
-		go t.startDownloadWorker(client, workQueue, results)
+	// Verified pieces are served to peers while the download runs, who are ranked by how fast they upload to us
+	store := newPieceStore(t)
+	choker := t.Choker
+	if choker == nil {
+		choker = NewChoker(false)
+		defer choker.Close()
 	}
 
-	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
+	// Start worker, at most one per client
+	// The workers are waited for, so no worker reads from a client any more once the download returns and the
+	// client may be handed to the seeder; done tells workers serving an idle peer to stop.
+	var workers sync.WaitGroup
+	done := make(chan struct{})
+	var startedMu sync.Mutex
+	started := make(map[*client.Client]bool)
+	finished := false
+	startWorker := func(c *client.Client) {
+		startedMu.Lock()
+		defer startedMu.Unlock()
+		if finished || started[c] {
+			return
+		}
+		started[c] = true
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			t.startDownloadWorker(c, workQueue, results, store, choker, done)
+		}()
+	}
+	for _, c := range clients {
+		startWorker(c)
+	}
+	for _, seed := range t.WebSeeds {
+		t.startWebSeedWorkers(seed, workQueue, results)
+	}
+	// Peers connected during the download, e.g. through peer exchange, get a worker too, and so do the ones
+	// registered before the handler was set, such as peers found on the local network meanwhile
+	if t.Conns != nil {
+		t.Conns.SetHandler(startWorker)
+		for _, c := range t.Conns.Clients() {
+			startWorker(c)
+		}
+	}
+
+	// Collect results into the store until full
 	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
+	for donePieces < numPieces {
 		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
+		store.put(res.index, res.buf)
 		donePieces++
+		if t.Conns != nil {
+			t.Conns.SetPiece(res.index)
+		}
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
+		percent := float64(donePieces) / float64(numPieces) * 100
 		numWorkers := runtime.NumGoroutine() - 1 // substrat one main thread
 		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
 	}
 	close(workQueue)
+	close(done)
+	if t.Conns != nil {
+		t.Conns.SetHandler(nil)
+	}
+	startedMu.Lock()
+	finished = true
+	startedMu.Unlock()
+	workers.Wait()
 
-	return buf, nil
+	return store.buf, nil
 }
@@ -0,0 +1,248 @@
+// Description: Peer exchange (ut_pex, BEP 11).
+// Connected peers are told which peers we connected to or dropped since the last message,
+// and the peers they tell us about are handed to the connection manager.
+package peer2peer
+
+import (
+	"log"
+	"time"
+
+	"bit-torrent/client"
+	"bit-torrent/peers"
+)
+
+// PEXInterval is how often we send peer exchange messages; peers must not send them more often than once a minute
+const PEXInterval = time.Minute
+
+// maxPEXPeers is the largest number of added, and of dropped, peers in one message
+const maxPEXPeers = 50
+
+// minPEXGap is the shortest gap between two messages of a peer we accept, with some slack for timer jitter
+const minPEXGap = 45 * time.Second
+
+// Flags describing an added peer
+const (
+	pexEncryption = 0x01 // prefers encryption
+	pexSeed       = 0x02 // is a seed or upload only
+	pexUTP        = 0x04 // supports uTP
+	pexHolepunch  = 0x08 // supports ut_holepunch
+	pexReachable  = 0x10 // accepts incoming connections
+)
+
+// pexState is the peer exchange state of one connection
+type pexState struct {
+	sent     map[string]peers.Peer // peers the remote peer knows from us
+	lastRecv time.Time
+}
+
+func init() {
+	client.RegisterExtension("ut_pex", handlePEX)
+	client.ExtensionFilter = offerExtension
+}
+
+// offerExtension reports whether an extension is offered for a torrent: private torrents do without peer exchange
+func offerExtension(infoHash [20]byte, name string) bool {
+	if name != "ut_pex" {
+		return true
+	}
+	m := lookupManager(infoHash)
+	return m == nil || !m.private
+}
+
+// runPEX sends peer exchange messages to the connected peers every PEXInterval until the manager is closed
+func (m *ConnManager) runPEX() {
+	ticker := time.NewTicker(PEXInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.sendPEX()
+		}
+	}
+}
+
+// sendPEX sends every peer that supports ut_pex the peers added and dropped since its last message
+func (m *ConnManager) sendPEX() {
+	m.mu.Lock()
+	current := make(map[string]peers.Peer)
+	flags := make(map[string]byte)
+	clients := make([]*client.Client, 0, len(m.clients))
+	for _, c := range m.clients {
+		clients = append(clients, c)
+		p, ok := m.pexAddr(c)
+		if !ok {
+			continue
+		}
+		current[p.String()] = p
+		flags[p.String()] = m.pexFlags(c)
+	}
+	m.mu.Unlock()
+
+	for _, c := range clients {
+		if !c.SupportsExtension("ut_pex") {
+			continue
+		}
+
+		m.mu.Lock()
+		state := m.pexStateOf(c)
+		self, _ := m.pexAddr(c)
+		var added, dropped []peers.Peer
+		for addr, p := range current {
+			if _, ok := state.sent[addr]; ok || addr == self.String() || len(added) == maxPEXPeers {
+				continue
+			}
+			added = append(added, p)
+			state.sent[addr] = p
+		}
+		for addr, p := range state.sent {
+			if _, ok := current[addr]; ok || len(dropped) == maxPEXPeers {
+				continue
+			}
+			dropped = append(dropped, p)
+			delete(state.sent, addr)
+		}
+		m.mu.Unlock()
+
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+		payload, err := encodePEX(added, dropped, flags)
+		if err != nil {
+			log.Printf("Could not encode peer exchange message: %v\n", err)
+			return
+		}
+		err = c.SendExtended("ut_pex", payload)
+		if err != nil {
+			log.Printf("Could not send peer exchange message to %s: %v\n", c.Peer, err)
+		}
+	}
+}
+
+// pexStateOf returns the peer exchange state of a client, creating it if needed; m.mu must be held
+func (m *ConnManager) pexStateOf(c *client.Client) *pexState {
+	state := m.pex[c]
+	if state == nil {
+		state = &pexState{sent: make(map[string]peers.Peer)}
+		m.pex[c] = state
+	}
+	return state
+}
+
+// pexAddr returns the address other peers can reach a connected peer on; m.mu must be held
+// Peers that connected to us are only reachable on the port from their extended handshake.
+func (m *ConnManager) pexAddr(c *client.Client) (peers.Peer, bool) {
+	if m.outgoing[c] {
+		return c.Peer, true
+	}
+	hs := c.ExtendedHandshake()
+	if hs == nil || hs.Port == 0 {
+		return peers.Peer{}, false
+	}
+	return peers.Peer{IP: c.Peer.IP, Port: hs.Port}, true
+}
+
+// pexFlags returns the flags we advertise for a connected peer; m.mu must be held
+func (m *ConnManager) pexFlags(c *client.Client) byte {
+	var flags byte
+	if m.outgoing[c] {
+		flags |= pexReachable
+	}
+	if hs := c.ExtendedHandshake(); hs != nil {
+		if e, ok := hs.Fields["e"].(int64); ok && e != 0 {
+			flags |= pexEncryption
+		}
+	}
+	if c.IsSeed(m.numPieces) {
+		flags |= pexSeed
+	}
+	return flags
+}
+
+// encodePEX builds the payload of a ut_pex message, splitting the peers by address family
+// It returns the payload and an error if one occurred.
+func encodePEX(added, dropped []peers.Peer, flags map[string]byte) ([]byte, error) {
+	var added4, added6, dropped4, dropped6 []peers.Peer
+	var flags4, flags6 []byte
+	for _, p := range added {
+		if p.IsIPv6() {
+			added6 = append(added6, p)
+			flags6 = append(flags6, flags[p.String()])
+		} else {
+			added4 = append(added4, p)
+			flags4 = append(flags4, flags[p.String()])
+		}
+	}
+	for _, p := range dropped {
+		if p.IsIPv6() {
+			dropped6 = append(dropped6, p)
+		} else {
+			dropped4 = append(dropped4, p)
+		}
+	}
+
+	dict := map[string]interface{}{
+		"added":    string(peers.Marshal(added4)),
+		"added.f":  string(flags4),
+		"dropped":  string(peers.Marshal(dropped4)),
+		"added6":   string(peers.Marshal6(added6)),
+		"added6.f": string(flags6),
+		"dropped6": string(peers.Marshal6(dropped6)),
+	}
+	return client.EncodeExtended(dict, nil)
+}
+
+// handlePEX handles a ut_pex message by handing the added peers to the connection manager of the torrent
+// Messages that arrive sooner than a minute after the previous one are ignored.
+func handlePEX(c *client.Client, payload []byte) error {
+	m := lookupManager(c.InfoHash())
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	state := m.pexStateOf(c)
+	now := time.Now()
+	early := !state.lastRecv.IsZero() && now.Sub(state.lastRecv) < minPEXGap
+	if !early {
+		state.lastRecv = now
+	}
+	m.mu.Unlock()
+	if early {
+		log.Printf("Ignoring peer exchange message from %s sent too soon\n", c.Peer)
+		return nil
+	}
+
+	dict, _, err := client.DecodeExtended(payload)
+	if err != nil {
+		return err
+	}
+
+	var added []peers.Peer
+	if s, ok := dict["added"].(string); ok {
+		ps, err := peers.Unmarshal([]byte(s))
+		if err != nil {
+			return err
+		}
+		added = append(added, limitPEX(ps)...)
+	}
+	if s, ok := dict["added6"].(string); ok {
+		ps, err := peers.Unmarshal6([]byte(s))
+		if err != nil {
+			return err
+		}
+		added = append(added, limitPEX(ps)...)
+	}
+	// Dropped peers need no action: we only drop peers whose connection fails
+	m.AddPeers(added)
+	return nil
+}
+
+// limitPEX truncates a list of peers from a message to maxPEXPeers
+func limitPEX(ps []peers.Peer) []peers.Peer {
+	if len(ps) > maxPEXPeers {
+		return ps[:maxPEXPeers]
+	}
+	return ps
+}
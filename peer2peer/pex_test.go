@@ -0,0 +1,127 @@
+package peer2peer
+
+import (
+	"net"
+	"testing"
+
+	"bit-torrent/client"
+	"bit-torrent/peers"
+)
+
+func TestEncodePEX(t *testing.T) {
+	added := []peers.Peer{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 6883},
+	}
+	dropped := []peers.Peer{
+		{IP: net.ParseIP("2001:db8::2"), Port: 6884},
+		{IP: net.IPv4(10, 0, 0, 3), Port: 6885},
+	}
+	flags := map[string]byte{
+		added[0].String(): pexReachable | pexSeed,
+		added[1].String(): pexEncryption,
+	}
+	payload, err := encodePEX(added, dropped, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, _, err := client.DecodeExtended(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key   string
+		ipv6  bool
+		want  []peers.Peer
+		flags string
+	}{
+		{"added", false, []peers.Peer{added[0], added[2]}, string([]byte{pexReachable | pexSeed, 0})},
+		{"added6", true, []peers.Peer{added[1]}, string([]byte{pexEncryption})},
+		{"dropped", false, []peers.Peer{dropped[1]}, ""},
+		{"dropped6", true, []peers.Peer{dropped[0]}, ""},
+	}
+	for _, test := range tests {
+		compact, _ := dict[test.key].(string)
+		unmarshal := peers.Unmarshal
+		if test.ipv6 {
+			unmarshal = peers.Unmarshal6
+		}
+		got, err := unmarshal([]byte(compact))
+		if err != nil {
+			t.Errorf("%s: %v", test.key, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s holds %v, want %v", test.key, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != test.want[i].String() {
+				t.Errorf("%s holds %v, want %v", test.key, got, test.want)
+				break
+			}
+		}
+		if test.flags != "" {
+			if f, _ := dict[test.key+".f"].(string); f != test.flags {
+				t.Errorf("%s.f is %x, want %x", test.key, f, test.flags)
+			}
+		}
+	}
+}
+
+func TestHandlePEX(t *testing.T) {
+	// The added peers accept the TCP connection but never answer the handshake, so they stay in dialing
+	var added []peers.Peer
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Skipf("Cannot listen: %v", err)
+		}
+		defer l.Close()
+		addr := l.Addr().(*net.TCPAddr)
+		added = append(added, peers.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+	dropped := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	// The client's info hash is the zero hash, which the manager is registered under
+	m := NewConnManager([20]byte{'m'}, [20]byte{}, 4, false)
+	defer m.Close()
+	c := &client.Client{Conn: discardConn{}, Peer: peers.Peer{IP: net.IPv4(10, 0, 0, 9), Port: 6881}}
+	dialing := func(p peers.Peer) bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.dialing[p.String()]
+	}
+
+	payload, err := encodePEX(added[:2], []peers.Peer{dropped}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handlePEX(c, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range added[:2] {
+		if !dialing(p) {
+			t.Errorf("Added peer %s is not dialed", p)
+		}
+	}
+	if dialing(dropped) {
+		t.Errorf("Dropped peer %s is dialed", dropped)
+	}
+
+	// A second message within a minute is ignored
+	payload, err = encodePEX(added[2:], nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handlePEX(c, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialing(added[2]) {
+		t.Errorf("Peer %s from a message sent too soon is dialed", added[2])
+	}
+}
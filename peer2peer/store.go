@@ -0,0 +1,102 @@
+// Description: pieceStore holds the pieces downloaded so far, so peers can be served while we download.
+package peer2peer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"bit-torrent/bitfield"
+	"bit-torrent/client"
+	"bit-torrent/message"
+)
+
+// pieceStore holds the data of a download and which of its pieces are verified
+type pieceStore struct {
+	t        *Torrent
+	mu       sync.RWMutex
+	buf      []byte
+	verified bitfield.Bitfield
+}
+
+// newPieceStore creates an empty store for the torrent
+func newPieceStore(t *Torrent) *pieceStore {
+	return &pieceStore{
+		t:        t,
+		buf:      make([]byte, t.Length),
+		verified: bitfield.New(t.NumPieces()),
+	}
+}
+
+// put stores a verified piece
+func (s *pieceStore) put(index int, data []byte) {
+	begin, end := s.t.calculateBoundsForPiece(index)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.buf[begin:end], data)
+	s.verified.SetPiece(index)
+}
+
+// read returns a block of a verified piece
+// It returns the data and an error if the piece is not verified or the block lies outside it.
+func (s *pieceStore) read(index, begin, length int) ([]byte, error) {
+	if index < 0 || index >= s.t.NumPieces() {
+		return nil, fmt.Errorf("Invalid piece index %d", index)
+	}
+	if begin < 0 || length <= 0 || length > MaxBlockSize || begin+length > s.t.PieceSize(index) {
+		return nil, fmt.Errorf("Invalid block offset %d or length %d", begin, length)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.verified.HasPiece(index) {
+		return nil, fmt.Errorf("Piece %d is not downloaded yet", index)
+	}
+	pieceBegin, _ := s.t.calculateBoundsForPiece(index)
+	data := make([]byte, length)
+	copy(data, s.buf[pieceBegin+begin:])
+	return data, nil
+}
+
+// ReadAt reads the data of verified pieces, for hashes below the piece layer of v2 torrents
+// It returns an error if a piece p overlaps is not verified yet.
+func (s *pieceStore) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for index := int(off / int64(s.t.PieceLength)); int64(index)*int64(s.t.PieceLength) < off+int64(len(p)); index++ {
+		if !s.verified.HasPiece(index) {
+			return 0, fmt.Errorf("Piece %d is not downloaded yet", index)
+		}
+	}
+	return copy(p, s.buf[off:]), nil
+}
+
+// serveRequest answers a Request message of a peer with the block, if we have verified its piece and the choker
+// unchokes the peer
+// Requests we cannot serve are rejected for peers with the Fast Extension and dropped for the others.
+// It returns an error if the connection failed.
+func (s *pieceStore) serveRequest(c *client.Client, msg *message.Message, choker *Choker) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	data, err := s.read(index, begin, length)
+	if err == nil && choker != nil && choker.IsChoked(c) {
+		err = fmt.Errorf("Peer is choked")
+	}
+	if err != nil {
+		log.Printf("Not serving request of %s: %v\n", c.Peer, err)
+		if c.SupportsFast() {
+			return c.SendReject(index, begin, length)
+		}
+		return nil
+	}
+	err = c.SendPiece(index, begin, data)
+	if err == nil && choker != nil {
+		choker.Uploaded(c, len(data))
+	}
+	return err
+}
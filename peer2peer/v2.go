@@ -0,0 +1,258 @@
+// Description: Merkle verification and hash requests of v2 torrents (BEP 52).
+// The pieces of a v2-only torrent are verified against the piece layers of its files. A piece that fails is not
+// thrown away: the peer is asked for the hashes of its 16 KiB blocks and only the blocks that do not match are
+// downloaded again. Peers are sent hashes of our files' merkle trees when they ask for them.
+package peer2peer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"time"
+
+	"bit-torrent/client"
+	"bit-torrent/merkle"
+	"bit-torrent/message"
+)
+
+// MaxHashes is the largest number of base layer hashes we send for a hash request
+const MaxHashes = 512
+
+// FileV2 is a file of a v2 or hybrid torrent
+type FileV2 struct {
+	Offset     int64 // where the file starts in the data of the torrent, at a piece boundary
+	Length     int64
+	PiecesRoot [32]byte
+	PieceLayer [][32]byte // nil for a file of at most one piece
+}
+
+// pieceV2 is what a piece of a v2-only torrent is verified against
+type pieceV2 struct {
+	file  *FileV2
+	piece int      // the index of the piece within the file
+	root  [32]byte // the piece's node of the piece layer, or the pieces root of a file of at most one piece
+	width int      // the number of leaves below root
+}
+
+// NumPieces returns the number of pieces of the torrent
+// The pieces of a v2-only torrent, which has no SHA-1 piece hashes, follow from its length.
+func (t *Torrent) NumPieces() int {
+	if t.PieceHashes != nil || t.PieceLength == 0 {
+		return len(t.PieceHashes)
+	}
+	return (t.Length + t.PieceLength - 1) / t.PieceLength
+}
+
+// pieceV2 returns what a piece of a v2-only torrent is verified against, or nil for torrents with SHA-1 piece hashes
+func (t *Torrent) pieceV2(index int) *pieceV2 {
+	if t.PieceHashes != nil {
+		return nil
+	}
+	pieceLength := int64(t.PieceLength)
+	begin := int64(index) * pieceLength
+	for i := range t.FilesV2 {
+		f := &t.FilesV2[i]
+		if begin < f.Offset || begin >= f.Offset+f.Length {
+			continue
+		}
+		p := &pieceV2{file: f, piece: int((begin - f.Offset) / pieceLength)}
+		if f.Length > pieceLength {
+			p.width = t.PieceLength / merkle.BlockSize
+			if p.piece < len(f.PieceLayer) {
+				p.root = f.PieceLayer[p.piece]
+			}
+		} else {
+			p.width = merkle.NextPowerOfTwo(int((f.Length + merkle.BlockSize - 1) / merkle.BlockSize))
+			p.root = f.PiecesRoot
+		}
+		return p
+	}
+	return nil
+}
+
+// repairPiece asks the peer for the leaf hashes of a v2 piece that failed verification, checks them against the
+// piece's root and downloads again only the blocks that do not match their hash
+// It returns an error if the hashes could not be had or the blocks could not be downloaded.
+func repairPiece(c *client.Client, pw *pieceWork, buf []byte, store *pieceStore, choker *Choker) error {
+	v := pw.v2
+	if v == nil || v.width < 2 {
+		return fmt.Errorf("Piece %d has no block hashes to repair it with", pw.index)
+	}
+	req := message.HashRequest{
+		PiecesRoot:  v.file.PiecesRoot,
+		Index:       v.piece * v.width,
+		Length:      v.width,
+		ProofLayers: bits.TrailingZeros(uint(v.width)),
+	}
+	err := c.SendHashRequest(req)
+	if err != nil {
+		return err
+	}
+
+	state := pieceProgress{index: pw.index, client: c, store: store, choker: choker, hashRequest: &req}
+	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.Conn.SetDeadline(time.Time{})
+	for state.hashes == nil && !state.hashRejected {
+		err := state.readMessage()
+		if err != nil {
+			return err
+		}
+	}
+	if state.hashRejected {
+		return fmt.Errorf("Peer %s rejected the hash request for piece %d", c.Peer, pw.index)
+	}
+	leaves := state.hashes
+	if len(leaves) < v.width || merkle.RootFrom(leaves[:v.width], 0, v.width) != v.root {
+		return fmt.Errorf("Peer %s sent wrong hashes for piece %d", c.Peer, pw.index)
+	}
+
+	// Keep the blocks that match their leaf hash
+	state.buf = buf
+	state.downloaded = len(buf)
+	state.requested = len(buf)
+	for i, leaf := range merkle.HashBlocks(buf) {
+		if leaf == leaves[i] {
+			continue
+		}
+		begin := i * merkle.BlockSize
+		length := merkle.BlockSize
+		if begin+length > len(buf) {
+			length = len(buf) - begin
+		}
+		state.rejected = append(state.rejected, block{begin, length})
+		state.downloaded -= length
+	}
+	log.Printf("Downloading %d bad blocks of piece #%d again\n", len(state.rejected), pw.index)
+	return state.download(pw)
+}
+
+// ServeHashRequest answers a Hash Request message of a peer with hashes of the merkle tree of one of our files,
+// or rejects it. Hashes below the piece layer are computed from data, which may be nil to serve only the layers above.
+// It returns an error if the connection failed.
+func (t *Torrent) ServeHashRequest(c *client.Client, msg *message.Message, data io.ReaderAt) error {
+	req, err := message.ParseHashRequest(msg)
+	if err != nil {
+		return err
+	}
+	hashes, err := t.Hashes(req, data)
+	if err != nil {
+		log.Printf("Not serving hash request of %s: %v\n", c.Peer, err)
+		return c.SendHashReject(req)
+	}
+	return c.SendHashes(req, hashes)
+}
+
+// Hashes returns the hashes of a hash request: the requested base layer hashes of a file's merkle tree followed by
+// the uncle hashes that prove them up to ProofLayers layers above the base layer, stopping below the root
+// It returns an error if the file is not ours, the request is invalid or the hashes need data we cannot read.
+func (t *Torrent) Hashes(req message.HashRequest, data io.ReaderAt) ([][32]byte, error) {
+	var f *FileV2
+	for i := range t.FilesV2 {
+		if t.FilesV2[i].Length > 0 && t.FilesV2[i].PiecesRoot == req.PiecesRoot {
+			f = &t.FilesV2[i]
+			break
+		}
+	}
+	if f == nil {
+		return nil, fmt.Errorf("Unknown pieces root %x", req.PiecesRoot)
+	}
+	tree := newFileTree(t, f, data)
+	if req.Length <= 0 || req.Length > MaxHashes || req.Length&(req.Length-1) != 0 || req.Index%req.Length != 0 ||
+		req.BaseLayer < 0 || req.BaseLayer > tree.height || req.ProofLayers < 0 ||
+		req.Index+req.Length > tree.width>>uint(req.BaseLayer) {
+		return nil, fmt.Errorf("Invalid hash request for %d hashes at %d of layer %d", req.Length, req.Index, req.BaseLayer)
+	}
+
+	hashes := make([][32]byte, 0, req.Length)
+	for i := req.Index; i < req.Index+req.Length; i++ {
+		h, err := tree.node(req.BaseLayer, i)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	level := req.BaseLayer + bits.TrailingZeros(uint(req.Length))
+	pos := req.Index / req.Length
+	for n := merkle.UncleCount(req.Length, req.ProofLayers); n > 0 && level < tree.height; n-- {
+		h, err := tree.node(level, pos^1)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+		pos /= 2
+		level++
+	}
+	return hashes, nil
+}
+
+// fileTree computes the nodes of the merkle tree of a file for a hash request
+// The layers from the piece layer up come from the piece layer; lower nodes are hashed from the data of their piece.
+type fileTree struct {
+	t      *Torrent
+	f      *FileV2
+	data   io.ReaderAt
+	width  int // the number of leaves, a power of two
+	height int // the level of the root
+	span   int // the number of leaves below a node of the piece layer, or width for a file of at most one piece
+	upper  [][][32]byte
+	pieces map[int][][][32]byte // the layers of the pieces hashed so far
+}
+
+// newFileTree creates the tree of a file of the torrent
+func newFileTree(t *Torrent, f *FileV2, data io.ReaderAt) *fileTree {
+	numBlocks := int((f.Length + merkle.BlockSize - 1) / merkle.BlockSize)
+	width := merkle.NextPowerOfTwo(numBlocks)
+	tree := &fileTree{
+		t:      t,
+		f:      f,
+		data:   data,
+		width:  width,
+		height: bits.TrailingZeros(uint(width)),
+		span:   t.PieceLength / merkle.BlockSize,
+		pieces: make(map[int][][][32]byte),
+	}
+	if width <= tree.span {
+		tree.span = width
+	} else if f.PieceLayer != nil {
+		tree.upper = merkle.Layers(f.PieceLayer, bits.TrailingZeros(uint(tree.span)), width/tree.span)
+	}
+	return tree
+}
+
+// node returns the i-th node of a layer of the tree
+// It returns an error if the node needs data we cannot read.
+func (tree *fileTree) node(level, i int) ([32]byte, error) {
+	spanLevel := bits.TrailingZeros(uint(tree.span))
+	if level >= spanLevel && tree.width > tree.span {
+		if tree.upper == nil {
+			return [32]byte{}, fmt.Errorf("No piece layer for %x", tree.f.PiecesRoot)
+		}
+		return tree.upper[level-spanLevel][i], nil
+	}
+
+	piece := (i << uint(level)) / tree.span
+	pieceLength := int64(tree.t.PieceLength)
+	if int64(piece)*pieceLength >= tree.f.Length {
+		return merkle.ZeroHash(level), nil // padding beyond the end of the file
+	}
+	layers, ok := tree.pieces[piece]
+	if !ok {
+		if tree.data == nil {
+			return [32]byte{}, fmt.Errorf("Hashes below the piece layer are not available")
+		}
+		begin := int64(piece) * pieceLength
+		length := tree.f.Length - begin
+		if length > pieceLength {
+			length = pieceLength
+		}
+		buf := make([]byte, length)
+		_, err := tree.data.ReadAt(buf, tree.f.Offset+begin)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		layers = merkle.Layers(merkle.HashBlocks(buf), 0, tree.span)
+		tree.pieces[piece] = layers
+	}
+	return layers[level][i-piece*(tree.span>>uint(level))], nil
+}
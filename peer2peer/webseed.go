@@ -0,0 +1,147 @@
+// Description: Web seeds and HTTP seeds as a source of pieces in the download.
+// A web seed has every piece, so its workers take any piece off the work queue, read it over HTTP and verify it like
+// a piece from a peer. Requests to one host are limited, and a seed that fails is left alone for a while.
+package peer2peer
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// MaxWebSeedConns is the largest number of requests we have open to one web seed host at a time
+const MaxWebSeedConns = 2
+
+// MaxWebSeedFailures is the number of failures in a row after which we stop using a web seed
+const MaxWebSeedFailures = 8
+
+// WebSeedRetry is how long we wait before using a web seed again after its first failure; the wait doubles with
+// every failure in a row, up to MaxWebSeedRetry
+var WebSeedRetry = 5 * time.Second
+
+// MaxWebSeedRetry is the longest wait before using a failed web seed again
+var MaxWebSeedRetry = 5 * time.Minute
+
+// WebSeed is a source of the torrent's data over HTTP, such as a web seed (BEP 19) or an HTTP seed (BEP 17)
+// A read may fail with an error that has a RetryAfter() time.Duration method when the server asked us to wait.
+type WebSeed interface {
+	io.ReaderAt
+	Host() string // the host requests go to, whose connections are limited to MaxWebSeedConns
+	String() string
+}
+
+var (
+	hostSlotsMu sync.Mutex
+	hostSlots   = make(map[string]chan struct{})
+)
+
+// hostSlot returns the semaphore that limits the requests to a host
+func hostSlot(host string) chan struct{} {
+	hostSlotsMu.Lock()
+	defer hostSlotsMu.Unlock()
+	slot, ok := hostSlots[host]
+	if !ok {
+		slot = make(chan struct{}, MaxWebSeedConns)
+		hostSlots[host] = slot
+	}
+	return slot
+}
+
+// webSeedState is the back-off of a web seed, shared by its workers
+type webSeedState struct {
+	seed WebSeed
+
+	mu       sync.Mutex
+	failures int       // failures in a row
+	retryAt  time.Time // when the seed may be used again
+}
+
+// wait sleeps until the seed may be used again
+// It returns false once the seed failed too often to be used at all.
+func (s *webSeedState) wait() bool {
+	s.mu.Lock()
+	failures := s.failures
+	delay := time.Until(s.retryAt)
+	s.mu.Unlock()
+	if failures >= MaxWebSeedFailures {
+		return false
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return true
+}
+
+// busyError is an error of a server that is busy and told us when to come back
+type busyError interface {
+	RetryAfter() time.Duration
+}
+
+// fail records a failed request and backs off
+// A busy server is left alone for as long as it asked, which does not count as a failure.
+func (s *webSeedState) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if busy, ok := err.(busyError); ok {
+		s.retryAt = time.Now().Add(busy.RetryAfter())
+		log.Printf("%v\n", err)
+		return
+	}
+	s.failures++
+	delay := WebSeedRetry << uint(s.failures-1)
+	if delay > MaxWebSeedRetry || delay <= 0 {
+		delay = MaxWebSeedRetry
+	}
+	s.retryAt = time.Now().Add(delay)
+	if s.failures > MaxWebSeedFailures {
+		return // another worker gave up already
+	}
+	if s.failures == MaxWebSeedFailures {
+		log.Printf("Giving up web seed %s: %v\n", s.seed, err)
+		return
+	}
+	log.Printf("Web seed %s failed, retrying in %v: %v\n", s.seed, delay, err)
+}
+
+// succeed records a successful request
+func (s *webSeedState) succeed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = 0
+}
+
+// startWebSeedWorkers starts the workers that download pieces from a web seed, one per connection we allow its host
+func (t *Torrent) startWebSeedWorkers(seed WebSeed, workQueue chan *pieceWork, results chan *pieceResult) {
+	state := &webSeedState{seed: seed}
+	for i := 0; i < MaxWebSeedConns; i++ {
+		go t.startWebSeedWorker(state, workQueue, results)
+	}
+}
+
+// startWebSeedWorker downloads pieces from a web seed and puts them on the results queue until the work queue is
+// closed or the seed failed too often
+func (t *Torrent) startWebSeedWorker(state *webSeedState, workQueue chan *pieceWork, results chan *pieceResult) {
+	slot := hostSlot(state.seed.Host())
+	for state.wait() {
+		pw, ok := <-workQueue
+		if !ok {
+			return
+		}
+
+		buf := make([]byte, pw.length)
+		slot <- struct{}{}
+		_, err := state.seed.ReadAt(buf, int64(pw.index)*int64(t.PieceLength))
+		<-slot
+		if err == nil {
+			err = checkIntegrity(pw, buf)
+		}
+		if err != nil {
+			workQueue <- pw // Put piece back on the queue
+			state.fail(err)
+			continue
+		}
+		state.succeed()
+		results <- &pieceResult{pw.index, buf}
+	}
+}
@@ -0,0 +1,145 @@
+package peer2peer
+
+import (
+	"crypto/sha1"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSeed is a web seed that fails its first failures reads and then serves data
+type fakeSeed struct {
+	host     string
+	data     []byte
+	failures int // reads that fail, or -1 for all of them
+
+	mu    sync.Mutex
+	reads []time.Time
+}
+
+func (s *fakeSeed) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads = append(s.reads, time.Now())
+	if s.failures < 0 || len(s.reads) <= s.failures {
+		return 0, errors.New("Connection refused")
+	}
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *fakeSeed) Host() string   { return s.host }
+func (s *fakeSeed) String() string { return "http://" + s.host + "/" }
+
+func (s *fakeSeed) readTimes() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.reads...)
+}
+
+// setWebSeedRetry shortens the back-off for a test
+// It returns a function that restores it.
+func setWebSeedRetry(retry, max time.Duration) func() {
+	oldRetry, oldMax := WebSeedRetry, MaxWebSeedRetry
+	WebSeedRetry, MaxWebSeedRetry = retry, max
+	return func() {
+		WebSeedRetry, MaxWebSeedRetry = oldRetry, oldMax
+	}
+}
+
+// singlePieceTorrent returns a torrent of one piece holding data, with its work queue
+func singlePieceTorrent(data []byte) (*Torrent, chan *pieceWork) {
+	t := &Torrent{
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+		PieceLength: len(data),
+		Length:      len(data),
+	}
+	workQueue := make(chan *pieceWork, 1)
+	workQueue <- t.newPieceWork(0)
+	return t, workQueue
+}
+
+func TestWebSeedBackOff(t *testing.T) {
+	defer setWebSeedRetry(20*time.Millisecond, time.Second)()
+
+	data := []byte("the data of the only piece")
+	seed := &fakeSeed{host: "backoff.example", data: data, failures: 3}
+	tor, workQueue := singlePieceTorrent(data)
+	results := make(chan *pieceResult)
+	go tor.startWebSeedWorker(&webSeedState{seed: seed}, workQueue, results)
+
+	select {
+	case res := <-results:
+		if res.index != 0 || string(res.buf) != string(data) {
+			t.Errorf("Got piece %d %q, want piece 0 %q", res.index, res.buf, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The piece was not downloaded")
+	}
+	close(workQueue)
+
+	// The waits after the three failures double: 20, 40 and 80 ms
+	reads := seed.readTimes()
+	if len(reads) != 4 {
+		t.Fatalf("Read %d times, want 4", len(reads))
+	}
+	for i := 1; i < len(reads); i++ {
+		want := WebSeedRetry << uint(i-1)
+		if gap := reads[i].Sub(reads[i-1]); gap < want {
+			t.Errorf("Read %d came %v after the previous one, want at least %v", i, gap, want)
+		}
+	}
+}
+
+func TestWebSeedGivesUp(t *testing.T) {
+	defer setWebSeedRetry(time.Millisecond, 4*time.Millisecond)()
+
+	data := []byte("never served")
+	seed := &fakeSeed{host: "giveup.example", data: data, failures: -1}
+	tor, workQueue := singlePieceTorrent(data)
+	results := make(chan *pieceResult)
+	state := &webSeedState{seed: seed}
+	done := make(chan struct{})
+	go func() {
+		tor.startWebSeedWorker(state, workQueue, results)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-results:
+		t.Fatal("A failing seed delivered a piece")
+	case <-time.After(5 * time.Second):
+		t.Fatal("The worker did not give up on the seed")
+	}
+	if n := len(seed.readTimes()); n != MaxWebSeedFailures {
+		t.Errorf("Read %d times, want %d", n, MaxWebSeedFailures)
+	}
+	// The piece is left for the other sources
+	if len(workQueue) != 1 {
+		t.Errorf("%d pieces are queued, want 1", len(workQueue))
+	}
+}
+
+// busySeedError is the error of a seed that asked us to come back later
+type busySeedError struct{}
+
+func (busySeedError) Error() string             { return "Busy" }
+func (busySeedError) RetryAfter() time.Duration { return 10 * time.Millisecond }
+
+func TestWebSeedBusyIsNoFailure(t *testing.T) {
+	state := &webSeedState{seed: &fakeSeed{host: "busy.example"}}
+	for i := 0; i < MaxWebSeedFailures+1; i++ {
+		state.fail(busySeedError{})
+	}
+	if state.failures != 0 {
+		t.Errorf("Busy answers counted as %d failures", state.failures)
+	}
+	start := time.Now()
+	if !state.wait() {
+		t.Fatal("Gave up on a busy seed")
+	}
+	if waited := time.Since(start); waited < 5*time.Millisecond {
+		t.Errorf("Waited %v, want about the 10ms the seed asked for", waited)
+	}
+}
@@ -9,6 +9,12 @@ import (
 	"strconv"
 )
 
+// peerSize is the length of a compact IPv4 peer: 4 for IP, 2 for port
+const peerSize = 6
+
+// peer6Size is the length of a compact IPv6 peer (BEP 7): 16 for IP, 2 for port
+const peer6Size = 18
+
 type Peer struct {
 	IP   net.IP
 	Port uint16
@@ -16,21 +22,68 @@ type Peer struct {
 
 // Unmarshal takes a byte slice and returns a slice of Peer structs and an error if one occurred.
 func Unmarshal(peersBin []byte) ([]Peer, error) {
-	const peerSize = 6 // 4 for IP, 2 for port
-	numPeers := len(peersBin) / peerSize
-	if len(peersBin)%peerSize != 0 {
+	return unmarshal(peersBin, net.IPv4len)
+}
+
+// Unmarshal6 takes a byte slice of compact IPv6 peers and returns a slice of Peer structs and an error if one occurred.
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	return unmarshal(peersBin, net.IPv6len)
+}
+
+// unmarshal parses compact peers whose IP addresses are ipLen bytes long
+func unmarshal(peersBin []byte, ipLen int) ([]Peer, error) {
+	size := ipLen + 2
+	numPeers := len(peersBin) / size
+	if len(peersBin)%size != 0 {
 		err := fmt.Errorf("Received malformed peers")
 		return nil, err
 	}
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
-		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+4 : offset+6]))
+		offset := i * size
+		peers[i].IP = net.IP(append([]byte(nil), peersBin[offset:offset+ipLen]...))
+		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+ipLen : offset+size]))
 	}
 	return peers, nil
 }
 
+// Marshal encodes the IPv4 peers in compact form, skipping IPv6 peers.
+func Marshal(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*peerSize)
+	for _, p := range peers {
+		if ip := p.IP.To4(); ip != nil {
+			buf = append(buf, ip...)
+			buf = append(buf, byte(p.Port>>8), byte(p.Port))
+		}
+	}
+	return buf
+}
+
+// Marshal6 encodes the IPv6 peers in compact form, skipping IPv4 peers.
+func Marshal6(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*peer6Size)
+	for _, p := range peers {
+		if p.IsIPv6() {
+			buf = append(buf, p.IP.To16()...)
+			buf = append(buf, byte(p.Port>>8), byte(p.Port))
+		}
+	}
+	return buf
+}
+
+// IsIPv6 reports whether the peer has an IPv6 address (IPv4-mapped addresses count as IPv4)
+func (p Peer) IsIPv6() bool {
+	return p.IP.To4() == nil && p.IP.To16() != nil
+}
+
+// Network returns the network name to dial the peer on: "tcp4" or "tcp6"
+func (p Peer) Network() string {
+	if p.IsIPv6() {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
 // stringer for Peer struct
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
@@ -0,0 +1,65 @@
+// Description: HTTP CONNECT proxy dialer.
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPConnect tunnels connections through an HTTP proxy with the CONNECT method
+type HTTPConnect struct {
+	Addr     string // host:port of the proxy
+	Username string // optional, sent with basic authentication
+	Password string
+}
+
+// bufferedConn is a connection whose first bytes were already read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffer first and then from the connection
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// DialTimeout asks the proxy to open a tunnel to address
+// It returns the tunnelled connection and an error if one occurred.
+func (p *HTTPConnect) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialProxy(p.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if p.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	_, err = conn.Write([]byte(req))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s refused CONNECT to %s: %s", p.Addr, address, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{}) // Disable the deadline
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
@@ -0,0 +1,58 @@
+// Description: Dialers that tunnel TCP connections through HTTP CONNECT and SOCKS5 proxies.
+// Package proxy is used for tracker announces and, optionally, peer connections.
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Dialer opens connections to an address, possibly through a proxy
+type Dialer interface {
+	// DialTimeout connects to address on the named network ("tcp", "tcp4" or "tcp6").
+	// The timeout covers both reaching the proxy and the proxy handshake.
+	DialTimeout(network, address string, timeout time.Duration) (net.Conn, error)
+}
+
+// FromURL creates a dialer for a proxy URL of the form
+// http://[user:password@]host:port or socks5://[user:password@]host:port
+// It returns the dialer and an error if the URL is invalid.
+func FromURL(raw string) (Dialer, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Proxy URL %q has no host", raw)
+	}
+
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "http":
+		return &HTTPConnect{Addr: u.Host, Username: username, Password: password}, nil
+	case "socks5", "socks5h":
+		return &SOCKS5{Addr: u.Host, Username: username, Password: password}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// dialProxy connects to the proxy server and sets a deadline for the proxy handshake
+// It returns the connection and an error if one occurred.
+func dialProxy(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	return conn, nil
+}
@@ -0,0 +1,165 @@
+// Description: SOCKS5 proxy dialer (RFC 1928) with username/password authentication (RFC 1929).
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants
+const (
+	socksVersion        = 5
+	socksAuthNone       = 0
+	socksAuthPassword   = 2
+	socksCmdConnect     = 1
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+	socksPasswordVer    = 1
+	socksReplySucceeded = 0
+)
+
+// SOCKS5 tunnels connections through a SOCKS5 proxy
+type SOCKS5 struct {
+	Addr     string // host:port of the proxy
+	Username string // optional, enables username/password authentication
+	Password string
+}
+
+// DialTimeout asks the proxy to connect to address
+// Host names are resolved by the proxy.
+// It returns the tunnelled connection and an error if one occurred.
+func (p *SOCKS5) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port in %s", address)
+	}
+
+	conn, err := dialProxy(p.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = p.handshake(conn, host, uint16(port))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{}) // Disable the deadline
+	return conn, nil
+}
+
+// handshake negotiates authentication and sends the CONNECT command
+// It returns an error if the proxy refuses.
+func (p *SOCKS5) handshake(conn net.Conn, host string, port uint16) error {
+	methods := []byte{socksAuthNone}
+	if p.Username != "" {
+		methods = []byte{socksAuthPassword}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	_, err := conn.Write(greeting)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return fmt.Errorf("Proxy %s is not a SOCKS5 proxy", p.Addr)
+	}
+	switch buf[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		err = p.authenticate(conn)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Proxy %s accepts none of our authentication methods", p.Addr)
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("Host name too long: %s", host)
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	// Reply: version, status, reserved, address type, bound address, bound port
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[1] != socksReplySucceeded {
+		return fmt.Errorf("Proxy %s could not connect to %s (reply %d)", p.Addr, host, header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case socksAddrIPv4:
+		addrLen = net.IPv4len
+	case socksAddrIPv6:
+		addrLen = net.IPv6len
+	case socksAddrDomain:
+		lenBuf := make([]byte, 1)
+		_, err = io.ReadFull(conn, lenBuf)
+		if err != nil {
+			return err
+		}
+		addrLen = int(lenBuf[0])
+	default:
+		return fmt.Errorf("Proxy %s sent unknown address type %d", p.Addr, header[3])
+	}
+	// The bound address and port are of no use to us, but must be consumed
+	bound := make([]byte, addrLen+2)
+	_, err = io.ReadFull(conn, bound)
+	return err
+}
+
+// authenticate performs username/password authentication
+// It returns an error if the proxy rejects the credentials.
+func (p *SOCKS5) authenticate(conn net.Conn) error {
+	if len(p.Username) > 255 || len(p.Password) > 255 {
+		return fmt.Errorf("Proxy credentials too long")
+	}
+	req := []byte{socksPasswordVer, byte(len(p.Username))}
+	req = append(req, p.Username...)
+	req = append(req, byte(len(p.Password)))
+	req = append(req, p.Password...)
+	_, err := conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return fmt.Errorf("Proxy %s rejected our credentials", p.Addr)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Description: The scrape command prints swarm statistics for torrents without joining the swarm.
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"bit-torrent/torrent"
+)
+
+// runScrape scrapes the trackers of the given .torrent files and prints the results
+// Torrents that share a tracker are scraped with a single request.
+func runScrape(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: go run . scrape <path to .torrent file>...")
+		return
+	}
+
+	// Group the torrents by tracker so each tracker is asked only once
+	var announces []string
+	byAnnounce := make(map[string][]torrent.TorrentFile)
+	for _, path := range args {
+		tf, err := torrent.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := byAnnounce[tf.Announce]; !ok {
+			announces = append(announces, tf.Announce)
+		}
+		byAnnounce[tf.Announce] = append(byAnnounce[tf.Announce], tf)
+	}
+
+	for _, announce := range announces {
+		tfs := byAnnounce[announce]
+		hashes := make([][20]byte, len(tfs))
+		for i, tf := range tfs {
+			hashes[i] = tf.InfoHash
+		}
+		results, err := torrent.Scrape(announce, hashes)
+		if err != nil {
+			log.Printf("Could not scrape %s: %v\n", announce, err)
+			continue
+		}
+		for i, res := range results {
+			fmt.Printf("%s (%x)\n", tfs[i].Name, res.InfoHash)
+			fmt.Printf("  seeders: %d, leechers: %d, completed: %d\n",
+				res.Complete, res.Incomplete, res.Downloaded)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Description: The seed command shares data we already have, without downloading it first.
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"bit-torrent/seeder"
+	"bit-torrent/storage"
+	"bit-torrent/torrent"
+)
+
+// runSeed seeds the data at dataPath, a file or the directory of a multi-file torrent, for the torrent at torrentPath
+// The data is verified against the piece hashes first; we then announce as a seeder, connect to the peers we
+// are told about and accept the peers that connect to us until the user presses enter or a seeding limit is reached.
+func runSeed(torrentPath, dataPath string) {
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := storage.Open(dataPath, tf.StorageFiles())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer data.Close()
+
+	fmt.Println("Verifying data...")
+	have, err := tf.Verify(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	numPieces := tf.NumPieces()
+	missing := 0
+	for i := 0; i < numPieces; i++ {
+		if !have.HasPiece(i) {
+			missing++
+		}
+	}
+	if missing > 0 {
+		log.Fatalf("%d of %d pieces of %s do not match the torrent\n", missing, numPieces, dataPath)
+	}
+
+	tor, err := tf.GetSeedTorrent()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Peers we connect to are told we have every piece, or none when super-seeding
+	tor.Conns.SetSuperSeeding(seeder.SuperSeed)
+	for i := 0; i < numPieces; i++ {
+		tor.Conns.SetPiece(i)
+	}
+
+	fmt.Println("Connecting to peers...")
+	keepAliveChan := make(chan bool)
+	clients, err := torrent.ConnectToPeers(tor, keepAliveChan)
+	if err != nil {
+		log.Printf("%v, waiting for peers to connect to us\n", err)
+	}
+	go keepAlive(tor, keepAliveChan)
+
+	startHTTPSeed(tor, data)
+	stop := make(chan struct{})
+	go waitForEnter(stop)
+	fmt.Println("Seeding. Press enter to exit")
+	uploaded := seeder.SeedFile(clients, tor, data, stop)
+	stopTorrent(tf, tor, uploaded, 0)
+	fmt.Println("Exiting...")
+}
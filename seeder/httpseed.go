@@ -0,0 +1,118 @@
+// Description: An HTTP handler that serves the pieces of a torrent to HTTP seeding clients (BEP 17).
+package seeder
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bit-torrent/peer2peer"
+)
+
+// MaxHTTPSeedRequests is the largest number of HTTP seed requests served at a time; more are told to come back later
+const MaxHTTPSeedRequests = 8
+
+// HTTPSeedRetry is the number of seconds a client is told to wait when we are busy
+const HTTPSeedRetry = 10
+
+// byteRange is an inclusive range of bytes within a piece
+type byteRange struct {
+	first int
+	last  int
+}
+
+// HTTPSeedHandler returns a handler that serves the pieces of the torrent from data
+// A request gives the info hash, a piece index and optionally ranges within the piece (ranges=0-16383,32768-49151);
+// the body of the answer is the requested bytes, or the whole piece.
+func HTTPSeedHandler(torrent peer2peer.Torrent, data io.ReaderAt) http.Handler {
+	slots := make(chan struct{}, MaxHTTPSeedRequests)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%d", HTTPSeedRetry)
+			return
+		}
+		serveHTTPSeed(w, r, torrent, data)
+	})
+}
+
+// serveHTTPSeed answers one HTTP seed request
+func serveHTTPSeed(w http.ResponseWriter, r *http.Request, torrent peer2peer.Torrent, data io.ReaderAt) {
+	query := r.URL.Query()
+	if query.Get("info_hash") != string(torrent.InfoHash[:]) {
+		http.Error(w, "Unknown info hash", http.StatusNotFound)
+		return
+	}
+	index, err := strconv.Atoi(query.Get("piece"))
+	if err != nil || index < 0 || index >= torrent.NumPieces() {
+		http.Error(w, "Invalid piece index", http.StatusBadRequest)
+		return
+	}
+	ranges, err := parseRanges(query.Get("ranges"), torrent.PieceSize(index))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The ranges are streamed from data one after the other; they do not overlap, so at most a piece is sent
+	total := 0
+	for _, br := range ranges {
+		total += br.last - br.first + 1
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(total))
+	pieceOffset := int64(index) * int64(torrent.PieceLength)
+	for _, br := range ranges {
+		_, err := io.Copy(w, io.NewSectionReader(data, pieceOffset+int64(br.first), int64(br.last-br.first+1)))
+		if err != nil {
+			log.Printf("Could not send piece %d to %s: %v\n", index, r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+// parseRanges parses the ranges parameter of a request for a piece of the given size
+// Without ranges the whole piece is requested. Ranges must lie within the piece and must not overlap,
+// so together they are never longer than the piece.
+// It returns the ranges and an error if they are malformed.
+func parseRanges(value string, pieceSize int) ([]byteRange, error) {
+	if value == "" {
+		return []byteRange{{0, pieceSize - 1}}, nil
+	}
+	var ranges []byteRange
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid range %q", part)
+		}
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid range %q", part)
+		}
+		last, err := strconv.Atoi(bounds[1])
+		if err != nil || first < 0 || last < first || last >= pieceSize {
+			return nil, fmt.Errorf("Invalid range %q", part)
+		}
+		ranges = append(ranges, byteRange{first, last})
+	}
+
+	// The bytes are sent in the order asked for, so the overlap check works on a sorted copy
+	sorted := append([]byteRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].first < sorted[j].first
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].first <= sorted[i-1].last {
+			return nil, fmt.Errorf("Overlapping ranges %d-%d and %d-%d",
+				sorted[i-1].first, sorted[i-1].last, sorted[i].first, sorted[i].last)
+		}
+	}
+	return ranges, nil
+}
@@ -0,0 +1,41 @@
+// Description: Seeding limits: when to stop seeding a torrent.
+package seeder
+
+import (
+	"fmt"
+	"time"
+
+	"bit-torrent/peer2peer"
+)
+
+// SeedRatio stops seeding once we uploaded this many times the size of the torrent, or never if 0
+var SeedRatio float64
+
+// SeedTime stops seeding after this long, or never if 0
+var SeedTime time.Duration
+
+// SeedIdle stops seeding once no peer has been interested in our pieces for this long, or never if 0
+var SeedIdle time.Duration
+
+// limitCheckInterval is how often the seeding limits are checked
+const limitCheckInterval = time.Second
+
+// limitReached checks the seeding limits of a torrent of the given length that we started seeding at started
+// It returns why seeding should stop, or an empty string if it should go on.
+func limitReached(choker *peer2peer.Choker, length int, started time.Time) string {
+	if SeedRatio > 0 && length > 0 {
+		ratio := float64(choker.TotalUploaded()) / float64(length)
+		if ratio >= SeedRatio {
+			return fmt.Sprintf("share ratio %.2f reached", ratio)
+		}
+	}
+	if SeedTime > 0 && time.Since(started) >= SeedTime {
+		return fmt.Sprintf("seeded for %s", SeedTime)
+	}
+	if SeedIdle > 0 {
+		if idle := choker.IdleFor(); idle >= SeedIdle {
+			return fmt.Sprintf("no interested peers for %s", idle.Round(time.Second))
+		}
+	}
+	return ""
+}
@@ -3,9 +3,10 @@ package seeder
 
 import (
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"sync"
+	"time"
 
 	"bit-torrent/bitfield"
 	"bit-torrent/client"
@@ -17,88 +18,203 @@ import (
 // It takes in the following parameters: torrent, index, begin, and length
 // it handles the following errors: Invalid piece index, Invalid block offset, and Invalid block length
 func handleRequestError(torrent peer2peer.Torrent, index, begin, length int) error {
-	numPieces := len(torrent.PieceHashes)
-	pieceLength := torrent.PieceLength
-	fileSize := torrent.Length
+	numPieces := torrent.NumPieces()
 
 	if index < 0 || index >= numPieces {
 		return fmt.Errorf("Invalid piece index %d", index)
 	}
 
-	// Check if this is the last piece
-	lastPiece := index == numPieces-1
-
-	// Calculate the length of this piece
-	var len int
-	if lastPiece {
-		len = int(pieceLength*numPieces - fileSize)
-	} else {
-		len = pieceLength
-	}
-	// Check if the requested block offset and length are valid
-	if begin < 0 || begin+length > len || length <= 0 {
+	// Calculate the length of this piece, which is shorter at the end of the data (and of a v2 file)
+	len := torrent.PieceSize(index)
+	// Check if the requested block offset and length are valid; blocks are at most 16 KiB, as we request them
+	if begin < 0 || begin+length > len || length <= 0 || length > peer2peer.MaxBlockSize {
 		return fmt.Errorf("Invalid block offset %d or length %d", begin, length)
 	}
 
 	return nil
 }
 
-// seedFile seeds the file to the clients that are connected to the seeder
+// seedFile seeds the data of the torrent, e.g. a file or a storage.Storage, to the clients that are connected to the seeder
+// Seeding stops when stop is closed, when a seeding limit (SeedRatio, SeedTime, SeedIdle) is reached, or when
+// every client is gone if the torrent has no ConnManager. The clients are closed, and so is the ConnManager.
+// It returns the number of bytes uploaded.
 func SeedFile(clients []*client.Client, torrent peer2peer.Torrent,
-	path string) {
+	file io.ReaderAt, stop <-chan struct{}) int64 {
 	fmt.Println("I have called I am the seeder")
-	// Open the file for reading
-	file, err := os.Open(path)
-	if err != nil {
-		log.Printf("Failed to open file: %v", err)
-		return
-	}
-	defer file.Close()
 
 	// Create a bitfield indicating that all pieces are available
-	numPieces := len(torrent.PieceHashes)
+	numPieces := torrent.NumPieces()
 	bitField := make(bitfield.Bitfield, (numPieces+7)/8)
 	for i := 0; i < numPieces; i++ {
 		bitField.SetPiece(i)
 	}
 
+	// Peers are choked until the choker gives them an upload slot; the choker of the download carries on,
+	// now ranking peers by how fast we upload to them
+	choker := torrent.Choker
+	if choker == nil {
+		choker = peer2peer.NewChoker(true)
+	}
+	choker.SetSeeding(true)
+	defer choker.Close()
+
+	// With super-seeding, pieces are revealed one at a time until the swarm has all of them
+	var super *superSeeder
+	if SuperSeed {
+		if torrent.Conns != nil {
+			torrent.Conns.SetSuperSeeding(true)
+		}
+		super = newSuperSeeder(numPieces, func() {
+			if torrent.Conns != nil {
+				torrent.Conns.SetSuperSeeding(false)
+			}
+		})
+	}
+
 	// Use a WaitGroup to wait for all clients to finish serving
+	// Once stopping is set, clients the ConnManager hands over late are closed instead, so wg.Add cannot race wg.Wait.
+	// A client may be handed over twice, by the caller and by the ConnManager; it is served once.
 	var wg sync.WaitGroup
-	wg.Add(len(clients))
-
-	// Serve each client
-	for _, c := range clients {
-		c.SendUnchoke()
+	var stoppingMu sync.Mutex
+	stopping := false
+	served := make(map[*client.Client]bool)
+	serve := func(c *client.Client) {
+		stoppingMu.Lock()
+		if stopping {
+			stoppingMu.Unlock()
+			c.Close()
+			return
+		}
+		if served[c] {
+			stoppingMu.Unlock()
+			return
+		}
+		served[c] = true
+		wg.Add(1)
+		stoppingMu.Unlock()
+		choker.Add(c)
+		choker.SetInterested(c, c.PeerInterested()) // the peer may have said so while we were downloading
 		c.SendNotInterested()
 
-		for i := 0; i < numPieces; i++ {
-			if bitField.HasPiece(i) {
-				c.SendHave(i)
+		// Peers connected through the ConnManager were sent our bitfield on connect and a Have for every piece
+		// since; others only learn about our pieces here
+		switch {
+		case super != nil && super.isActive():
+			super.add(c)
+		case torrent.Conns == nil:
+			for i := 0; i < numPieces; i++ {
+				if bitField.HasPiece(i) {
+					c.SendHave(i)
+				}
+			}
+		}
+		// Peers with the Fast Extension may request their allowed fast pieces even while choked
+		if c.SupportsFast() {
+			for _, index := range client.AllowedFastSet(c.Peer.IP, torrent.InfoHash, numPieces, client.AllowedFastCount) {
+				c.SendAllowedFast(index)
 			}
 		}
 
 		// Start a goroutine to serve the client
-		go serveClient(&wg, c, torrent, file)
+		go serveClient(&wg, c, choker, super, torrent, file)
+	}
+
+	// Peers that connect to us while seeding are served as well, until the torrent is closed. The handler is set
+	// before the ConnManager's clients are listed, so a peer that registers in between is served all the same.
+	finished := make(chan struct{})
+	if torrent.Conns != nil {
+		for i := 0; i < numPieces; i++ {
+			torrent.Conns.SetPiece(i)
+		}
+		torrent.Conns.SetHandler(serve)
+		clients = append(append([]*client.Client(nil), clients...), torrent.Conns.Clients()...)
+		finished = nil // seed until stopped
+	}
+
+	// Serve each client
+	for _, c := range clients {
+		serve(c)
+	}
+
+	if torrent.Conns == nil {
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+	}
+
+	started := time.Now()
+	ticker := time.NewTicker(limitCheckInterval)
+	defer ticker.Stop()
+	for stopped := false; !stopped; {
+		select {
+		case <-finished:
+			return choker.TotalUploaded()
+		case <-stop:
+			log.Println("Stopped seeding")
+			stopped = true
+		case <-ticker.C:
+			if reason := limitReached(choker, torrent.Length, started); reason != "" {
+				log.Printf("Stopped seeding: %s\n", reason)
+				stopped = true
+			}
+		}
 	}
 
-	// Wait for all clients to finish serving
+	// Close the connections and wait for the clients to finish
+	stoppingMu.Lock()
+	stopping = true
+	stoppingMu.Unlock()
+	if torrent.Conns != nil {
+		torrent.Conns.SetHandler(nil)
+		torrent.Conns.Close()
+		clients = torrent.Conns.Clients()
+	}
+	for _, c := range clients {
+		c.Close()
+	}
 	wg.Wait()
+	return choker.TotalUploaded()
 }
 
+// chokeGrace is how long after we choke a peer its requests are still expected, having been sent before our Choke arrived
+var chokeGrace = 5 * time.Second
+
+// MaxChokedRequests is the number of requests a peer may send while choked, after chokeGrace, before we disconnect it
+const MaxChokedRequests = 10
+
 // serveClient serves the client by sending it the requested blocks of data from the file reader and handling the client's messages.
-func serveClient(wg *sync.WaitGroup, c *client.Client, torrent peer2peer.Torrent, file *os.File) {
+// Requests wait in an upload queue, so the peer can cancel them, and are dropped when we choke the peer.
+// super is the super-seeder, or nil.
+func serveClient(wg *sync.WaitGroup, c *client.Client, choker *peer2peer.Choker, super *superSeeder, torrent peer2peer.Torrent, file io.ReaderAt) {
+	queue := newUploadQueue()
 	defer func() {
+		queue.close()
 		c.Conn.Close()
+		choker.Remove(c)
+		if super != nil {
+			super.remove(c)
+		}
+		if torrent.Conns != nil {
+			torrent.Conns.Remove(c)
+		}
 		wg.Done() // Signal that this client has finished serving
 	}()
 
+	allowedFast := make(map[int]bool)
+	if c.SupportsFast() {
+		for _, index := range client.AllowedFastSet(c.Peer.IP, torrent.InfoHash, torrent.NumPieces(), client.AllowedFastCount) {
+			allowedFast[index] = true
+		}
+	}
+	go upload(c, queue, choker, torrent, file, allowedFast)
+
+	chokedRequests := 0
 	for {
-		fmt.Println("Wait for  a message from the client")
 		// Wait for a message from the client
 		msg, err := c.Read()
 		if err != nil {
 			log.Printf("Error reading from client: %v", err)
-			//continue
 			return
 		}
 		if msg == nil {
@@ -107,6 +223,46 @@ func serveClient(wg *sync.WaitGroup, c *client.Client, torrent peer2peer.Torrent
 		}
 
 		switch msg.ID {
+		case message.MsgInterested:
+			choker.SetInterested(c, true)
+		case message.MsgNotInterested:
+			choker.SetInterested(c, false)
+		case message.MsgHave:
+			index, err := message.ParseHave(msg)
+			if err != nil {
+				log.Printf("Error parsing have message: %v", err)
+				continue
+			}
+			c.SetPiece(index)
+			if super != nil {
+				super.peerHas(c, index)
+			}
+		case message.MsgBitfield:
+			c.SetBitfield(msg.Payload)
+			for i := 0; super != nil && i < torrent.NumPieces(); i++ {
+				if c.HasPiece(i) {
+					super.peerHas(c, i)
+				}
+			}
+		case message.MsgHashRequest:
+			// Choked peers get only the hashes from the piece layer up, which the torrent holds; the ones below
+			// are hashed from up to a piece of data each, and like the data are for the peers we upload to
+			var data io.ReaderAt
+			if !choker.IsChoked(c) {
+				data = file
+			}
+			err := torrent.ServeHashRequest(c, msg, data)
+			if err != nil {
+				log.Printf("Error serving hash request: %v", err)
+				return
+			}
+		case message.MsgCancel:
+			index, begin, length, err := message.ParseCancel(msg)
+			if err != nil {
+				log.Printf("Error parsing cancel message: %v", err)
+				continue
+			}
+			queue.cancel(request{index, begin, length})
 		case message.MsgRequest:
 			// Parse the request message
 			index, begin, length, err := message.ParseRequest(msg)
@@ -115,63 +271,64 @@ func serveClient(wg *sync.WaitGroup, c *client.Client, torrent peer2peer.Torrent
 				continue
 			}
 
+			// Choked peers are only served their allowed fast pieces, and disconnected if they keep asking
+			if since := choker.ChokedSince(c); !since.IsZero() && !allowedFast[index] {
+				if time.Since(since) > chokeGrace {
+					chokedRequests++
+					if chokedRequests > MaxChokedRequests {
+						log.Printf("Disconnecting %s: too many requests while choked\n", c.Peer)
+						return
+					}
+				}
+				rejectRequest(c, index, begin, length)
+				continue
+			}
+
+			// Super-seeding peers may only request the pieces we offered them
+			if super != nil && !super.allowed(c, index) {
+				rejectRequest(c, index, begin, length)
+				continue
+			}
+
 			// Check if the requested block is valid
 			err = handleRequestError(torrent, index, begin, length)
 			if err != nil {
 				log.Printf("Error handling request: %v", err)
+				rejectRequest(c, index, begin, length)
 				continue
 			}
 
-			// Get the requested data from the file reader
-			// offset := int64(index)*int64(torrent.PieceLength) + int64(begin)
-			data, err := getData(file, torrent, index, begin, length)
-			if err != nil {
-				log.Printf("Error getting data from file: %v", err)
-				continue
-			}
-			// Send the data to the client
-			err = c.SendPiece(index, begin, data)
-			if err != nil {
-				log.Printf("Error sending data to client: %v", err)
+			if !queue.push(request{index, begin, length}) {
+				log.Printf("Request queue of %s is full\n", c.Peer)
+				rejectRequest(c, index, begin, length)
 			}
-			fmt.Println("Sending piece %d for peer %s",
-				index, c.Peer.String())
 		}
 	}
 }
 
-// getData gets the data from the file reader and returns it as a byte array.
-func getData(file *os.File, torrent peer2peer.Torrent, index, begin, length int) ([]byte, error) {
-	numPieces := len(torrent.PieceHashes)
-	pieceLength := torrent.PieceLength
-	fileSize := torrent.Length
-
-	offset := int64(index)*int64(pieceLength) + int64(begin)
-
-	
-	// Check if this is the last piece
-	lastPiece := index == numPieces-1
-
-
-
-	// Calculate the length of this piece
-	var len int
-	if lastPiece {
-		len = int(fileSize - int(offset))
-	} else {
-		len = torrent.PieceLength
+// rejectRequest tells a peer with the Fast Extension that we will not serve its request
+// Peers without it are not told; they stop waiting when the request times out.
+func rejectRequest(c *client.Client, index, begin, length int) {
+	if !c.SupportsFast() {
+		return
 	}
+	err := c.SendReject(index, begin, length)
+	if err != nil {
+		log.Printf("Error rejecting request: %v", err)
+	}
+}
 
-
-	buf := make([]byte, len)
+// getData gets the data from the file reader and returns it as a byte array.
+// The request has been validated by handleRequestError, so the block lies within the file.
+func getData(file io.ReaderAt, torrent peer2peer.Torrent, index, begin, length int) ([]byte, error) {
+	offset := int64(index)*int64(torrent.PieceLength) + int64(begin)
+	buf := make([]byte, length)
 
 	// Read the data from the file
-	_, err := file.ReadAt(buf[:len], offset)
+	_, err := file.ReadAt(buf, offset)
 	if err != nil {
 		log.Printf("Error reading from file: %v", err)
 		return nil, err
 	}
 	return buf, nil
 }
-
-
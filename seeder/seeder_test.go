@@ -0,0 +1,201 @@
+package seeder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"bit-torrent/bitfield"
+	"bit-torrent/client"
+	"bit-torrent/handshake"
+	"bit-torrent/message"
+	"bit-torrent/peer2peer"
+)
+
+// testTorrents serves a single torrent of which we have every piece
+type testTorrents struct {
+	torrent peer2peer.Torrent
+}
+
+func (s testTorrents) InfoHashes() [][20]byte {
+	return [][20]byte{s.torrent.InfoHash}
+}
+
+func (s testTorrents) Lookup(infoHash [20]byte) ([20]byte, bitfield.Bitfield, int, bool) {
+	have := make(bitfield.Bitfield, (s.torrent.NumPieces()+7)/8)
+	for i := 0; i < s.torrent.NumPieces(); i++ {
+		have.SetPiece(i)
+	}
+	return s.torrent.PeerID, have, s.torrent.NumPieces(), infoHash == s.torrent.InfoHash
+}
+
+// testTorrent returns a torrent of four 32 byte pieces and its data
+func testTorrent() (peer2peer.Torrent, []byte) {
+	data := make([]byte, 128)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	torrent := peer2peer.Torrent{
+		PeerID:      [20]byte{'s', 'e', 'e', 'd'},
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: make([][20]byte, 4),
+		PieceLength: 32,
+		Length:      len(data),
+	}
+	return torrent, data
+}
+
+// expect reads the next message from the peer's side of the connection and checks its ID
+func expect(t *testing.T, conn net.Conn, id interface{}) *message.Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := message.Read(conn)
+	if err != nil {
+		t.Fatalf("Waiting for message %v: %v", id, err)
+	}
+	if msg == nil || interface{}(msg.ID) != id {
+		t.Fatalf("Received %v, want message %v", msg, id)
+	}
+	return msg
+}
+
+// send writes a message from the peer's side of the connection
+func send(t *testing.T, conn net.Conn, msg *message.Message) {
+	t.Helper()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write(msg.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servePeer connects a peer with the Fast Extension and no pieces over an in-memory connection and serves it
+// It returns the peer's side of the connection and a channel closed when serveClient returns.
+func servePeer(t *testing.T, choker *peer2peer.Choker, torrent peer2peer.Torrent, data []byte) (net.Conn, chan struct{}) {
+	t.Helper()
+	peer, conn := net.Pipe()
+	accepted := make(chan *client.Client, 1)
+	go func() {
+		c, err := client.Accept(conn, testTorrents{torrent})
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+
+	hs := &handshake.HandShake{Pstr: "BitTorrent protocol", InfoHash: torrent.InfoHash, PeerID: [20]byte{'p'}}
+	hs.SetBit(handshake.BitFast)
+	_, err := peer.Write(hs.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = handshake.Read(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, peer, message.MsgHaveAll)
+	send(t, peer, &message.Message{ID: message.MsgHaveNone})
+	c := <-accepted
+	if c == nil {
+		t.FailNow()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		choker.Add(c)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		serveClient(&wg, c, choker, nil, torrent, bytes.NewReader(data))
+	}()
+	expect(t, peer, message.MsgChoke)
+	return peer, done
+}
+
+// block returns the index, begin and data of a Piece message
+func block(msg *message.Message) (int, int, []byte) {
+	return int(binary.BigEndian.Uint32(msg.Payload[0:4])), int(binary.BigEndian.Uint32(msg.Payload[4:8])), msg.Payload[8:]
+}
+
+func TestCancelQueuedUpload(t *testing.T) {
+	torrent, data := testTorrent()
+	choker := peer2peer.NewChoker(true)
+	defer choker.Close()
+	peer, done := servePeer(t, choker, torrent, data)
+
+	send(t, peer, &message.Message{ID: message.MsgInterested})
+	expect(t, peer, message.MsgUnchoke)
+
+	// We do not read, so the first block stays in flight while the others wait in the queue
+	send(t, peer, message.FormatRequest(0, 0, 8))
+	send(t, peer, message.FormatRequest(0, 8, 8))
+	send(t, peer, message.FormatRequest(0, 16, 8))
+	send(t, peer, message.FormatCancel(0, 8, 8))
+	send(t, peer, message.FormatRequest(1, 0, 8))
+
+	for _, want := range []struct{ index, begin int }{{0, 0}, {0, 16}, {1, 0}} {
+		index, begin, got := block(expect(t, peer, message.MsgPiece))
+		offset := want.index*torrent.PieceLength + want.begin
+		if index != want.index || begin != want.begin || !bytes.Equal(got, data[offset:offset+8]) {
+			t.Errorf("Received block %d+%d %v, want block %d+%d", index, begin, got, want.index, want.begin)
+		}
+	}
+	peer.Close()
+	<-done
+}
+
+func TestRejectChokedRequests(t *testing.T) {
+	defer func(grace time.Duration) { chokeGrace = grace }(chokeGrace)
+	torrent, data := testTorrent()
+	choker := peer2peer.NewChoker(true)
+	defer choker.Close()
+
+	tests := []struct {
+		name  string
+		grace time.Duration
+		// the requests answered with a Reject before the peer is disconnected, or -1 if it stays connected
+		rejects int
+	}{
+		{"within the grace period", time.Hour, -1},
+		{"after the grace period", 0, MaxChokedRequests},
+	}
+	for _, test := range tests {
+		chokeGrace = test.grace
+		peer, done := servePeer(t, choker, torrent, data)
+		requests := MaxChokedRequests + 1
+		for i := 0; i < requests; i++ {
+			send(t, peer, message.FormatRequest(0, 0, 8))
+			if i == test.rejects {
+				break
+			}
+			index, begin, length, err := message.ParseReject(expect(t, peer, message.MsgReject))
+			if err != nil || index != 0 || begin != 0 || length != 8 {
+				t.Errorf("%s: rejected %d+%d (%d bytes), %v, want the request", test.name, index, begin, length, err)
+			}
+		}
+
+		if test.rejects < 0 {
+			select {
+			case <-done:
+				t.Errorf("%s: the peer was disconnected", test.name)
+			default:
+			}
+			peer.Close()
+			<-done
+			continue
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the peer was not disconnected", test.name)
+		}
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := message.Read(peer); err == nil {
+			t.Errorf("%s: the connection is still open", test.name)
+		}
+		peer.Close()
+	}
+}
@@ -0,0 +1,211 @@
+// Description: Super-seeding (BEP 16), for a seed that is the only source of a torrent.
+// Every peer is offered a single piece with a Have message, and is offered another one only after the piece has been
+// seen announced by other peers, so the origin uploads each piece as few times as possible. Once every piece is known
+// to be in the swarm, the seeder falls back to normal seeding.
+package seeder
+
+import (
+	"log"
+	"sync"
+
+	"bit-torrent/bitfield"
+	"bit-torrent/client"
+)
+
+// SuperSeed turns on super-seeding
+var SuperSeed = false
+
+// superSeeder hands out the pieces of a torrent one at a time
+type superSeeder struct {
+	numPieces int
+	onDone    func() // called once when the swarm has every piece
+
+	mu           sync.Mutex
+	active       bool
+	peers        map[*client.Client]*superPeer
+	availability []int // number of connected peers known to have each piece
+}
+
+// superPeer is what the super-seeder knows about one peer
+type superPeer struct {
+	has     bitfield.Bitfield
+	offer   int          // the piece offered last, or -1
+	offered map[int]bool // every piece offered to the peer, which it may request
+}
+
+// newSuperSeeder creates a super-seeder for a torrent with numPieces pieces
+// onDone is called when it falls back to normal seeding.
+func newSuperSeeder(numPieces int, onDone func()) *superSeeder {
+	return &superSeeder{
+		numPieces:    numPieces,
+		onDone:       onDone,
+		active:       true,
+		peers:        make(map[*client.Client]*superPeer),
+		availability: make([]int, numPieces),
+	}
+}
+
+// isActive reports whether we are still super-seeding
+func (s *superSeeder) isActive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// add starts super-seeding to a peer with the pieces it told us it has, and offers it its first piece
+// Without super-seeding the peer is told about every piece instead.
+func (s *superSeeder) add(c *client.Client) {
+	s.mu.Lock()
+	if !s.active {
+		s.mu.Unlock()
+		announceAll(c, s.numPieces)
+		return
+	}
+	p := &superPeer{has: bitfield.New(s.numPieces), offer: -1, offered: make(map[int]bool)}
+	for i := 0; i < s.numPieces; i++ {
+		if c.HasPiece(i) {
+			p.has.SetPiece(i)
+			s.availability[i]++
+		}
+	}
+	s.peers[c] = p
+	offer := s.nextOfferLocked(p)
+	s.mu.Unlock()
+
+	s.sendOffer(c, offer)
+	s.checkSaturated()
+}
+
+// remove forgets a peer whose connection was closed
+func (s *superSeeder) remove(c *client.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.peers[c]
+	if p == nil {
+		return
+	}
+	for i := 0; i < s.numPieces; i++ {
+		if p.has.HasPiece(i) {
+			s.availability[i]--
+		}
+	}
+	delete(s.peers, c)
+}
+
+// allowed reports whether a peer may request a piece: while super-seeding only the pieces offered to it
+func (s *superSeeder) allowed(c *client.Client, index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active {
+		return true
+	}
+	p := s.peers[c]
+	return p != nil && p.offered[index]
+}
+
+// peerHas records a piece a peer announced
+// Peers that were offered the piece see it propagated and are offered a new one; the announcing peer itself
+// only gets a new piece this way when no other peer could pass its piece on.
+func (s *superSeeder) peerHas(c *client.Client, index int) {
+	s.mu.Lock()
+	p := s.peers[c]
+	if !s.active || p == nil || index < 0 || index >= s.numPieces || p.has.HasPiece(index) {
+		s.mu.Unlock()
+		return
+	}
+	p.has.SetPiece(index)
+	s.availability[index]++
+
+	offers := make(map[*client.Client]int)
+	for other, op := range s.peers {
+		if other != c && op.offer == index {
+			offers[other] = s.nextOfferLocked(op)
+		}
+	}
+	if p.offer == index && len(s.peers) == 1 {
+		offers[c] = s.nextOfferLocked(p)
+	}
+	s.mu.Unlock()
+
+	for other, offer := range offers {
+		s.sendOffer(other, offer)
+	}
+	s.checkSaturated()
+}
+
+// nextOfferLocked picks the rarest piece the peer does not have, preferring pieces not offered to anyone else,
+// and records it as the peer's offer; s.mu must be held
+// It returns the piece, or -1 if the peer has every piece.
+func (s *superSeeder) nextOfferLocked(p *superPeer) int {
+	offeredTo := make([]int, s.numPieces)
+	for _, op := range s.peers {
+		if op.offer >= 0 {
+			offeredTo[op.offer]++
+		}
+	}
+	best := -1
+	for i := 0; i < s.numPieces; i++ {
+		if p.has.HasPiece(i) || p.offered[i] {
+			continue
+		}
+		if best < 0 || s.availability[i]+offeredTo[i] < s.availability[best]+offeredTo[best] {
+			best = i
+		}
+	}
+	p.offer = best
+	if best >= 0 {
+		p.offered[best] = true
+	}
+	return best
+}
+
+// sendOffer announces an offered piece to a peer
+func (s *superSeeder) sendOffer(c *client.Client, index int) {
+	if index < 0 {
+		return
+	}
+	err := c.SendHave(index)
+	if err != nil {
+		log.Printf("Could not offer piece %d to %s: %v\n", index, c.Peer, err)
+	}
+}
+
+// checkSaturated falls back to normal seeding once every piece is known to be in the swarm:
+// the peers are told about every piece and onDone is called
+func (s *superSeeder) checkSaturated() {
+	s.mu.Lock()
+	if !s.active {
+		s.mu.Unlock()
+		return
+	}
+	for _, n := range s.availability {
+		if n == 0 {
+			s.mu.Unlock()
+			return
+		}
+	}
+	s.active = false
+	clients := make([]*client.Client, 0, len(s.peers))
+	for c := range s.peers {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	log.Println("Every piece is in the swarm, leaving super-seeding")
+	for _, c := range clients {
+		announceAll(c, s.numPieces)
+	}
+	if s.onDone != nil {
+		s.onDone()
+	}
+}
+
+// announceAll tells a peer about every piece with Have messages, since a bitfield may only follow the handshake
+func announceAll(c *client.Client, numPieces int) {
+	for i := 0; i < numPieces; i++ {
+		err := c.SendHave(i)
+		if err != nil {
+			return
+		}
+	}
+}
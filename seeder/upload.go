@@ -0,0 +1,113 @@
+// Description: The upload queue holds the requests of one peer until their blocks are sent.
+// Requests are read and queued by serveClient and sent by upload, so a Cancel can remove a request before it is served.
+package seeder
+
+import (
+	"io"
+	"log"
+	"sync"
+
+	"bit-torrent/client"
+	"bit-torrent/peer2peer"
+)
+
+// request is a block a peer asked for
+type request struct {
+	index, begin, length int
+}
+
+// uploadQueue is the queue of requests of one peer
+type uploadQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	reqs   []request
+	closed bool
+}
+
+// newUploadQueue creates an empty queue
+func newUploadQueue() *uploadQueue {
+	q := &uploadQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues a request
+// It returns false if the queue already holds client.MaxRequestQueue requests.
+func (q *uploadQueue) push(r request) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.reqs) >= client.MaxRequestQueue {
+		return false
+	}
+	q.reqs = append(q.reqs, r)
+	q.cond.Signal()
+	return true
+}
+
+// cancel removes a request from the queue
+// It returns false if the request was not queued, e.g. because it was already sent.
+func (q *uploadQueue) cancel(r request) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queued := range q.reqs {
+		if queued == r {
+			q.reqs = append(q.reqs[:i], q.reqs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pop waits for the next request
+// It returns false once the queue is closed.
+func (q *uploadQueue) pop() (request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.reqs) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return request{}, false
+	}
+	r := q.reqs[0]
+	q.reqs = q.reqs[1:]
+	return r, true
+}
+
+// close wakes up pop and makes it return false
+func (q *uploadQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// upload sends the blocks of the queued requests until the queue is closed
+// Requests that are still queued when we choke the peer are dropped, except for its allowed fast pieces.
+// The connection is closed if a block cannot be sent, which ends serveClient.
+func upload(c *client.Client, q *uploadQueue, choker *peer2peer.Choker, torrent peer2peer.Torrent, file io.ReaderAt, allowedFast map[int]bool) {
+	for {
+		r, ok := q.pop()
+		if !ok {
+			return
+		}
+		if choker.IsChoked(c) && !allowedFast[r.index] {
+			rejectRequest(c, r.index, r.begin, r.length)
+			continue
+		}
+
+		data, err := getData(file, torrent, r.index, r.begin, r.length)
+		if err != nil {
+			log.Printf("Error getting data from file: %v", err)
+			rejectRequest(c, r.index, r.begin, r.length)
+			continue
+		}
+		err = c.SendPiece(r.index, r.begin, data)
+		if err != nil {
+			log.Printf("Error sending data to client: %v", err)
+			c.Close()
+			return
+		}
+		choker.Uploaded(c, len(data))
+	}
+}
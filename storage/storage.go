@@ -0,0 +1,222 @@
+// Description: Storage maps the byte stream of a torrent onto its files.
+// Package storage reads and writes the data of single and multi-file torrents as one stream of bytes,
+// and checks which pieces of existing data match the torrent's piece hashes. Pad files, which align the files of
+// hybrid and v2 torrents to piece boundaries, are kept out of the file system: they read as zeros and ignore writes.
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bit-torrent/bitfield"
+)
+
+// File is a file of a torrent
+// Path is relative to the torrent's directory; a single-file torrent has one file with an empty path.
+type File struct {
+	Path   string
+	Length int64
+	Pad    bool // a pad file, which is not stored
+}
+
+// Storage is the data of a torrent on disk
+type Storage struct {
+	files  []*os.File // nil for pad files
+	starts []int64    // offset of each file in the stream
+	length int64
+}
+
+// Open opens the existing data of a torrent for reading
+// path is the file of a single-file torrent or the directory of a multi-file torrent.
+// It returns the storage and an error if a file is missing or has the wrong size.
+func Open(path string, files []File) (*Storage, error) {
+	return open(path, files, os.O_RDONLY)
+}
+
+// Create creates the files of a torrent, and the directories they are in, for writing
+// Existing files are truncated to their length in the torrent.
+// It returns the storage and an error if one occurred.
+func Create(path string, files []File) (*Storage, error) {
+	return open(path, files, os.O_RDWR|os.O_CREATE)
+}
+
+// open opens every file of the torrent with the given flags
+func open(path string, files []File, flag int) (*Storage, error) {
+	s := &Storage{}
+	for _, f := range files {
+		if f.Pad {
+			s.files = append(s.files, nil)
+			s.starts = append(s.starts, s.length)
+			s.length += f.Length
+			continue
+		}
+		name, err := filePath(path, f.Path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if flag&os.O_CREATE != 0 {
+			err = os.MkdirAll(filepath.Dir(name), 0755)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		file, err := os.OpenFile(name, flag, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, file)
+		s.starts = append(s.starts, s.length)
+		s.length += f.Length
+
+		if flag&os.O_CREATE != 0 {
+			err = file.Truncate(f.Length)
+		} else {
+			err = checkSize(file, f.Length)
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// filePath joins the torrent's path and the relative path of one of its files,
+// refusing paths that would leave the torrent's directory
+func filePath(path, rel string) (string, error) {
+	if rel == "" {
+		return path, nil
+	}
+	clean := filepath.Clean(filepath.FromSlash(rel))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid file path %q", rel)
+	}
+	return filepath.Join(path, clean), nil
+}
+
+// checkSize returns an error if a file does not have the expected length
+func checkSize(file *os.File, length int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != length {
+		return fmt.Errorf("%s has %d bytes instead of %d", file.Name(), info.Size(), length)
+	}
+	return nil
+}
+
+// Length returns the total length of the files
+func (s *Storage) Length() int64 {
+	return s.length
+}
+
+// Close closes the files
+func (s *Storage) Close() error {
+	var first error
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		err := f.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ReadAt reads len(p) bytes of the stream at offset off, across file boundaries
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	return s.span(p, off, func(f *os.File, b []byte, at int64) (int, error) {
+		if f == nil {
+			for i := range b {
+				b[i] = 0
+			}
+			return len(b), nil
+		}
+		return f.ReadAt(b, at)
+	})
+}
+
+// WriteAt writes p to the stream at offset off, across file boundaries
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	return s.span(p, off, func(f *os.File, b []byte, at int64) (int, error) {
+		if f == nil {
+			return len(b), nil
+		}
+		return f.WriteAt(b, at)
+	})
+}
+
+// span calls op for every part of p that falls into a file, starting at offset off of the stream
+// op is called with a nil file for the parts that fall into pad files.
+func (s *Storage) span(p []byte, off int64, op func(*os.File, []byte, int64) (int, error)) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.length {
+		return 0, io.EOF
+	}
+	done := 0
+	for i, f := range s.files {
+		end := s.starts[i] + s.fileLength(i)
+		if done == len(p) {
+			break
+		}
+		if off+int64(done) >= end {
+			continue
+		}
+		at := off + int64(done) - s.starts[i]
+		n := len(p) - done
+		if int64(n) > end-(off+int64(done)) {
+			n = int(end - (off + int64(done)))
+		}
+		m, err := op(f, p[done:done+n], at)
+		done += m
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// fileLength returns the length of the i-th file
+func (s *Storage) fileLength(i int) int64 {
+	if i+1 < len(s.starts) {
+		return s.starts[i+1] - s.starts[i]
+	}
+	return s.length - s.starts[i]
+}
+
+// Verify hashes every piece of the data and compares it with the torrent's piece hashes
+// It returns the pieces that match and an error if the data could not be read.
+func (s *Storage) Verify(pieceHashes [][20]byte, pieceLength int) (bitfield.Bitfield, error) {
+	bf := bitfield.New(len(pieceHashes))
+	buf := make([]byte, pieceLength)
+	for i, hash := range pieceHashes {
+		begin := int64(i) * int64(pieceLength)
+		end := begin + int64(pieceLength)
+		if end > s.length {
+			end = s.length
+		}
+		if begin >= end {
+			break
+		}
+		piece := buf[:end-begin]
+		_, err := s.ReadAt(piece, begin)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha1.Sum(piece)
+		if bytes.Equal(sum[:], hash[:]) {
+			bf.SetPiece(i)
+		}
+	}
+	return bf, nil
+}
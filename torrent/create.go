@@ -0,0 +1,369 @@
+// Description: Create builds .torrent files from local files and directories.
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"bit-torrent/bencode"
+	"bit-torrent/merkle"
+	"bit-torrent/storage"
+)
+
+// Bounds of the piece length picked by Create when none is given
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	targetPieces   = 1500 // the number of pieces Create aims for
+)
+
+// Format is the kind of metadata Create writes
+type Format int
+
+const (
+	FormatV1     Format = iota // SHA-1 piece hashes
+	FormatV2                   // a file tree with SHA-256 merkle roots and piece layers (BEP 52)
+	FormatHybrid               // both, so v1 and v2 clients share the data
+)
+
+// CreateOptions are the optional fields of a torrent made by Create
+type CreateOptions struct {
+	Format       Format
+	Trackers     [][]string // tiers of tracker URLs; the first URL is also the announce URL
+	WebSeeds     []string   // URLs of web seeds (BEP 19)
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // left out when zero
+	Private      bool      // peers are only found through the trackers (BEP 27)
+	Source       string    // set by some trackers so the same data gets a different info hash
+	PieceLength  int       // picked from the size of the data when zero; a power of two for v2 and hybrid torrents
+}
+
+type createInfo struct {
+	Pieces      string                 `bencode:"pieces,omitempty"`
+	PieceLength int                    `bencode:"piece length"`
+	Length      int64                  `bencode:"length,omitempty"`
+	Name        string                 `bencode:"name"`
+	Files       []createFile           `bencode:"files,omitempty"`
+	Private     int                    `bencode:"private,omitempty"`
+	Source      string                 `bencode:"source,omitempty"`
+	MetaVersion int                    `bencode:"meta version,omitempty"`
+	FileTree    map[string]interface{} `bencode:"file tree,omitempty"`
+}
+
+type createFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr,omitempty"`
+}
+
+type createTorrent struct {
+	Announce     string            `bencode:"announce,omitempty"`
+	AnnounceList [][]string        `bencode:"announce-list,omitempty"`
+	Comment      string            `bencode:"comment,omitempty"`
+	CreatedBy    string            `bencode:"created by,omitempty"`
+	CreationDate int64             `bencode:"creation date,omitempty"`
+	Info         createInfo        `bencode:"info"`
+	PieceLayers  map[string]string `bencode:"piece layers,omitempty"`
+	URLList      []string          `bencode:"url-list,omitempty"`
+}
+
+// Create builds a torrent of the file or directory at path
+// A directory becomes a multi-file torrent of the regular files below it, in lexical order. The files of v2 and
+// hybrid torrents start at piece boundaries, which hybrids mark in their v1 file list with pad files.
+// It returns the bencoded .torrent file and an error if one occurred.
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	files, err := walkFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var length int64
+	for _, f := range files {
+		length += f.Length
+	}
+	if length == 0 {
+		return nil, fmt.Errorf("%s has no data to share", path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = PickPieceLength(length)
+	}
+	if pieceLength <= 0 || pieceLength%minPieceLength != 0 {
+		return nil, fmt.Errorf("Piece length %d is not a multiple of %d", pieceLength, minPieceLength)
+	}
+	if opts.Format != FormatV1 && pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("Piece length %d of a v2 torrent is not a power of two", pieceLength)
+	}
+
+	layout := files
+	if opts.Format != FormatV1 {
+		layout = padFiles(files, int64(pieceLength))
+	}
+	data, err := storage.Open(path, layout)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	hashes, err := hashPieces(data, layout, pieceLength, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	info := createInfo{
+		PieceLength: pieceLength,
+		Name:        filepath.Base(filepath.Clean(path)),
+		Source:      opts.Source,
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+	ct := createTorrent{
+		Comment:   opts.Comment,
+		CreatedBy: opts.CreatedBy,
+		URLList:   opts.WebSeeds,
+	}
+	if opts.Format != FormatV2 {
+		info.Pieces = string(hashes.v1)
+		if len(files) == 1 && files[0].Path == "" {
+			info.Length = length
+		} else {
+			for _, f := range layout {
+				cf := createFile{Length: f.Length, Path: strings.Split(f.Path, "/")}
+				if f.Pad {
+					cf.Attr = "p"
+				}
+				info.Files = append(info.Files, cf)
+			}
+		}
+	}
+	if opts.Format != FormatV1 {
+		filesV2, layers := hashes.merkleTrees(layout, pieceLength)
+		info.MetaVersion = 2
+		info.FileTree = fileTree(filesV2, info.Name)
+		if len(layers) > 0 {
+			ct.PieceLayers = layers
+		}
+	}
+	ct.Info = info
+	if !opts.CreationDate.IsZero() {
+		ct.CreationDate = opts.CreationDate.Unix()
+	}
+	for _, tier := range opts.Trackers {
+		if len(tier) == 0 {
+			continue
+		}
+		if ct.Announce == "" {
+			ct.Announce = tier[0]
+		}
+		ct.AnnounceList = append(ct.AnnounceList, tier)
+	}
+	// A single tracker needs no announce-list
+	if len(ct.AnnounceList) == 1 && len(ct.AnnounceList[0]) == 1 {
+		ct.AnnounceList = nil
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, ct)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// PickPieceLength returns a piece length for length bytes of data: the power of two that gives about
+// targetPieces pieces, between 16 KiB and 16 MiB
+func PickPieceLength(length int64) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && length/int64(pieceLength) > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// walkFiles lists the files of a torrent of the file or directory at path
+// A single file is listed with an empty path, as storage expects.
+func walkFiles(path string) ([]storage.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []storage.File{{Length: info.Size()}}, nil
+	}
+
+	var files []storage.File
+	err = filepath.Walk(path, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, storage.File{Path: filepath.ToSlash(rel), Length: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s contains no files", path)
+	}
+	return files, nil
+}
+
+// createHashes are the hashes of the data of a new torrent
+type createHashes struct {
+	v1     []byte       // the concatenated SHA-1 hashes of the pieces
+	blocks [][][32]byte // the SHA-256 hashes of the blocks of every piece, up to the end of its file
+}
+
+// hashPieces hashes the pieces of the data laid out in files on one goroutine per CPU
+// It returns the hashes the format needs and an error if the data could not be read.
+func hashPieces(data *storage.Storage, files []storage.File, pieceLength int, format Format) (createHashes, error) {
+	length := data.Length()
+	numPieces := int((length + int64(pieceLength) - 1) / int64(pieceLength))
+	var hashes createHashes
+	if format != FormatV2 {
+		hashes.v1 = make([]byte, numPieces*sha1.Size)
+	}
+
+	// v2 block hashes cover a file's data but not the padding after it
+	var dataEnd []int64
+	if format != FormatV1 {
+		hashes.blocks = make([][][32]byte, numPieces)
+		dataEnd = make([]int64, numPieces)
+		var offset int64
+		for _, f := range files {
+			end := offset + f.Length
+			if !f.Pad {
+				for begin := offset; begin < end; begin += int64(pieceLength) {
+					dataEnd[begin/int64(pieceLength)] = end
+				}
+			}
+			offset = end
+		}
+	}
+
+	indexes := make(chan int, numPieces)
+	for i := 0; i < numPieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for i := range indexes {
+				begin := int64(i) * int64(pieceLength)
+				end := begin + int64(pieceLength)
+				if end > length {
+					end = length
+				}
+				piece := buf[:end-begin]
+				_, err := data.ReadAt(piece, begin)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				if hashes.v1 != nil {
+					sum := sha1.Sum(piece)
+					copy(hashes.v1[i*sha1.Size:], sum[:])
+				}
+				if hashes.blocks != nil {
+					fileEnd := dataEnd[i]
+					if fileEnd > end {
+						fileEnd = end
+					}
+					hashes.blocks[i] = merkle.HashBlocks(piece[:fileEnd-begin])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return hashes, firstErr
+}
+
+// merkleTrees builds the merkle tree of every file laid out in files from the block hashes of its pieces
+// It returns the files of the file tree and the piece layers of the files longer than a piece, by pieces root.
+func (h createHashes) merkleTrees(files []storage.File, pieceLength int) ([]FileV2, map[string]string) {
+	blocksPerPiece := pieceLength / merkle.BlockSize
+	var filesV2 []FileV2
+	layers := make(map[string]string)
+	var offset int64
+	for _, f := range files {
+		first := int(offset / int64(pieceLength))
+		offset += f.Length
+		if f.Pad {
+			continue
+		}
+		fv := FileV2{Path: f.Path, Length: f.Length}
+		if f.Length > 0 {
+			numPieces := int((f.Length + int64(pieceLength) - 1) / int64(pieceLength))
+			var leaves [][32]byte
+			for i := first; i < first+numPieces; i++ {
+				leaves = append(leaves, h.blocks[i]...)
+			}
+			fv.PiecesRoot = merkle.PiecesRoot(leaves, blocksPerPiece)
+			if numPieces > 1 {
+				fv.PieceLayer = merkle.PieceLayer(leaves, blocksPerPiece)
+				var layer []byte
+				for _, node := range fv.PieceLayer {
+					layer = append(layer, node[:]...)
+				}
+				layers[string(fv.PiecesRoot[:])] = string(layer)
+			}
+		}
+		filesV2 = append(filesV2, fv)
+	}
+	return filesV2, layers
+}
+
+// fileTree builds the file tree of a v2 info dictionary: nested directories whose files hold their length and
+// pieces root under the empty key
+// A single file, with an empty path, is stored under the torrent's name.
+func fileTree(files []FileV2, name string) map[string]interface{} {
+	tree := make(map[string]interface{})
+	for _, f := range files {
+		p := f.Path
+		if p == "" {
+			p = name
+		}
+		elems := strings.Split(p, "/")
+		dir := tree
+		for _, elem := range elems[:len(elems)-1] {
+			sub, ok := dir[elem].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				dir[elem] = sub
+			}
+			dir = sub
+		}
+		entry := map[string]interface{}{"length": f.Length}
+		if f.Length > 0 {
+			entry["pieces root"] = string(f.PiecesRoot[:])
+		}
+		dir[elems[len(elems)-1]] = map[string]interface{}{"": entry}
+	}
+	return tree
+}
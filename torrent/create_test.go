@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bit-torrent/storage"
+)
+
+func TestCreateInfoHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hello.txt")
+	err = ioutil.WriteFile(path, []byte("hello world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Create(path, CreateOptions{
+		Trackers:    [][]string{{"http://tracker.example/announce"}},
+		WebSeeds:    []string{"http://seed.example/hello.txt"},
+		Comment:     "not in the info hash",
+		PieceLength: 16384,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The info dictionary written out by hand, with its keys in order
+	pieceHash := sha1.Sum([]byte("hello world"))
+	info := "d6:lengthi11e4:name9:hello.txt12:piece lengthi16384e6:pieces20:" + string(pieceHash[:]) + "e"
+	if want := sha1.Sum([]byte(info)); tf.InfoHash != want {
+		t.Errorf("Info hash is %x, want %x", tf.InfoHash, want)
+	}
+	if tf.Announce != "http://tracker.example/announce" {
+		t.Errorf("Announce is %q", tf.Announce)
+	}
+	if !reflect.DeepEqual(tf.WebSeeds, []string{"http://seed.example/hello.txt"}) {
+		t.Errorf("Web seeds are %v", tf.WebSeeds)
+	}
+	if tf.Name != "hello.txt" || tf.Length != 11 || tf.PieceLength != 16384 || tf.Private {
+		t.Errorf("Parsed %s of %d bytes in pieces of %d, private %v", tf.Name, tf.Length, tf.PieceLength, tf.Private)
+	}
+	if !reflect.DeepEqual(tf.PieceHashes, [][20]byte{pieceHash}) {
+		t.Errorf("Piece hashes are %x, want %x", tf.PieceHashes, pieceHash)
+	}
+
+	// Private torrents and sources get a different info hash
+	for _, opts := range []CreateOptions{{Private: true}, {Source: "tracker"}} {
+		other, err := Create(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otf, err := Parse(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if otf.InfoHash == tf.InfoHash {
+			t.Errorf("%+v gives the info hash of a public torrent", opts)
+		}
+		if otf.Private != opts.Private {
+			t.Errorf("%+v parses as private %v", opts, otf.Private)
+		}
+	}
+}
+
+func TestCreateFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "data")
+	files := map[string]int{
+		"a.bin":     40000, // more than two pieces
+		"b/c.bin":   100,   // less than a block
+		"b/d/e.bin": 16384, // exactly a piece
+	}
+	for name, size := range files {
+		buf := make([]byte, size)
+		for i := range buf {
+			buf[i] = byte(i*7 + len(name))
+		}
+		path := filepath.Join(root, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, buf, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		format      Format
+		metaVersion int
+	}{
+		{"v1", FormatV1, 1},
+		{"v2", FormatV2, 2},
+		{"hybrid", FormatHybrid, 2},
+	}
+	for _, test := range tests {
+		data, err := Create(root, CreateOptions{Format: test.format, PieceLength: 16384})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		tf, err := Parse(data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if tf.MetaVersion != test.metaVersion {
+			t.Errorf("%s: meta version is %d, want %d", test.name, tf.MetaVersion, test.metaVersion)
+		}
+		if test.format != FormatV1 && len(tf.FilesV2) != len(files) {
+			t.Errorf("%s: file tree has %d files, want %d", test.name, len(tf.FilesV2), len(files))
+		}
+
+		// The data the torrent was made from passes its own hashes
+		store, err := storage.Open(root, tf.StorageFiles())
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		have, err := tf.Verify(store)
+		store.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for i := 0; i < tf.NumPieces(); i++ {
+			if !have.HasPiece(i) {
+				t.Errorf("%s: piece %d of %d does not verify", test.name, i, tf.NumPieces())
+			}
+		}
+	}
+}
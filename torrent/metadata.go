@@ -0,0 +1,271 @@
+// Description: Magnet links and download of the info dictionary from peers (ut_metadata, BEP 9).
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"bit-torrent/bencode"
+	"bit-torrent/client"
+	"bit-torrent/magnet"
+	"bit-torrent/peers"
+)
+
+// metadataPieceSize is the size of the pieces the info dictionary is exchanged in
+const metadataPieceSize = 16384
+
+// maxMetadataSize protects us from peers announcing absurd metadata sizes
+const maxMetadataSize = 16 << 20
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// OpenMagnet parses a magnet link and downloads the info dictionary from the peers of the torrent
+// Peers are taken from the x.pe parameters, from every tracker in the link and from the DHT if one is running.
+// It returns a TorrentFile and an error if the metadata could not be obtained.
+func OpenMagnet(uri string) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:])
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	var known []peers.Peer
+	for _, pe := range m.Peers {
+		addr, err := net.ResolveTCPAddr("tcp", pe)
+		if err != nil {
+			log.Printf("Skipping invalid peer %s: %v\n", pe, err)
+			continue
+		}
+		known = append(known, peers.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+
+	ps := append([]peers.Peer(nil), known...)
+	for _, tr := range m.Trackers {
+		t := TorrentFile{Announce: tr, InfoHash: m.InfoHash}
+		trackerPeers, err := t.requestPeers(peerID, Port)
+		if err != nil {
+			log.Printf("Could not get peers from %s: %v\n", tr, err)
+			continue
+		}
+		ps = append(ps, trackerPeers...)
+	}
+	if DHT != nil {
+		dhtPeers, err := DHT.GetPeers(m.InfoHash)
+		if err != nil {
+			log.Printf("Could not get peers from the DHT: %v\n", err)
+		}
+		ps = append(ps, dhtPeers...)
+	}
+	ps = uniquePeers(ps)
+	if len(ps) == 0 {
+		return TorrentFile{}, fmt.Errorf("No peers found for magnet link %x", m.InfoHash)
+	}
+
+	info, err := FetchMetadata(m.InfoHash, peerID, ps)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	bto := bencodeTorrent{}
+	if len(m.Trackers) > 0 {
+		bto.Announce = m.Trackers[0]
+	}
+	err = bencode.Unmarshal(bytes.NewReader(info), &bto.Info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	// The info dictionary was verified against the info hash
+	t, err := bto.toTorrentFile(m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	// The piece layers of a hybrid are not part of the info dictionary
+	if t.MetaVersion == 2 {
+		err = t.parseV2(info, nil)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	t.Peers = known
+	t.WebSeeds = m.WebSeeds
+	if t.Name == "" {
+		t.Name = m.DisplayName
+	}
+	return t, nil
+}
+
+// FetchMetadata downloads the bencoded info dictionary of a torrent from the given peers
+// All peers are asked concurrently and the first verified copy wins.
+// It returns the info dictionary and an error if no peer could provide it.
+func FetchMetadata(infoHash, peerID [20]byte, ps []peers.Peer) ([]byte, error) {
+	type result struct {
+		info []byte
+		err  error
+	}
+	results := make(chan result, len(ps))
+	for _, p := range ps {
+		go func(p peers.Peer) {
+			info, err := fetchMetadataFrom(p, infoHash, peerID)
+			if err != nil {
+				log.Printf("Could not get metadata from %s: %v\n", p, err)
+			}
+			results <- result{info, err}
+		}(p)
+	}
+
+	for range ps {
+		res := <-results
+		if res.err == nil {
+			return res.info, nil
+		}
+	}
+	return nil, fmt.Errorf("None of %d peers sent the metadata", len(ps))
+}
+
+// metadataFetch is the progress of downloading the info dictionary from one peer
+type metadataFetch struct {
+	metadata  []byte
+	received  []bool
+	remaining int
+	err       error
+}
+
+// metadataFetches maps the clients we are downloading the info dictionary from to their progress
+var metadataFetches sync.Map
+
+func init() {
+	client.RegisterExtension("ut_metadata", handleMetadata)
+}
+
+// fetchMetadataFrom downloads the info dictionary from a single peer
+// It returns the info dictionary and an error if one occurred.
+func fetchMetadataFrom(peer peers.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	c, err := client.Connect(peer, peerID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if !c.SupportsExtended() {
+		return nil, fmt.Errorf("Peer does not support the extension protocol")
+	}
+	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	fetch := &metadataFetch{}
+	metadataFetches.Store(c, fetch)
+	defer metadataFetches.Delete(c)
+
+	for fetch.metadata == nil || fetch.remaining > 0 {
+		// Extended messages are handed to handleMetadata by Read
+		_, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if fetch.err != nil {
+			return nil, fetch.err
+		}
+
+		hs := c.ExtendedHandshake()
+		if fetch.metadata != nil || hs == nil {
+			continue
+		}
+		if hs.M["ut_metadata"] == 0 {
+			return nil, fmt.Errorf("Peer does not support ut_metadata")
+		}
+		if hs.MetadataSize <= 0 || hs.MetadataSize > maxMetadataSize {
+			return nil, fmt.Errorf("Invalid metadata size %d", hs.MetadataSize)
+		}
+		fetch.metadata = make([]byte, hs.MetadataSize)
+		numPieces := (hs.MetadataSize + metadataPieceSize - 1) / metadataPieceSize
+		fetch.received = make([]bool, numPieces)
+		fetch.remaining = numPieces
+		for i := 0; i < numPieces; i++ {
+			payload, err := client.EncodeExtended(map[string]interface{}{
+				"msg_type": metadataRequest,
+				"piece":    i,
+			}, nil)
+			if err != nil {
+				return nil, err
+			}
+			err = c.SendExtended("ut_metadata", payload)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	hash := sha1.Sum(fetch.metadata)
+	if !bytes.Equal(hash[:], infoHash[:]) {
+		return nil, fmt.Errorf("Metadata does not match infohash %x", infoHash)
+	}
+	return fetch.metadata, nil
+}
+
+// handleMetadata handles a ut_metadata message
+// Pieces are stored if we are downloading the info dictionary from the peer; requests are rejected
+// since we do not serve metadata.
+func handleMetadata(c *client.Client, payload []byte) error {
+	dict, data, err := client.DecodeExtended(payload)
+	if err != nil {
+		return err
+	}
+	msgType, _ := dict["msg_type"].(int64)
+	piece, _ := dict["piece"].(int64)
+
+	if msgType == metadataRequest {
+		reject, err := client.EncodeExtended(map[string]interface{}{
+			"msg_type": metadataReject,
+			"piece":    int(piece),
+		}, nil)
+		if err != nil {
+			return err
+		}
+		return c.SendExtended("ut_metadata", reject)
+	}
+
+	v, ok := metadataFetches.Load(c)
+	if !ok {
+		return nil
+	}
+	fetch := v.(*metadataFetch)
+	if fetch.metadata == nil {
+		return nil
+	}
+
+	switch msgType {
+	case metadataReject:
+		fetch.err = fmt.Errorf("Peer rejected metadata piece %d", piece)
+	case metadataData:
+		if piece < 0 || int(piece) >= len(fetch.received) {
+			fetch.err = fmt.Errorf("Received invalid metadata piece %d", piece)
+			return nil
+		}
+		begin := int(piece) * metadataPieceSize
+		if begin+len(data) > len(fetch.metadata) ||
+			(int(piece) < len(fetch.received)-1 && len(data) != metadataPieceSize) {
+			fetch.err = fmt.Errorf("Metadata piece %d has invalid length %d", piece, len(data))
+			return nil
+		}
+		copy(fetch.metadata[begin:], data)
+		if !fetch.received[piece] {
+			fetch.received[piece] = true
+			fetch.remaining--
+		}
+	}
+	return nil
+}
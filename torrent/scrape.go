@@ -0,0 +1,123 @@
+// Description: Tracker scrape (BEP 48) requests.
+package torrent
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"bit-torrent/bencode"
+)
+
+// ScrapeResult holds the swarm statistics a tracker reports for one torrent
+type ScrapeResult struct {
+	InfoHash   [20]byte
+	Complete   int // number of seeders
+	Downloaded int // number of completed downloads
+	Incomplete int // number of leechers
+}
+
+// Scrape asks the tracker behind the announce URL for the statistics of the given info hashes.
+// HTTP trackers are scraped through the URL derived from the announce URL, UDP trackers through the scrape action.
+// It returns one result per info hash, in the same order, and an error if one occurred.
+// Info hashes the tracker does not know about are reported with zero counts.
+func Scrape(announce string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, nil
+	}
+	if strings.HasPrefix(announce, "udp://") {
+		tr, err := dialUDPTracker(announce)
+		if err != nil {
+			return nil, err
+		}
+		defer tr.Close()
+		return tr.scrape(infoHashes)
+	}
+	return scrapeHTTP(announce, infoHashes)
+}
+
+// Scrape asks the torrent's tracker for the statistics of this torrent
+// It returns the result and an error if one occurred.
+func (t *TorrentFile) Scrape() (ScrapeResult, error) {
+	results, err := Scrape(t.Announce, [][20]byte{t.InfoHash})
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	return results[0], nil
+}
+
+// scrapeURL derives the scrape URL from an HTTP announce URL by replacing the
+// "announce" at the start of the last path component with "scrape".
+// It returns an error if the tracker does not support scraping.
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if slash < 0 || !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return "", fmt.Errorf("Tracker %s does not support scrape", announce)
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + u.Path[slash+1+len("announce"):]
+	return u.String(), nil
+}
+
+// scrapeHTTP scrapes an HTTP tracker
+// It returns one result per info hash, in the same order, and an error if one occurred.
+func scrapeHTTP(announce string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	scrape, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(scrape)
+	if err != nil {
+		return nil, err
+	}
+	params := base.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	base.RawQuery = params.Encode()
+
+	resp, err := trackerHTTPClient().Get(base.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tracker answered %s", resp.Status)
+	}
+
+	data, err := bencode.Decode(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Received malformed scrape response")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("Tracker error: %s", reason)
+	}
+	files, _ := dict["files"].(map[string]interface{})
+
+	results := make([]ScrapeResult, len(infoHashes))
+	for i, h := range infoHashes {
+		results[i].InfoHash = h
+		stats, ok := files[string(h[:])].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		results[i].Complete = scrapeCount(stats, "complete")
+		results[i].Downloaded = scrapeCount(stats, "downloaded")
+		results[i].Incomplete = scrapeCount(stats, "incomplete")
+	}
+	return results, nil
+}
+
+// scrapeCount returns the integer stored under key in a decoded scrape dictionary, or 0 if missing
+func scrapeCount(stats map[string]interface{}, key string) int {
+	n, _ := stats[key].(int64)
+	return int(n)
+}
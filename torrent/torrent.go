@@ -6,20 +6,34 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"os"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"bit-torrent/bencode"
+	"bit-torrent/bitfield"
 	"bit-torrent/client"
+	"bit-torrent/dht"
+	"bit-torrent/httpseed"
+	"bit-torrent/lsd"
 	"bit-torrent/peer2peer"
 	"bit-torrent/peers"
+	"bit-torrent/storage"
+	"bit-torrent/webseed"
 )
 
 // Port to listen on
 const Port uint16 = 6881
 
+// DHT is the DHT node used to find peers in addition to the tracker, or nil to use trackers only
+var DHT *dht.Server
+
+// LSD announces torrents on the local network and finds peers there, or nil to not use local service discovery
+var LSD *lsd.Service
+
 // TorrentFile encodes the metadata from a .torrent file
 type TorrentFile struct {
 	Announce    string
@@ -28,13 +42,30 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []storage.File // the files of a multi-file torrent, nil for a single file
+	Peers       []peers.Peer   // peers known without asking the tracker, e.g. from a magnet link
+	MetaVersion int            // 2 for v2 and hybrid torrents (BEP 52), 1 otherwise
+	InfoHashV2  [32]byte       // SHA-256 of the info dictionary of a v2 or hybrid torrent
+	FilesV2     []FileV2       // the file tree of a v2 or hybrid torrent
+	WebSeeds    []string       // URLs of web seeds (BEP 19), from the url-list
+	HTTPSeeds   []string       // URLs of HTTP seeds (BEP 17), from the httpseeds
+	Private     bool           // peers may only be found through the trackers (BEP 27)
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr"`
 }
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length"`
+	Name        string        `bencode:"name"`
+	Files       []bencodeFile `bencode:"files"`
+	MetaVersion int           `bencode:"meta version"`
+	Private     int           `bencode:"private"`
 }
 
 type bencodeTorrent struct {
@@ -45,31 +76,89 @@ type bencodeTorrent struct {
 // ParseTorrentFile parses a .torrent file and returns a TorrentFile struct
 // GetTorrent returns a Torrent struct from the TorrentFile struct
 func (t *TorrentFile) GetTorrent() (peer2peer.Torrent, error) {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+	return t.newTorrent(announceStats{left: int64(t.left())}, true)
+}
 
+// GetSeedTorrent returns a Torrent struct for seeding data we already have
+// We announce that nothing is left to download, and finding no peers is not an error: they may connect to us later.
+func (t *TorrentFile) GetSeedTorrent() (peer2peer.Torrent, error) {
+	return t.newTorrent(announceStats{event: "started"}, false)
+}
+
+// newTorrent announces the torrent to the tracker and the DHT and returns a Torrent struct with the peers found
+// It returns an error if needPeers is set and no peers were found.
+func (t *TorrentFile) newTorrent(stats announceStats, needPeers bool) (peer2peer.Torrent, error) {
+	err := t.checkPieceLayers()
 	if err != nil {
 		return peer2peer.Torrent{}, err
 	}
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:])
 
-	peers, err := t.requestPeers(peerID, Port)
 	if err != nil {
 		return peer2peer.Torrent{}, err
 	}
 
-	torrent := peer2peer.Torrent{
-		Peers:       peers,
-		PeerID:      peerID,
-		InfoHash:    t.InfoHash,
-		PieceHashes: t.PieceHashes,
-		PieceLength: t.PieceLength,
-		Length:      t.Length,
-		Name:        t.Name,
+	// Web seeds have the whole torrent, so with them we can do without peers, and so can we while local service
+	// discovery may still find some
+	webSeeds := t.webSeeds()
+	needPeers = needPeers && len(webSeeds) == 0 && (LSD == nil || t.Private)
+
+	ps := append([]peers.Peer(nil), t.Peers...)
+	// Private torrents are only announced to their trackers (BEP 27)
+	useDHT := DHT != nil && !t.Private
+	if t.Announce != "" || !useDHT {
+		trackerPeers, err := t.announcePeers(peerID, Port, stats)
+		if err != nil && !useDHT && needPeers {
+			return peer2peer.Torrent{}, err
+		}
+		if err != nil {
+			log.Printf("Could not get peers from %s: %v\n", t.Announce, err)
+		}
+		ps = append(ps, trackerPeers...)
+	}
+	if useDHT {
+		dhtPeers, err := DHT.Announce(t.InfoHash, Port)
+		if err != nil {
+			log.Printf("Could not get peers from the DHT: %v\n", err)
+		}
+		log.Printf("Found %d peers in the DHT\n", len(dhtPeers))
+		ps = append(ps, dhtPeers...)
+	}
+	ps = uniquePeers(ps)
+	if len(ps) == 0 && needPeers {
+		return peer2peer.Torrent{}, fmt.Errorf("No peers found for %s", t.Name)
+	}
+
+	torrent := t.peerTorrent()
+	torrent.Peers = ps
+	torrent.PeerID = peerID
+	torrent.WebSeeds = webSeeds
+	torrent.Conns = peer2peer.NewConnManager(peerID, t.InfoHash, torrent.NumPieces(), t.Private)
+	torrent.Choker = peer2peer.NewChoker(false)
+	if LSD != nil && !t.Private {
+		conns := torrent.Conns
+		LSD.Add(t.InfoHash, func(p peers.Peer) {
+			conns.AddPeers([]peers.Peer{p})
+		})
 	}
 
 	return torrent, nil
 }
 
+// uniquePeers removes peers that are listed more than once, e.g. by the tracker and the DHT
+func uniquePeers(ps []peers.Peer) []peers.Peer {
+	seen := make(map[string]bool)
+	unique := ps[:0]
+	for _, p := range ps {
+		if !seen[p.String()] {
+			seen[p.String()] = true
+			unique = append(unique, p)
+		}
+	}
+	return unique
+}
+
 // // Connect to peers
 // func ConnectToPeers(torrent peer2peer.Torrent,
 // 	keepAliveChan chan bool) ([]*client.Client, error) {
@@ -113,12 +202,19 @@ func ConnectToPeers(torrent peer2peer.Torrent,
 		wg.Add(1)
 		go func(p peers.Peer) {
 			defer wg.Done()
-			c, err := client.New(p, torrent.PeerID, torrent.InfoHash)
+			var c *client.Client
+			var err error
+			if torrent.Conns != nil {
+				c, err = torrent.Conns.Connect(p)
+			} else {
+				numPieces := torrent.NumPieces()
+				c, err = client.New(p, torrent.PeerID, torrent.InfoHash, bitfield.New(numPieces), numPieces)
+			}
 			if err != nil {
-				log.Printf("Could not handshake with %s. Disconnecting\n", p.IP)
+				log.Printf("Could not handshake with %s. Disconnecting\n", p)
 				return
 			}
-			log.Printf("Completed handshake with %s\n", p.IP)
+			log.Printf("Completed handshake with %s\n", p)
 			mu.Lock()
 			clients = append(clients, c)
 			mu.Unlock()
@@ -146,6 +242,7 @@ func ConnectToPeers(torrent peer2peer.Torrent,
 }
 
 // DownloadToFile downloads the torrent file and saves it to the specified path
+// The files of a multi-file torrent are saved in the directory at path.
 func (t *TorrentFile) DownloadToFile(path string,
 	torrent peer2peer.Torrent, clients []*client.Client) error {
 	buf, err := torrent.Download(clients)
@@ -153,13 +250,13 @@ func (t *TorrentFile) DownloadToFile(path string,
 		return err
 	}
 
-	outFile, err := os.Create(path)
+	out, err := storage.Create(path, t.StorageFiles())
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
+	defer out.Close()
 
-	_, err = outFile.Write(buf)
+	_, err = out.WriteAt(buf, 0)
 	if err != nil {
 		return err
 	}
@@ -168,34 +265,145 @@ func (t *TorrentFile) DownloadToFile(path string,
 	return nil
 }
 
+// peerTorrent returns the Torrent struct of the torrent, without peers
+func (t *TorrentFile) peerTorrent() peer2peer.Torrent {
+	return peer2peer.Torrent{
+		InfoHash:    t.InfoHash,
+		PieceHashes: t.PieceHashes,
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Name:        t.Name,
+		FilesV2:     t.peerFilesV2(),
+		Private:     t.Private,
+	}
+}
+
+// webSeeds returns the web seeds and HTTP seeds of the torrent; URLs we cannot use are logged and skipped
+func (t *TorrentFile) webSeeds() []peer2peer.WebSeed {
+	var seeds []peer2peer.WebSeed
+	for _, u := range t.WebSeeds {
+		seed, err := webseed.New(u, t.Name, t.StorageFiles())
+		if err != nil {
+			log.Printf("Skipping web seed: %v\n", err)
+			continue
+		}
+		seeds = append(seeds, seed)
+	}
+	for _, u := range t.HTTPSeeds {
+		seed, err := httpseed.New(u, t.InfoHash, t.PieceLength, t.Length)
+		if err != nil {
+			log.Printf("Skipping HTTP seed: %v\n", err)
+			continue
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds
+}
+
+// NumPieces returns the number of pieces of the torrent
+func (t *TorrentFile) NumPieces() int {
+	pt := t.peerTorrent()
+	return pt.NumPieces()
+}
+
+// Verify checks which pieces of the torrent's data are correct
+// It returns the correct pieces and an error if the data could not be read.
+func (t *TorrentFile) Verify(data *storage.Storage) (bitfield.Bitfield, error) {
+	if t.PieceHashes != nil {
+		return data.Verify(t.PieceHashes, t.PieceLength)
+	}
+	pt := t.peerTorrent()
+	bf := bitfield.New(pt.NumPieces())
+	for i := 0; i < pt.NumPieces(); i++ {
+		buf := make([]byte, pt.PieceSize(i))
+		_, err := data.ReadAt(buf, int64(i)*int64(t.PieceLength))
+		if err != nil {
+			return nil, err
+		}
+		if pt.VerifyPiece(i, buf) {
+			bf.SetPiece(i)
+		}
+	}
+	return bf, nil
+}
+
+// StorageFiles returns the files the data of the torrent is stored in
+// A single-file torrent has one file with an empty path, which stands for the path the data is saved to.
+func (t *TorrentFile) StorageFiles() []storage.File {
+	if t.Files != nil {
+		return t.Files
+	}
+	return []storage.File{{Length: int64(t.Length)}}
+}
+
 // Open parses a torrent file
+// The info hash is computed over the info dictionary exactly as it appears in the file.
 func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
+	return Parse(data)
+}
 
+// Parse parses the contents of a .torrent file
+// It returns the TorrentFile and an error if the data is not a valid torrent.
+func Parse(data []byte) (TorrentFile, error) {
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err := bencode.Unmarshal(bytes.NewReader(data), &bto)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	return bto.toTorrentFile()
+	info, err := bencode.RawValue(data, "info")
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	t, err := bto.toTorrentFile(sha1.Sum(info))
+	t.WebSeeds = urlList(data, "url-list")
+	t.HTTPSeeds = urlList(data, "httpseeds")
+	if err != nil || t.MetaVersion != 2 {
+		return t, err
+	}
+	// The piece layers live outside the info dictionary
+	layers, err := bencode.RawValue(data, "piece layers")
+	if err != nil {
+		layers = nil
+	}
+	err = t.parseV2(info, layers)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return t, nil
 }
 
-// hash returns the SHA-1 hash of the bencodeInfo struct as a byte array
-func (i *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
+// urlList returns the URLs under a key of a .torrent file, such as the web seeds of the url-list
+// The key holds either a single URL or a list of them.
+func urlList(data []byte, key string) []string {
+	raw, err := bencode.RawValue(data, key)
 	if err != nil {
-		return [20]byte{}, err
+		return nil
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	decoded, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	switch v := decoded.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var urls []string
+		for _, u := range v {
+			if s, ok := u.(string); ok && s != "" {
+				urls = append(urls, s)
+			}
+		}
+		return urls
+	}
+	return nil
 }
 
-
 // splitPieceHashes splits the pieces field of the bencodeInfo struct into a slice of 20 byte arrays
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	hashLen := 20 // Length of SHA-1 hash
@@ -214,25 +422,41 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 }
 
 // toTorrentFile converts a bencodeTorrent struct to a TorrentFile struct
-// toTorrentFile converts a bencodeTorrent struct to a TorrentFile struct
-func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return TorrentFile{}, err
-	}
-	pieceHashes, err := bto.Info.splitPieceHashes()
-	if err != nil {
-		return TorrentFile{}, err
+// The v2 part of the info dictionary is left to parseV2; a v2-only torrent has no piece hashes.
+func (bto *bencodeTorrent) toTorrentFile(infoHash [20]byte) (TorrentFile, error) {
+	var pieceHashes [][20]byte
+	var err error
+	if bto.Info.MetaVersion != 2 || bto.Info.Pieces != "" {
+		pieceHashes, err = bto.Info.splitPieceHashes()
+		if err != nil {
+			return TorrentFile{}, err
+		}
 	}
 	t := TorrentFile{
+		MetaVersion: 1,
 		Announce:    bto.Announce,
 		InfoHash:    infoHash,
 		PieceHashes: pieceHashes,
 		PieceLength: bto.Info.PieceLength,
 		Length:      bto.Info.Length,
 		Name:        bto.Info.Name,
+		Private:     bto.Info.Private == 1,
+	}
+	if bto.Info.MetaVersion == 2 {
+		t.MetaVersion = 2
+	}
+	// A multi-file torrent lists its files instead of a length; the data is their concatenation
+	if len(bto.Info.Files) > 0 {
+		t.Length = 0
+		for _, f := range bto.Info.Files {
+			if len(f.Path) == 0 || f.Length < 0 {
+				return TorrentFile{}, fmt.Errorf("Invalid file entry in %s", t.Name)
+			}
+			// Pad files of hybrid torrents align the next file to a piece boundary
+			pad := strings.Contains(f.Attr, "p")
+			t.Files = append(t.Files, storage.File{Path: path.Join(f.Path...), Length: int64(f.Length), Pad: pad})
+			t.Length += f.Length
+		}
 	}
 	return t, nil
 }
-
-
@@ -2,22 +2,39 @@
 package torrent
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"bit-torrent/bencode"
 	"bit-torrent/peers"
+	"bit-torrent/proxy"
 )
 
+// TrackerProxy is the proxy HTTP trackers are reached through, or nil to connect directly
+// UDP trackers cannot be reached through a proxy.
+var TrackerProxy proxy.Dialer
+
 type bencodeTrackerResp struct {
 	Interval int    `bencode:"interval"`
 	Peers    string `bencode:"peers"`
+	Peers6   string `bencode:"peers6"`
+}
+
+// announceStats are the transfer totals and the event reported in an announce
+type announceStats struct {
+	uploaded   int64
+	downloaded int64
+	left       int64
+	event      string // "started", "completed", "stopped", or empty for a regular announce
 }
 
 // buildTrackerURL builds a tracker URL from the torrent file and peer information and returns it as a string.
-func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
+func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16, stats announceStats) (string, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return "", err
@@ -27,29 +44,54 @@ func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, err
 		"info_hash": []string{string(t.InfoHash[:])},
 		"peer_id":   []string{string(peerID[:])},
 		"port":      []string{strconv.Itoa(int(port))},
-		"uploaded":  []string{"0"},
+		"uploaded":  []string{strconv.FormatInt(stats.uploaded, 10)},
 
 		// "downloaded"   : []string{string(t.Length)},
-		"downloaded": []string{"0"},
+		"downloaded": []string{strconv.FormatInt(stats.downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{"0"},
-		// "left":       []string{strconv.Itoa(t.Length)},
+		"left":       []string{strconv.FormatInt(stats.left, 10)},
+	}
+	if stats.event != "" {
+		params.Set("event", stats.event)
+	}
+	// Tell the tracker our IPv6 address so IPv6 peers can find us (BEP 7), unless a proxy is there to hide it
+	if ip := localIPv6(); ip != nil && TrackerProxy == nil {
+		params.Set("ipv6", ip.String())
 	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
 
+// left returns the number of bytes we report as left to download
+// The size of a magnet link is unknown until its metadata arrives; a non-zero
+// amount is reported meanwhile so trackers do not take us for a seeder.
+func (t *TorrentFile) left() int {
+	if t.NumPieces() == 0 {
+		return metadataPieceSize
+	}
+	return t.Length
+}
+
 // requestPeers requests peers from the tracker and returns a slice of peers.
+// UDP trackers are asked with the UDP tracker protocol.
 func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	url, err := t.buildTrackerURL(peerID, port)
+	return t.announcePeers(peerID, port, announceStats{left: int64(t.left())})
+}
+
+// announcePeers announces the torrent to the tracker with the given totals and event and returns a slice of peers.
+func (t *TorrentFile) announcePeers(peerID [20]byte, port uint16, stats announceStats) ([]peers.Peer, error) {
+	if strings.HasPrefix(t.Announce, "udp://") {
+		return t.requestPeersUDP(peerID, port, stats)
+	}
+
+	url, err := t.buildTrackerURL(peerID, port, stats)
 
 	if err != nil {
 		return nil, err
 	}
 
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	resp, err := trackerHTTPClient().Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +106,61 @@ func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer,
 		return nil, err
 	}
 
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+	peersV4, err := peers.Unmarshal([]byte(trackerResp.Peers))
+	if err != nil {
+		return nil, err
+	}
+	peersV6, err := peers.Unmarshal6([]byte(trackerResp.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	return append(peersV4, peersV6...), nil
 }
 
+// AnnounceStopped tells the tracker we stopped sharing the torrent, with the totals of the session
+// Nothing is sent for torrents without a tracker.
+// It returns an error if one occurred.
+func (t *TorrentFile) AnnounceStopped(peerID [20]byte, port uint16, uploaded, downloaded int64) error {
+	if t.Announce == "" {
+		return nil
+	}
+	stats := announceStats{uploaded: uploaded, downloaded: downloaded, event: "stopped"}
+	_, err := t.announcePeers(peerID, port, stats)
+	return err
+}
 
+// localIPv6 returns a global unicast IPv6 address of this host, or nil if it has none
+func localIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		// Skip IPv4, and unique local addresses (fc00::/7) which are not reachable from the internet
+		if ip.To4() == nil && ip.IsGlobalUnicast() && ip[0]&0xfe != 0xfc {
+			return ip
+		}
+	}
+	return nil
+}
+
+
+
+// trackerHTTPClient returns the HTTP client used for announces and scrapes
+// Connections go through TrackerProxy if one is set.
+func trackerHTTPClient() *http.Client {
+	c := &http.Client{Timeout: 15 * time.Second}
+	if TrackerProxy != nil {
+		c.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return TrackerProxy.DialTimeout(network, addr, 15*time.Second)
+			},
+		}
+	}
+	return c
+}
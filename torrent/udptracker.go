@@ -0,0 +1,251 @@
+// Description: UDP tracker protocol (BEP 15) client.
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"bit-torrent/peers"
+)
+
+// udpProtocolID is the magic constant sent in every connect request
+const udpProtocolID uint64 = 0x41727101980
+
+// Actions of the UDP tracker protocol
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+// udpEvents are the event numbers of announces; a regular announce is 0
+var udpEvents = map[string]uint32{
+	"":          0,
+	"completed": 1,
+	"started":   2,
+	"stopped":   3,
+}
+
+// udpMaxScrape is the number of info hashes that fit in a single scrape packet
+const udpMaxScrape = 74
+
+// udpRetries is the number of times a request is sent before giving up
+const udpRetries = 3
+
+// udpTimeout is how long we wait for a response before resending a request
+const udpTimeout = 5 * time.Second
+
+// udpConnIDLifetime is how long a connection ID handed out by the tracker stays valid
+const udpConnIDLifetime = time.Minute
+
+// udpTracker is a connection to a UDP tracker
+type udpTracker struct {
+	conn     net.Conn
+	connID   uint64
+	connTime time.Time
+}
+
+// dialUDPTracker opens a UDP socket to the tracker in the given udp:// announce URL
+// It returns the tracker and an error if one occurred.
+func dialUDPTracker(announce string) (*udpTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("Not a UDP tracker: %s", announce)
+	}
+	// Going around the proxy would reveal our address, which is what the proxy is there to prevent
+	if TrackerProxy != nil {
+		return nil, fmt.Errorf("UDP tracker %s cannot be reached through a proxy", announce)
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{conn: conn}, nil
+}
+
+// Close closes the socket
+func (u *udpTracker) Close() error {
+	return u.conn.Close()
+}
+
+// roundTrip sends a request with the given action and payload and waits for the matching response.
+// The request is resent if no response arrives in time.
+// It returns the response payload (without action and transaction ID) and an error if one occurred.
+func (u *udpTracker) roundTrip(action uint32, payload []byte) ([]byte, error) {
+	var txID [4]byte
+	_, err := rand.Read(txID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var req []byte
+	if action == udpActionConnect {
+		req = make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	} else {
+		req = make([]byte, 16+len(payload))
+		binary.BigEndian.PutUint64(req[0:8], u.connID)
+		copy(req[16:], payload)
+	}
+	binary.BigEndian.PutUint32(req[8:12], action)
+	copy(req[12:16], txID[:])
+
+	// A datagram can be up to 64 KiB, room for thousands of peers
+	buf := make([]byte, 64*1024)
+	for attempt := 0; attempt < udpRetries; attempt++ {
+		_, err = u.conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+
+		u.conn.SetReadDeadline(time.Now().Add(udpTimeout))
+		for {
+			n, err := u.conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break // resend
+				}
+				return nil, err
+			}
+			if n < 8 || string(buf[4:8]) != string(txID[:]) {
+				continue // not the response we are waiting for
+			}
+			resAction := binary.BigEndian.Uint32(buf[0:4])
+			if resAction == udpActionError {
+				return nil, fmt.Errorf("Tracker error: %s", buf[8:n])
+			}
+			if resAction != action {
+				return nil, fmt.Errorf("Expected action %d but got %d", action, resAction)
+			}
+			res := make([]byte, n-8)
+			copy(res, buf[8:n])
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("Tracker did not respond after %d attempts", udpRetries)
+}
+
+// connect obtains a connection ID from the tracker unless we still hold a valid one
+// It returns an error if one occurred.
+func (u *udpTracker) connect() error {
+	if u.connID != 0 && time.Since(u.connTime) < udpConnIDLifetime {
+		return nil
+	}
+	res, err := u.roundTrip(udpActionConnect, nil)
+	if err != nil {
+		return err
+	}
+	if len(res) < 8 {
+		return fmt.Errorf("Received malformed connect response of length %d", len(res))
+	}
+	u.connID = binary.BigEndian.Uint64(res[0:8])
+	u.connTime = time.Now()
+	return nil
+}
+
+// scrape requests the swarm statistics for the given info hashes
+// It returns one result per info hash, in the same order, and an error if one occurred.
+func (u *udpTracker) scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += udpMaxScrape {
+		end := start + udpMaxScrape
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+		batch := infoHashes[start:end]
+
+		err := u.connect()
+		if err != nil {
+			return nil, err
+		}
+		payload := make([]byte, 0, 20*len(batch))
+		for _, h := range batch {
+			payload = append(payload, h[:]...)
+		}
+		res, err := u.roundTrip(udpActionScrape, payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) < 12*len(batch) {
+			return nil, fmt.Errorf("Received malformed scrape response of length %d", len(res))
+		}
+		for i, h := range batch {
+			offset := i * 12
+			results = append(results, ScrapeResult{
+				InfoHash:   h,
+				Complete:   int(binary.BigEndian.Uint32(res[offset : offset+4])),
+				Downloaded: int(binary.BigEndian.Uint32(res[offset+4 : offset+8])),
+				Incomplete: int(binary.BigEndian.Uint32(res[offset+8 : offset+12])),
+			})
+		}
+	}
+	return results, nil
+}
+
+// announce announces the torrent to the tracker
+// Peers are returned in the address family of the tracker connection.
+// It returns the announce interval in seconds, the peers and an error if one occurred.
+func (u *udpTracker) announce(infoHash, peerID [20]byte, port uint16, stats announceStats) (int, []peers.Peer, error) {
+	err := u.connect()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var key [4]byte
+	_, err = rand.Read(key[:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, 82)
+	copy(payload[0:20], infoHash[:])
+	copy(payload[20:40], peerID[:])
+	binary.BigEndian.PutUint64(payload[40:48], uint64(stats.downloaded))
+	binary.BigEndian.PutUint64(payload[48:56], uint64(stats.left))
+	binary.BigEndian.PutUint64(payload[56:64], uint64(stats.uploaded))
+	binary.BigEndian.PutUint32(payload[64:68], udpEvents[stats.event])
+	binary.BigEndian.PutUint32(payload[68:72], 0) // IP: let the tracker use the source address
+	copy(payload[72:76], key[:])
+	binary.BigEndian.PutUint32(payload[76:80], ^uint32(0)) // num_want: -1 for the tracker's default
+	binary.BigEndian.PutUint16(payload[80:82], port)
+
+	res, err := u.roundTrip(udpActionAnnounce, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(res) < 12 {
+		return 0, nil, fmt.Errorf("Received malformed announce response of length %d", len(res))
+	}
+	interval := int(binary.BigEndian.Uint32(res[0:4]))
+
+	var ps []peers.Peer
+	if addr, ok := u.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ps, err = peers.Unmarshal6(res[12:])
+	} else {
+		ps, err = peers.Unmarshal(res[12:])
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return interval, ps, nil
+}
+
+// requestPeersUDP requests peers from a UDP tracker and returns a slice of peers.
+func (t *TorrentFile) requestPeersUDP(peerID [20]byte, port uint16, stats announceStats) ([]peers.Peer, error) {
+	tr, err := dialUDPTracker(t.Announce)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	_, ps, err := tr.announce(t.InfoHash, peerID, port, stats)
+	return ps, err
+}
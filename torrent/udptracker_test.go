@@ -0,0 +1,169 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"bit-torrent/peers"
+	"bit-torrent/tracker"
+)
+
+// startUDPTracker serves a tracker store over UDP on a local port of the given network
+// It returns the udp:// announce URL and the connection, which the caller closes.
+func startUDPTracker(t *testing.T, network, addr string, store *tracker.Store) (string, net.PacketConn) {
+	t.Helper()
+	srv, err := tracker.NewUDPServer(store, 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("Cannot listen on %s: %v", addr, err)
+	}
+	go srv.Serve(conn)
+	return "udp://" + conn.LocalAddr().String() + "/announce", conn
+}
+
+func TestUDPAnnounceAndScrape(t *testing.T) {
+	store := tracker.NewStore(time.Hour)
+	infoHash := [20]byte{1, 2, 3}
+	for i := 0; i < 3; i++ {
+		_, _, err := store.Announce(tracker.AnnounceRequest{
+			InfoHash: infoHash,
+			PeerID:   [20]byte{byte(i + 1)},
+			IP:       net.IPv4(10, 0, 0, byte(i+1)),
+			Port:     6881,
+			Left:     int64(i), // the first peer is a seeder
+			NumWant:  -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	announce, conn := startUDPTracker(t, "udp4", "127.0.0.1:0", store)
+	defer conn.Close()
+
+	tr, err := dialUDPTracker(announce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	interval, ps, err := tr.announce(infoHash, [20]byte{9}, 6881, announceStats{left: 100, event: "started"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval != 1800 {
+		t.Errorf("Interval is %d, want 1800", interval)
+	}
+	if len(ps) != 3 {
+		t.Fatalf("Got %d peers, want 3: %v", len(ps), ps)
+	}
+	for _, p := range ps {
+		if !p.IP.Equal(net.IPv4(10, 0, 0, 1)) && !p.IP.Equal(net.IPv4(10, 0, 0, 2)) && !p.IP.Equal(net.IPv4(10, 0, 0, 3)) {
+			t.Errorf("Unexpected peer %s", p)
+		}
+	}
+
+	results, err := tr.scrape([][20]byte{infoHash, {4, 5, 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ScrapeResult{InfoHash: infoHash, Complete: 1, Incomplete: 3}
+	if results[0] != want {
+		t.Errorf("Scrape gave %+v, want %+v", results[0], want)
+	}
+	if results[1].Complete != 0 || results[1].Incomplete != 0 {
+		t.Errorf("Scrape of an unknown torrent gave %+v", results[1])
+	}
+}
+
+func TestUDPAnnounceIPv6(t *testing.T) {
+	store := tracker.NewStore(time.Hour)
+	infoHash := [20]byte{7}
+	_, _, err := store.Announce(tracker.AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   [20]byte{1},
+		IP:       net.ParseIP("2001:db8::1"),
+		Port:     51413,
+		NumWant:  -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	announce, conn := startUDPTracker(t, "udp6", "[::1]:0", store)
+	defer conn.Close()
+
+	tf := TorrentFile{Announce: announce, InfoHash: infoHash}
+	ps, err := tf.requestPeersUDP([20]byte{2}, 6881, announceStats{left: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || !ps[0].IP.Equal(net.ParseIP("2001:db8::1")) || ps[0].Port != 51413 {
+		t.Errorf("Got peers %v", ps)
+	}
+}
+
+// A reply with more IPv6 peers than fit in 2 KiB must not be truncated
+func TestUDPAnnounceLargeReply(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var many []peers.Peer
+	for i := 0; i < 300; i++ {
+		ip := net.ParseIP("2001:db8::")
+		binary.BigEndian.PutUint16(ip[14:], uint16(i))
+		many = append(many, peers.Peer{IP: ip, Port: 6881})
+	}
+	compact := peers.Marshal6(many)
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			res := make([]byte, 8)
+			binary.BigEndian.PutUint32(res[0:4], action)
+			copy(res[4:8], buf[12:16])
+			if action == udpActionConnect {
+				res = append(res, 0, 0, 0, 0, 0, 0, 0, 42)
+			} else {
+				res = append(res, make([]byte, 12)...)
+				res = append(res, compact...)
+			}
+			conn.WriteTo(res, addr)
+		}
+	}()
+
+	tr, err := dialUDPTracker("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	// The client reads the peers of an IPv4 tracker as IPv4, so check the size of the payload instead
+	err = tr.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tr.roundTrip(udpActionAnnounce, make([]byte, 82))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 12+len(compact) {
+		t.Fatalf("Reply has %d bytes, want %d", len(res), 12+len(compact))
+	}
+	ps, err := peers.Unmarshal6(res[12:])
+	if err != nil || len(ps) != len(many) {
+		t.Fatalf("Got %d peers and error %v, want %d", len(ps), err, len(many))
+	}
+}
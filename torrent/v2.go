@@ -0,0 +1,229 @@
+// Description: The v2 part of v2 and hybrid torrents (BEP 52): the file tree and the piece layers.
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bit-torrent/bencode"
+	"bit-torrent/merkle"
+	"bit-torrent/peer2peer"
+	"bit-torrent/storage"
+)
+
+// FileV2 is a file of the file tree of a v2 or hybrid torrent
+type FileV2 struct {
+	Path       string // relative to the torrent's directory, empty for a single-file torrent
+	Length     int64
+	PiecesRoot [32]byte   // root of the file's merkle tree, zero for an empty file
+	PieceLayer [][32]byte // hashes of the file's pieces, nil for a file of at most one piece or a layer we lack
+}
+
+// parseV2 reads the file tree of a v2 or hybrid info dictionary and the piece layers of the torrent
+// Piece layers are checked against the pieces roots, and a missing one is left nil. A v2-only torrent is identified
+// by its SHA-256 info hash truncated to 20 bytes and its files are aligned to pieces with pad files; a hybrid keeps
+// its v1 info hash, and its v1 files have to match the file tree.
+// It returns an error if the v2 metadata is invalid.
+func (t *TorrentFile) parseV2(info, layers []byte) error {
+	if t.PieceLength < merkle.BlockSize || t.PieceLength&(t.PieceLength-1) != 0 {
+		return fmt.Errorf("Invalid v2 piece length %d", t.PieceLength)
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(info))
+	if err != nil {
+		return err
+	}
+	dict, _ := decoded.(map[string]interface{})
+	tree, ok := dict["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Missing file tree in %s", t.Name)
+	}
+	var files []FileV2
+	err = walkFileTree(tree, nil, &files)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("Empty file tree in %s", t.Name)
+	}
+
+	var layerDict map[string]interface{}
+	if layers != nil {
+		decoded, err := bencode.Decode(bytes.NewReader(layers))
+		if err != nil {
+			return err
+		}
+		layerDict, _ = decoded.(map[string]interface{})
+	}
+	blocksPerPiece := t.PieceLength / merkle.BlockSize
+	for i := range files {
+		f := &files[i]
+		if f.Length <= int64(t.PieceLength) {
+			continue
+		}
+		raw, ok := layerDict[string(f.PiecesRoot[:])].(string)
+		if !ok {
+			continue
+		}
+		numPieces := int((f.Length + int64(t.PieceLength) - 1) / int64(t.PieceLength))
+		if len(raw) != numPieces*32 {
+			return fmt.Errorf("Piece layer of %s has %d bytes instead of %d", f.Path, len(raw), numPieces*32)
+		}
+		layer := make([][32]byte, numPieces)
+		for j := range layer {
+			copy(layer[j][:], raw[j*32:])
+		}
+		if merkle.LayerRoot(layer, blocksPerPiece) != f.PiecesRoot {
+			return fmt.Errorf("Piece layer of %s does not match its pieces root", f.Path)
+		}
+		f.PieceLayer = layer
+	}
+
+	// A single-file torrent's tree holds one file named after the torrent
+	if len(files) == 1 && files[0].Path == t.Name {
+		files[0].Path = ""
+	}
+	t.FilesV2 = files
+	t.InfoHashV2 = sha256.Sum256(info)
+	if t.PieceHashes != nil {
+		return t.checkHybridFiles()
+	}
+
+	copy(t.InfoHash[:], t.InfoHashV2[:20])
+	if files[0].Path == "" {
+		t.Files = nil
+		t.Length = int(files[0].Length)
+		return nil
+	}
+	var plain []storage.File
+	for _, f := range files {
+		plain = append(plain, storage.File{Path: f.Path, Length: f.Length})
+	}
+	t.Files = padFiles(plain, int64(t.PieceLength))
+	t.Length = 0
+	for _, f := range t.Files {
+		t.Length += int(f.Length)
+	}
+	return nil
+}
+
+// walkFileTree appends the files below a directory of a file tree to files, in the order of their names
+// A file is a dictionary with an entry under the empty key holding its length and pieces root.
+func walkFileTree(dir map[string]interface{}, parent []string, files *[]FileV2) error {
+	names := make([]string, 0, len(dir))
+	for name := range dir {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("Invalid file name %q in file tree", name)
+		}
+		node, ok := dir[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Invalid file tree entry %q", name)
+		}
+		elems := append(append([]string(nil), parent...), name)
+		entry, ok := node[""].(map[string]interface{})
+		if !ok {
+			err := walkFileTree(node, elems, files)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		f := FileV2{Path: path.Join(elems...)}
+		length, ok := entry["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("Invalid length of %s", f.Path)
+		}
+		f.Length = length
+		if length > 0 {
+			root, ok := entry["pieces root"].(string)
+			if !ok || len(root) != 32 {
+				return fmt.Errorf("Invalid pieces root of %s", f.Path)
+			}
+			copy(f.PiecesRoot[:], root)
+		}
+		*files = append(*files, f)
+	}
+	return nil
+}
+
+// checkHybridFiles checks that the v1 files of a hybrid torrent, without its pad files, are the files of its file tree
+func (t *TorrentFile) checkHybridFiles() error {
+	v1 := t.StorageFiles()
+	j := 0
+	for _, f := range v1 {
+		if f.Pad {
+			continue
+		}
+		if j >= len(t.FilesV2) || t.FilesV2[j].Path != f.Path || t.FilesV2[j].Length != f.Length {
+			return fmt.Errorf("The v1 and v2 files of hybrid torrent %s differ", t.Name)
+		}
+		j++
+	}
+	if j != len(t.FilesV2) {
+		return fmt.Errorf("The v1 and v2 files of hybrid torrent %s differ", t.Name)
+	}
+	return nil
+}
+
+// padFiles inserts a pad file after every file that does not end on a piece boundary, except the last one,
+// so that every file starts at the beginning of a piece
+func padFiles(files []storage.File, pieceLength int64) []storage.File {
+	var padded []storage.File
+	for i, f := range files {
+		padded = append(padded, f)
+		if rest := f.Length % pieceLength; rest != 0 && i < len(files)-1 {
+			n := pieceLength - rest
+			padded = append(padded, storage.File{Path: ".pad/" + strconv.FormatInt(n, 10), Length: n, Pad: true})
+		}
+	}
+	return padded
+}
+
+// checkPieceLayers returns an error if a v2-only torrent lacks the piece layer of a file longer than a piece,
+// without which its pieces cannot be verified
+func (t *TorrentFile) checkPieceLayers() error {
+	if t.PieceHashes != nil {
+		return nil
+	}
+	for _, f := range t.FilesV2 {
+		if f.Length > int64(t.PieceLength) && f.PieceLayer == nil {
+			return fmt.Errorf("The piece layer of %s is missing from %s", f.Path, t.Name)
+		}
+	}
+	return nil
+}
+
+// peerFilesV2 returns the files of the file tree with their offsets in the torrent's data, where every file
+// starts at a piece boundary
+func (t *TorrentFile) peerFilesV2() []peer2peer.FileV2 {
+	if t.FilesV2 == nil {
+		return nil
+	}
+	var files []peer2peer.FileV2
+	var offset int64
+	j := 0
+	for _, f := range t.StorageFiles() {
+		if !f.Pad && j < len(t.FilesV2) {
+			fv := t.FilesV2[j]
+			files = append(files, peer2peer.FileV2{
+				Offset:     offset,
+				Length:     fv.Length,
+				PiecesRoot: fv.PiecesRoot,
+				PieceLayer: fv.PieceLayer,
+			})
+			j++
+		}
+		offset += f.Length
+	}
+	return files
+}
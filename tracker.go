@@ -0,0 +1,80 @@
+// Description: The tracker command runs a BitTorrent tracker.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"bit-torrent/tracker"
+)
+
+// runTracker parses the tracker flags and serves announces and scrapes until the process is killed
+func runTracker(args []string) {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	httpAddr := fs.String("http", ":6969", "address to serve HTTP announces and scrapes on")
+	udpAddr := fs.String("udp", ":6969", "address to serve UDP announces and scrapes on (empty to disable)")
+	interval := fs.Duration("interval", 30*time.Minute, "announce interval handed to clients")
+	whitelistPath := fs.String("whitelist", "", "file with the hex info hashes to track, one per line (default: track everything)")
+	fs.Parse(args)
+
+	// Peers that miss two announces in a row are forgotten
+	store := tracker.NewStore(2*(*interval) + time.Minute)
+	if *whitelistPath != "" {
+		hashes, err := readWhitelist(*whitelistPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store.SetWhitelist(hashes)
+		fmt.Printf("Tracking %d whitelisted torrents\n", len(hashes))
+	}
+	go store.RunExpiry(time.Minute, nil)
+
+	// Both servers share the store, so HTTP and UDP clients see the same swarms
+	if *udpAddr != "" {
+		udpServer, err := tracker.NewUDPServer(store, *interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Serving UDP tracker on %s\n", *udpAddr)
+		go func() {
+			log.Fatal(udpServer.ListenAndServe(*udpAddr))
+		}()
+	}
+
+	fmt.Printf("Serving HTTP tracker on %s\n", *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, tracker.NewHTTPServer(store, *interval)))
+}
+
+// readWhitelist reads hex encoded info hashes, one per line; blank lines and lines starting with # are skipped
+// It returns the info hashes and an error if one occurred.
+func readWhitelist(path string) ([][20]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var hashes [][20]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(line)
+		if err != nil || len(raw) != 20 {
+			return nil, fmt.Errorf("Invalid info hash %q in %s", line, path)
+		}
+		var h [20]byte
+		copy(h[:], raw)
+		hashes = append(hashes, h)
+	}
+	return hashes, scanner.Err()
+}
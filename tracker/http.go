@@ -0,0 +1,226 @@
+// Description: HTTP tracker server serving /announce and /scrape.
+package tracker
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"bit-torrent/bencode"
+	"bit-torrent/peers"
+)
+
+// HTTPServer serves announces and scrapes over HTTP from a Store
+type HTTPServer struct {
+	Store    *Store
+	Interval time.Duration // how often clients should announce
+}
+
+type bencodeAnnounceResp struct {
+	Interval    int         `bencode:"interval"`
+	MinInterval int         `bencode:"min interval"`
+	Complete    int         `bencode:"complete"`
+	Incomplete  int         `bencode:"incomplete"`
+	Peers       interface{} `bencode:"peers"`
+	Peers6      string      `bencode:"peers6,omitempty"`
+}
+
+// bencodePeer is a peer in a non-compact announce response
+type bencodePeer struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type bencodeScrapeResp struct {
+	Files map[string]bencodeScrapeFile `bencode:"files"`
+}
+
+type bencodeFailureResp struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+// NewHTTPServer creates an HTTP tracker that asks clients to announce every interval
+func NewHTTPServer(store *Store, interval time.Duration) *HTTPServer {
+	return &HTTPServer{Store: store, Interval: interval}
+}
+
+// ServeHTTP routes /announce and /scrape requests
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		s.serveAnnounce(w, r)
+	case "/scrape":
+		s.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveAnnounce handles an announce request and responds with peers of the swarm
+func (s *HTTPServer) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	req, err := parseAnnounceParams(params, r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	selected, stats, err := s.Store.Announce(req)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	var addrs []peers.Peer
+	for i := range selected {
+		addrs = append(addrs, selected[i].Addrs()...)
+	}
+
+	resp := bencodeAnnounceResp{
+		Interval:    int(s.Interval / time.Second),
+		MinInterval: int(s.Interval / time.Second / 2),
+		Complete:    stats.Complete,
+		Incomplete:  stats.Incomplete,
+	}
+	if params.Get("compact") == "0" {
+		noPeerID := params.Get("no_peer_id") == "1"
+		list := make([]bencodePeer, 0, len(addrs))
+		for i := range selected {
+			for _, addr := range selected[i].Addrs() {
+				bp := bencodePeer{IP: addr.IP.String(), Port: int(addr.Port)}
+				if !noPeerID {
+					bp.PeerID = string(selected[i].ID[:])
+				}
+				list = append(list, bp)
+			}
+		}
+		resp.Peers = list
+	} else {
+		resp.Peers = string(peers.Marshal(addrs))
+		resp.Peers6 = string(peers.Marshal6(addrs))
+	}
+	writeBencode(w, resp)
+}
+
+// serveScrape handles a scrape request for the info hashes in the query, or for every torrent if none are given
+func (s *HTTPServer) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, raw := range r.URL.Query()["info_hash"] {
+		h, err := parseHash(raw)
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+		infoHashes = append(infoHashes, h)
+	}
+
+	resp := bencodeScrapeResp{Files: make(map[string]bencodeScrapeFile)}
+	for h, stats := range s.Store.Scrape(infoHashes) {
+		resp.Files[string(h[:])] = bencodeScrapeFile{
+			Complete:   stats.Complete,
+			Downloaded: stats.Downloaded,
+			Incomplete: stats.Incomplete,
+		}
+	}
+	writeBencode(w, resp)
+}
+
+// parseAnnounceParams reads the announce parameters from the query string
+// The peer's address is taken from the connection; an ipv6 parameter adds an IPv6 address (BEP 7).
+// It returns the request and an error if a parameter is missing or malformed.
+func parseAnnounceParams(params url.Values, remoteAddr string) (AnnounceRequest, error) {
+	var req AnnounceRequest
+	var err error
+
+	req.InfoHash, err = parseHash(params.Get("info_hash"))
+	if err != nil {
+		return req, err
+	}
+	req.PeerID, err = parseHash(params.Get("peer_id"))
+	if err != nil {
+		return req, fmt.Errorf("Invalid peer_id")
+	}
+	port, err := strconv.ParseUint(params.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return req, fmt.Errorf("Invalid port")
+	}
+	req.Port = uint16(port)
+
+	for _, field := range []struct {
+		name string
+		dst  *int64
+	}{{"uploaded", &req.Uploaded}, {"downloaded", &req.Downloaded}, {"left", &req.Left}} {
+		v := params.Get(field.name)
+		if v == "" {
+			continue
+		}
+		*field.dst, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return req, fmt.Errorf("Invalid %s", field.name)
+		}
+	}
+	if v := params.Get("numwant"); v != "" {
+		req.NumWant, _ = strconv.Atoi(v)
+	}
+
+	req.Event = params.Get("event")
+	switch req.Event {
+	case EventNone, EventStarted, EventCompleted, EventStopped:
+	default:
+		return req, fmt.Errorf("Invalid event %q", req.Event)
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return req, err
+	}
+	req.IP = net.ParseIP(host)
+	if v := params.Get("ipv6"); v != "" {
+		// The address may be given with a port, in which case the port is ignored
+		if h, _, err := net.SplitHostPort(v); err == nil {
+			v = h
+		}
+		req.IPv6 = net.ParseIP(v)
+	}
+	return req, nil
+}
+
+// parseHash converts a raw 20-byte query parameter into an array
+func parseHash(raw string) ([20]byte, error) {
+	var h [20]byte
+	if len(raw) != 20 {
+		return h, fmt.Errorf("Invalid info_hash of length %d", len(raw))
+	}
+	copy(h[:], raw)
+	return h, nil
+}
+
+// writeFailure responds with a bencoded failure reason
+func writeFailure(w http.ResponseWriter, err error) {
+	writeBencode(w, bencodeFailureResp{FailureReason: err.Error()})
+}
+
+// writeBencode bencodes val and writes it as the response body
+func writeBencode(w http.ResponseWriter, val interface{}) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, val)
+	if err != nil {
+		log.Printf("Error encoding tracker response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,270 @@
+// Description: In-memory swarm store shared by the tracker servers.
+// Package tracker implements a BitTorrent tracker that serves announces and scrapes.
+package tracker
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"bit-torrent/peers"
+)
+
+// DefaultNumWant is the number of peers returned when the client does not ask for a number
+const DefaultNumWant = 50
+
+// MaxNumWant is the largest number of peers returned in a single announce
+const MaxNumWant = 200
+
+// Events a client can report in an announce
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// AnnounceRequest holds the parameters of an announce, independent of the transport it arrived on
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	IP         net.IP // address the announce came from
+	IPv6       net.IP // additional IPv6 address reported by the client (BEP 7), may be nil
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+	NumWant    int
+}
+
+// Peer is a peer that announced itself to the tracker
+// A peer may be reachable over IPv4, IPv6 or both.
+type Peer struct {
+	ID       [20]byte
+	IPv4     net.IP
+	IPv6     net.IP
+	Port     uint16
+	Left     int64
+	LastSeen time.Time
+}
+
+// Addrs returns one peers.Peer for every address the peer is reachable on
+func (p *Peer) Addrs() []peers.Peer {
+	var addrs []peers.Peer
+	if p.IPv4 != nil {
+		addrs = append(addrs, peers.Peer{IP: p.IPv4, Port: p.Port})
+	}
+	if p.IPv6 != nil {
+		addrs = append(addrs, peers.Peer{IP: p.IPv6, Port: p.Port})
+	}
+	return addrs
+}
+
+// Stats holds the counters reported in announce and scrape responses
+type Stats struct {
+	Complete   int // number of seeders
+	Incomplete int // number of leechers
+	Downloaded int // number of completed downloads
+}
+
+// swarm holds the peers of one torrent
+type swarm struct {
+	peers      map[[20]byte]*Peer
+	downloaded int
+}
+
+// Store keeps the swarms of all torrents in memory
+// It is safe for concurrent use by several servers.
+type Store struct {
+	mu          sync.Mutex
+	swarms      map[[20]byte]*swarm
+	whitelist   map[[20]byte]bool
+	peerTimeout time.Duration
+}
+
+// NewStore creates an empty store that forgets peers which have not announced for peerTimeout
+func NewStore(peerTimeout time.Duration) *Store {
+	return &Store{
+		swarms:      make(map[[20]byte]*swarm),
+		peerTimeout: peerTimeout,
+	}
+}
+
+// SetWhitelist restricts the tracker to the given info hashes
+// An empty whitelist allows every torrent.
+func (s *Store) SetWhitelist(infoHashes [][20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(infoHashes) == 0 {
+		s.whitelist = nil
+		return
+	}
+	s.whitelist = make(map[[20]byte]bool, len(infoHashes))
+	for _, h := range infoHashes {
+		s.whitelist[h] = true
+	}
+}
+
+// Allowed reports whether the tracker serves the torrent with the given info hash
+func (s *Store) Allowed(infoHash [20]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allowed(infoHash)
+}
+
+func (s *Store) allowed(infoHash [20]byte) bool {
+	return s.whitelist == nil || s.whitelist[infoHash]
+}
+
+// Announce records the announcing peer and picks other peers of the swarm for it
+// The returned peers are copies and may be used after further announces.
+// It returns the peers, the swarm statistics and an error if the torrent is not allowed.
+func (s *Store) Announce(req AnnounceRequest) ([]Peer, Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.allowed(req.InfoHash) {
+		return nil, Stats{}, fmt.Errorf("Torrent %x is not tracked here", req.InfoHash)
+	}
+
+	sw, ok := s.swarms[req.InfoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[[20]byte]*Peer)}
+		s.swarms[req.InfoHash] = sw
+	}
+
+	now := time.Now()
+	if req.Event == EventStopped {
+		delete(sw.peers, req.PeerID)
+	} else {
+		p, ok := sw.peers[req.PeerID]
+		if !ok {
+			p = &Peer{ID: req.PeerID}
+			sw.peers[req.PeerID] = p
+		}
+		if ip := req.IP.To4(); ip != nil {
+			p.IPv4 = ip
+		} else if req.IP != nil {
+			p.IPv6 = req.IP
+		}
+		if req.IPv6 != nil && req.IPv6.To4() == nil {
+			p.IPv6 = req.IPv6
+		}
+		p.Port = req.Port
+		p.Left = req.Left
+		p.LastSeen = now
+		if req.Event == EventCompleted {
+			sw.downloaded++
+		}
+	}
+
+	numWant := req.NumWant
+	if numWant <= 0 {
+		numWant = DefaultNumWant
+	}
+	if numWant > MaxNumWant {
+		numWant = MaxNumWant
+	}
+
+	// Pick random peers other than the announcing one; seeders are of no use to a seeder
+	var selected []Peer
+	if req.Event != EventStopped {
+		for id, p := range sw.peers {
+			if id == req.PeerID || now.Sub(p.LastSeen) > s.peerTimeout {
+				continue
+			}
+			if req.Left == 0 && p.Left == 0 {
+				continue
+			}
+			selected = append(selected, *p)
+		}
+		rand.Shuffle(len(selected), func(i, j int) {
+			selected[i], selected[j] = selected[j], selected[i]
+		})
+		if len(selected) > numWant {
+			selected = selected[:numWant]
+		}
+	}
+
+	return selected, sw.stats(now, s.peerTimeout), nil
+}
+
+// Scrape returns the statistics of the given torrents
+// If no info hashes are given, all allowed torrents are reported.
+func (s *Store) Scrape(infoHashes [][20]byte) map[[20]byte]Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	res := make(map[[20]byte]Stats)
+	if len(infoHashes) == 0 {
+		for h, sw := range s.swarms {
+			if s.allowed(h) {
+				res[h] = sw.stats(now, s.peerTimeout)
+			}
+		}
+		return res
+	}
+	for _, h := range infoHashes {
+		if !s.allowed(h) {
+			continue
+		}
+		if sw, ok := s.swarms[h]; ok {
+			res[h] = sw.stats(now, s.peerTimeout)
+		} else {
+			res[h] = Stats{}
+		}
+	}
+	return res
+}
+
+// Expire removes the peers that have not announced within the peer timeout and drops empty swarms
+func (s *Store) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for h, sw := range s.swarms {
+		for id, p := range sw.peers {
+			if now.Sub(p.LastSeen) > s.peerTimeout {
+				delete(sw.peers, id)
+			}
+		}
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, h)
+		}
+	}
+}
+
+// RunExpiry calls Expire every interval until done is closed
+func (s *Store) RunExpiry(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Expire()
+		case <-done:
+			return
+		}
+	}
+}
+
+// stats counts the live seeders and leechers of the swarm
+func (sw *swarm) stats(now time.Time, peerTimeout time.Duration) Stats {
+	st := Stats{Downloaded: sw.downloaded}
+	for _, p := range sw.peers {
+		if now.Sub(p.LastSeen) > peerTimeout {
+			continue
+		}
+		if p.Left == 0 {
+			st.Complete++
+		} else {
+			st.Incomplete++
+		}
+	}
+	return st
+}
@@ -0,0 +1,219 @@
+// Description: UDP tracker server (BEP 15).
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"bit-torrent/peers"
+)
+
+// udpProtocolID is the magic constant every connect request starts with
+const udpProtocolID uint64 = 0x41727101980
+
+// Actions of the UDP tracker protocol
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+// udpEvents maps the event numbers of UDP announces to the events of HTTP announces
+var udpEvents = []string{EventNone, EventCompleted, EventStarted, EventStopped}
+
+// udpAnnounceSize is the length of an announce request without BEP 41 options
+const udpAnnounceSize = 98
+
+// udpConnIDPeriod is the time slot a connection ID is issued for.
+// IDs from the current and the previous slot are accepted, so an ID lives between one and two periods.
+const udpConnIDPeriod = time.Minute
+
+// UDPServer serves announces and scrapes over UDP from a Store
+type UDPServer struct {
+	Store    *Store
+	Interval time.Duration // how often clients should announce
+	secret   []byte        // key for the connection ID hashes
+}
+
+// NewUDPServer creates a UDP tracker that asks clients to announce every interval
+// Connection IDs are keyed with a random secret, so they do not survive a restart.
+func NewUDPServer(store *Store, interval time.Duration) (*UDPServer, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPServer{Store: store, Interval: interval, secret: secret}, nil
+}
+
+// ListenAndServe listens on the UDP address and serves requests until an error occurs
+func (s *UDPServer) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// Serve reads requests from conn and answers them until reading fails
+func (s *UDPServer) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		res := s.handle(buf[:n], udpAddr)
+		if res == nil {
+			continue
+		}
+		_, err = conn.WriteTo(res, addr)
+		if err != nil {
+			log.Printf("Error answering %s: %v", addr, err)
+		}
+	}
+}
+
+// handle processes one request packet and returns the response packet, or nil to drop the request
+func (s *UDPServer) handle(req []byte, addr *net.UDPAddr) []byte {
+	connID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	txID := req[12:16]
+
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		res := udpHeader(udpActionConnect, txID, 8)
+		binary.BigEndian.PutUint64(res[8:16], s.connectionID(addr.IP, time.Now()))
+		return res
+	}
+
+	// Everything but connect must carry an ID we handed out to this address
+	if !s.validConnectionID(connID, addr.IP) {
+		return udpError(txID, "Invalid connection ID")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		return s.handleAnnounce(req, addr, txID)
+	case udpActionScrape:
+		return s.handleScrape(req, txID)
+	default:
+		return udpError(txID, "Unknown action")
+	}
+}
+
+// handleAnnounce answers an announce request
+// Peers are returned in the address family the request arrived on.
+func (s *UDPServer) handleAnnounce(req []byte, addr *net.UDPAddr, txID []byte) []byte {
+	if len(req) < udpAnnounceSize {
+		return udpError(txID, "Malformed announce")
+	}
+	var ar AnnounceRequest
+	copy(ar.InfoHash[:], req[16:36])
+	copy(ar.PeerID[:], req[36:56])
+	ar.Downloaded = int64(binary.BigEndian.Uint64(req[56:64]))
+	ar.Left = int64(binary.BigEndian.Uint64(req[64:72]))
+	ar.Uploaded = int64(binary.BigEndian.Uint64(req[72:80]))
+	event := binary.BigEndian.Uint32(req[80:84])
+	if int(event) >= len(udpEvents) {
+		return udpError(txID, "Invalid event")
+	}
+	ar.Event = udpEvents[event]
+	// The IP field (req[84:88]) is ignored so nobody can announce a host other than their own
+	ar.IP = addr.IP
+	ar.NumWant = int(int32(binary.BigEndian.Uint32(req[92:96])))
+	ar.Port = binary.BigEndian.Uint16(req[96:98])
+
+	selected, stats, err := s.Store.Announce(ar)
+	if err != nil {
+		return udpError(txID, err.Error())
+	}
+
+	var addrs []peers.Peer
+	for i := range selected {
+		addrs = append(addrs, selected[i].Addrs()...)
+	}
+	var compact []byte
+	if addr.IP.To4() != nil {
+		compact = peers.Marshal(addrs)
+	} else {
+		compact = peers.Marshal6(addrs)
+	}
+
+	res := udpHeader(udpActionAnnounce, txID, 12+len(compact))
+	binary.BigEndian.PutUint32(res[8:12], uint32(s.Interval/time.Second))
+	binary.BigEndian.PutUint32(res[12:16], uint32(stats.Incomplete))
+	binary.BigEndian.PutUint32(res[16:20], uint32(stats.Complete))
+	copy(res[20:], compact)
+	return res
+}
+
+// handleScrape answers a scrape request
+func (s *UDPServer) handleScrape(req []byte, txID []byte) []byte {
+	payload := req[16:]
+	if len(payload) == 0 || len(payload)%20 != 0 {
+		return udpError(txID, "Malformed scrape")
+	}
+	infoHashes := make([][20]byte, len(payload)/20)
+	for i := range infoHashes {
+		copy(infoHashes[i][:], payload[i*20:(i+1)*20])
+	}
+
+	stats := s.Store.Scrape(infoHashes)
+	res := udpHeader(udpActionScrape, txID, 12*len(infoHashes))
+	for i, h := range infoHashes {
+		st := stats[h] // torrents that are not allowed are reported as empty
+		offset := 8 + i*12
+		binary.BigEndian.PutUint32(res[offset:offset+4], uint32(st.Complete))
+		binary.BigEndian.PutUint32(res[offset+4:offset+8], uint32(st.Downloaded))
+		binary.BigEndian.PutUint32(res[offset+8:offset+12], uint32(st.Incomplete))
+	}
+	return res
+}
+
+// connectionID computes the connection ID for an address in the time slot containing t
+// The ID is a keyed hash, so the server does not need to remember the IDs it handed out.
+func (s *UDPServer) connectionID(ip net.IP, t time.Time) uint64 {
+	slot := make([]byte, 8)
+	binary.BigEndian.PutUint64(slot, uint64(t.Unix()/int64(udpConnIDPeriod/time.Second)))
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(ip.To16())
+	mac.Write(slot)
+	return binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+}
+
+// validConnectionID reports whether connID was issued to ip in the current or the previous time slot
+func (s *UDPServer) validConnectionID(connID uint64, ip net.IP) bool {
+	now := time.Now()
+	return connID == s.connectionID(ip, now) ||
+		connID == s.connectionID(ip, now.Add(-udpConnIDPeriod))
+}
+
+// udpHeader allocates a response of the given payload length and fills in action and transaction ID
+func udpHeader(action uint32, txID []byte, payloadLen int) []byte {
+	res := make([]byte, 8+payloadLen)
+	binary.BigEndian.PutUint32(res[0:4], action)
+	copy(res[4:8], txID)
+	return res
+}
+
+// udpError builds an error response carrying msg
+func udpError(txID []byte, msg string) []byte {
+	res := udpHeader(udpActionError, txID, len(msg))
+	copy(res[8:], msg)
+	return res
+}
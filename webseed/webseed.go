@@ -0,0 +1,159 @@
+// Description: Web seeds (BEP 19): the data of a torrent read from an HTTP server with range requests.
+// Package webseed maps the data of a torrent, the concatenation of its files, onto the URLs of the files on the
+// server, so a web seed can be read like any other io.ReaderAt.
+package webseed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"bit-torrent/proxy"
+	"bit-torrent/storage"
+)
+
+// Proxy is the proxy web seeds are reached through, or nil to connect directly
+var Proxy proxy.Dialer
+
+// Timeout is how long one request to a web seed may take
+var Timeout = 60 * time.Second
+
+// Seed reads the data of a torrent from a web seed
+type Seed struct {
+	URL    string
+	base   *url.URL
+	name   string
+	files  []storage.File
+	client *http.Client
+}
+
+// New creates a web seed for the torrent with the given name and files, as listed in its url-list
+// It returns the seed and an error if the URL is not an HTTP URL.
+func New(rawURL, name string, files []storage.File) (*Seed, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("Unsupported web seed URL %s", rawURL)
+	}
+	return &Seed{URL: rawURL, base: base, name: name, files: files, client: httpClient()}, nil
+}
+
+// Host returns the host the seed's requests go to
+func (s *Seed) Host() string {
+	return s.base.Host
+}
+
+// String returns the URL of the seed
+func (s *Seed) String() string {
+	return s.URL
+}
+
+// fileURL returns the URL of a file of the torrent
+// A URL ending in a slash is a directory the torrent's name is appended to; the files of a multi-file torrent are
+// below that directory. A single-file torrent's URL may also name the file itself.
+func (s *Seed) fileURL(f storage.File) string {
+	u := *s.base
+	elems := []string{s.name}
+	if f.Path != "" {
+		elems = append(elems, strings.Split(f.Path, "/")...)
+	} else if !strings.HasSuffix(u.Path, "/") {
+		return u.String()
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.Path += strings.Join(elems, "/")
+	u.RawPath = ""
+	return u.String()
+}
+
+// ReadAt reads len(p) bytes of the torrent's data at offset off, with one range request per file it spans
+// Pad files are not requested; they read as zeros.
+func (s *Seed) ReadAt(p []byte, off int64) (int, error) {
+	done := 0
+	var start int64
+	for _, f := range s.files {
+		end := start + f.Length
+		if done == len(p) {
+			break
+		}
+		if off+int64(done) >= end {
+			start = end
+			continue
+		}
+		at := off + int64(done) - start
+		n := len(p) - done
+		if int64(n) > end-(off+int64(done)) {
+			n = int(end - (off + int64(done)))
+		}
+		if f.Pad {
+			for i := done; i < done+n; i++ {
+				p[i] = 0
+			}
+		} else {
+			err := s.get(s.fileURL(f), p[done:done+n], at)
+			if err != nil {
+				return done, err
+			}
+		}
+		done += n
+		start = end
+	}
+	if done < len(p) {
+		return done, io.EOF
+	}
+	return done, nil
+}
+
+// get reads len(p) bytes of the file at u, starting at offset off
+// A server that ignores the range and sends the whole file is read up to the range.
+func (s *Seed) get(u string, p []byte, off int64) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		_, err = io.CopyN(ioutil.Discard, resp.Body, off)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Web seed %s answered %s for %s", s.URL, resp.Status, u)
+	}
+	_, err = io.ReadFull(resp.Body, p)
+	if err != nil {
+		return fmt.Errorf("Could not read %d bytes of %s: %v", len(p), u, err)
+	}
+	return nil
+}
+
+// httpClient returns the HTTP client used for requests to web seeds
+// Connections go through Proxy if one is set.
+func httpClient() *http.Client {
+	c := &http.Client{Timeout: Timeout}
+	if Proxy != nil {
+		c.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return Proxy.DialTimeout(network, addr, 15*time.Second)
+			},
+		}
+	}
+	return c
+}
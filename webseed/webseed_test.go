@@ -0,0 +1,144 @@
+package webseed
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bit-torrent/storage"
+)
+
+// fileServer serves files by path, recording the paths requested
+// With ignoreRange it answers every request with the whole file and 200 OK, like servers without range support.
+type fileServer struct {
+	files       map[string][]byte
+	ignoreRange bool
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requested = append(s.requested, r.URL.Path)
+	s.mu.Unlock()
+	data, ok := s.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if s.ignoreRange {
+		w.Write(data)
+		return
+	}
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+}
+
+// content returns n bytes that start with the byte first
+func content(first byte, n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = first + byte(i)
+	}
+	return data
+}
+
+func TestReadAtMultiFile(t *testing.T) {
+	a, b := content(0, 100), content(100, 50)
+	srv := &fileServer{files: map[string][]byte{"/seed/dir/a": a, "/seed/dir/s/b": b}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	files := []storage.File{
+		{Path: "a", Length: 100},
+		{Path: ".pad/20", Length: 20, Pad: true},
+		{Path: "s/b", Length: 50},
+	}
+	seed, err := New(ts.URL+"/seed/", "dir", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// From the end of a, across the pad file, into b
+	p := make([]byte, 40)
+	n, err := seed.ReadAt(p, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte(nil), a[90:]...), make([]byte, 20)...), b[:10]...)
+	if n != len(p) || !bytes.Equal(p, want) {
+		t.Errorf("Read %d bytes %v, want %v", n, p, want)
+	}
+	for _, path := range srv.requested {
+		if strings.Contains(path, ".pad") {
+			t.Errorf("Pad file %s was requested", path)
+		}
+	}
+	if len(srv.requested) != 2 {
+		t.Errorf("Made %d requests, want 2", len(srv.requested))
+	}
+
+	// Past the end of the data
+	_, err = seed.ReadAt(make([]byte, 10), 165)
+	if err == nil {
+		t.Error("Read past the end of the data")
+	}
+}
+
+func TestReadAtSingleFile(t *testing.T) {
+	data := content(0, 64)
+	srv := &fileServer{files: map[string][]byte{"/file.iso": data}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	seed, err := New(ts.URL+"/file.iso", "name.iso", []storage.File{{Length: 64}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 16)
+	_, err = seed.ReadAt(p, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[8:24]) {
+		t.Errorf("Read %v, want %v", p, data[8:24])
+	}
+}
+
+func TestReadAtWithoutRangeSupport(t *testing.T) {
+	data := content(0, 200)
+	srv := &fileServer{files: map[string][]byte{"/name": data}, ignoreRange: true}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	seed, err := New(ts.URL+"/", "name", []storage.File{{Length: 200}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 50)
+	_, err = seed.ReadAt(p, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[120:170]) {
+		t.Errorf("Read %v, want %v", p, data[120:170])
+	}
+}
+
+func TestReadAtError(t *testing.T) {
+	ts := httptest.NewServer(&fileServer{})
+	defer ts.Close()
+
+	seed, err := New(ts.URL+"/", "missing", []storage.File{{Length: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = seed.ReadAt(make([]byte, 10), 0)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Got error %v, want a 404", err)
+	}
+}